@@ -27,7 +27,6 @@ import (
 	"encoding/pem"
 	"fmt"
 	"io"
-	"log"
 	"os"
 	"strings"
 )
@@ -65,36 +64,27 @@ func KeyGeneratorWrapper(keyType string, keyBits int, keyCurve string) (key inte
 	return
 }
 
-// WritePrivKeyWrapper is a wrapper for writing private keys.
+// WritePrivKeyWrapper is a wrapper for writing private keys, the key file is created with mode 0600 or truncated.
 func WritePrivKeyWrapper(keyType string, key interface{}, keyFile string) (err error) {
 	keyType_ := strings.ToUpper(keyType)
-	file_, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, os.ModePerm)
+	file_, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		log.Println(err)
 		return
 	}
 	defer func(file_ *os.File) {
-		err := file_.Close()
-		if err != nil {
-			log.Println(err)
+		closeErr := file_.Close()
+		if err == nil {
+			err = closeErr
 		}
 	}(file_)
 	switch keyType_ {
 	case "RSA":
 		{
 			err = WriteRsaPrivKeyPem(file_, key.(*rsa.PrivateKey))
-			if err != nil {
-				log.Println(err)
-				return
-			}
 		}
 	case "ECDSA":
 		{
 			err = WriteEccPrivKeyPem(file_, key.(*ecdsa.PrivateKey))
-			if err != nil {
-				log.Println(err)
-				return
-			}
 		}
 	}
 	return
@@ -21,6 +21,9 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -82,3 +85,27 @@ func TestGenECCCSR(t *testing.T) {
 	_ = WriteEccPrivKeyPem(os.Stdout, privKey_)
 	t.Log(GetCSRString(csr_))
 }
+
+func TestWritePrivKeyWrapper(t *testing.T) {
+	keyFile_ := filepath.Join(t.TempDir(), "key.pem")
+	// Written twice, the second key replaces the first one.
+	for i := 0; i < 2; i++ {
+		if err := WritePrivKeyWrapper("ecdsa", GenEccKey(elliptic.P256()), keyFile_); err != nil {
+			t.Fatal(err)
+		}
+	}
+	content_, err := os.ReadFile(keyFile_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(content_), "BEGIN"); n != 1 {
+		t.Errorf("got %d keys in key file", n)
+	}
+	info_, err := os.Stat(keyFile_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info_.Mode().Perm() != 0600 {
+		t.Errorf("key file mode %v", info_.Mode().Perm())
+	}
+}
@@ -0,0 +1,332 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	zerosslIPCert "github.com/tinkernels/zerossl-ip-cert"
+)
+
+// DefaultCaddyAdmin is the default caddy admin api address.
+const DefaultCaddyAdmin = "localhost:2019"
+
+// caddyValidationServer is the server name created for validation when no caddy server listens on the port.
+const caddyValidationServer = "zerossl_validation"
+
+// loadCaddyConfig posts the config file to caddy admin api /load endpoint.
+func loadCaddyConfig(ctx context.Context, admin, configFile, adapter string) (err error) {
+	if admin == "" {
+		admin = DefaultCaddyAdmin
+	}
+	config_, err := os.ReadFile(configFile)
+	if err != nil {
+		return
+	}
+	contentType_ := "application/json"
+	if adapter != "" && adapter != "json" {
+		contentType_ = "text/" + adapter
+	}
+	req_, err := http.NewRequestWithContext(ctx, http.MethodPost, caddyAdminUrl(admin, "/load"), bytes.NewReader(config_))
+	if err != nil {
+		return
+	}
+	req_.Header.Set("Content-Type", contentType_)
+	return doPostActionRequest(req_)
+}
+
+// CaddyValidationResponder serves http file validation content with a temporary static_response route
+// added via caddy admin api.
+type CaddyValidationResponder struct {
+	Admin  string // caddy admin api address
+	Server string // caddy http server name, created when empty and no server listens on the validation port
+	Logger *slog.Logger
+
+	routeID string
+	// tempServer is the temporary server the route is added to, removed in Stop of its last user.
+	tempServer string
+}
+
+// caddyMu guards finding, creating and removing the temporary server, and tempServerUsers.
+var caddyMu sync.Mutex
+
+// tempServerUsers is the number of validations using the temporary server.
+var tempServerUsers int
+
+type caddyServer struct {
+	Listen []string `json:"listen"`
+	// Routes is nil if the server has no routes.
+	Routes *[]json.RawMessage `json:"routes"`
+}
+
+// caddyConfig is the part of caddy config used by CaddyValidationResponder, nil fields are missing in the config.
+type caddyConfig struct {
+	Apps *struct {
+		Http *struct {
+			Servers *map[string]caddyServer `json:"servers"`
+		} `json:"http"`
+	} `json:"apps"`
+}
+
+// caddyAdminError is returned when caddy admin api responds with a status code other than 2xx.
+type caddyAdminError struct {
+	Method, Path string
+	StatusCode   int
+	Message      string
+}
+
+func (e *caddyAdminError) Error() string {
+	return fmt.Sprintf("caddy admin %v %v returned status code %d: %s", e.Method, e.Path, e.StatusCode, e.Message)
+}
+
+// isCaddyNotFound reports whether err is a not found response of caddy admin api.
+func isCaddyNotFound(err error) bool {
+	var adminErr_ *caddyAdminError
+	return errors.As(err, &adminErr_) && adminErr_.StatusCode == http.StatusNotFound
+}
+
+// Start adds the validation route. Leftovers of a validation of the cert that didn't stop, the route, or the
+// temporary server if not in use, are removed first, so their ids don't conflict.
+func (r *CaddyValidationResponder) Start(ctx context.Context, certInfo *zerosslIPCert.CertificateInfoModel) (err error) {
+	if r.Admin == "" {
+		r.Admin = DefaultCaddyAdmin
+	}
+	v, ok := certInfo.Validation.OtherMethods[certInfo.CommonName]
+	if !ok {
+		return fmt.Errorf("no validation info for %v", certInfo.CommonName)
+	}
+	validateHttpUrl_, err := url.Parse(v.FileValidationUrlHttp)
+	if err != nil {
+		return
+	}
+	port_ := validateHttpUrl_.Port()
+	if port_ == "" {
+		port_ = "80"
+	}
+	routeID_ := "zerossl_validation_" + certInfo.ID
+	route_ := map[string]interface{}{
+		"@id":   routeID_,
+		"match": []map[string]interface{}{{"path": []string{validateHttpUrl_.Path}}},
+		"handle": []map[string]interface{}{{
+			"handler":     "static_response",
+			"status_code": http.StatusOK,
+			"body":        strings.Join(v.FileValidationContent, "\n"),
+		}},
+		"terminal": true,
+	}
+	if err = r.request(ctx, http.MethodDelete, "/id/"+routeID_, nil, nil); err == nil {
+		r.logger().Warn("Removed leftover caddy validation route", "route", routeID_)
+	} else if !isCaddyNotFound(err) {
+		return fmt.Errorf("removing leftover caddy validation route: %w", err)
+	}
+	caddyMu.Lock()
+	defer caddyMu.Unlock()
+	// Nil if nothing is loaded.
+	var config_ *caddyConfig
+	if err = r.request(ctx, http.MethodGet, "/config/", nil, &config_); err != nil {
+		return
+	}
+	servers_ := config_.servers()
+	if _, ok := servers_[caddyValidationServer]; ok && tempServerUsers == 0 {
+		r.logger().Warn("Removing leftover caddy server", "server", caddyValidationServer)
+		if err = r.request(ctx, http.MethodDelete, "/config/apps/http/servers/"+caddyValidationServer, nil,
+			nil); err != nil {
+			return fmt.Errorf("removing leftover caddy server: %w", err)
+		}
+		delete(servers_, caddyValidationServer)
+	}
+	server_ := r.Server
+	if server_ == "" {
+		server_ = findCaddyServer(servers_, port_)
+	}
+	if server_ == "" {
+		// No server listens on the port, create one only for validation.
+		r.logger().Info("Creating caddy server for validation", "server", caddyValidationServer, "port", port_)
+		newServer_ := map[string]interface{}{
+			"listen": []string{":" + port_},
+			"routes": []interface{}{route_},
+			// Don't let caddy try to get certificates for the ip.
+			"automatic_https": map[string]interface{}{"disable": true},
+		}
+		if err = r.createServer(ctx, config_, newServer_); err != nil {
+			return
+		}
+		r.routeID, r.tempServer = routeID_, caddyValidationServer
+		tempServerUsers++
+		return
+	}
+	serverPath_ := "/config/apps/http/servers/" + server_
+	switch routes_ := servers_[server_].Routes; {
+	case routes_ == nil:
+		r.logger().Info("Adding caddy validation route as the only route", "route", routeID_, "server", server_)
+		err = r.request(ctx, http.MethodPut, serverPath_+"/routes", []interface{}{route_}, nil)
+	case len(*routes_) == 0:
+		r.logger().Info("Adding caddy validation route as the only route", "route", routeID_, "server", server_)
+		err = r.request(ctx, http.MethodPatch, serverPath_+"/routes", []interface{}{route_}, nil)
+	default:
+		// Insert as the first route so it takes precedence.
+		r.logger().Info("Adding caddy validation route", "route", routeID_, "server", server_)
+		err = r.request(ctx, http.MethodPut, serverPath_+"/routes/0", route_, nil)
+	}
+	if err != nil {
+		return
+	}
+	r.routeID = routeID_
+	if server_ == caddyValidationServer {
+		// Sharing the temporary server created by another validation.
+		r.tempServer = caddyValidationServer
+		tempServerUsers++
+	}
+	return
+}
+
+// createServer adds the server as caddyValidationServer, creating apps, http app and servers missing in the config,
+// or the config if nothing is loaded.
+func (r *CaddyValidationResponder) createServer(ctx context.Context, config *caddyConfig,
+	server map[string]interface{}) error {
+	var path_ string
+	var value_ interface{} = server
+	switch {
+	case config == nil:
+		// Nothing is loaded, the config is set as a whole.
+		return r.request(ctx, http.MethodPost, "/config/", map[string]interface{}{"apps": map[string]interface{}{
+			"http": map[string]interface{}{"servers": map[string]interface{}{caddyValidationServer: server}}}}, nil)
+	case config.Apps == nil:
+		path_ = "/config/apps"
+		value_ = map[string]interface{}{"http": map[string]interface{}{
+			"servers": map[string]interface{}{caddyValidationServer: server}}}
+	case config.Apps.Http == nil:
+		path_ = "/config/apps/http"
+		value_ = map[string]interface{}{"servers": map[string]interface{}{caddyValidationServer: server}}
+	case config.Apps.Http.Servers == nil:
+		path_ = "/config/apps/http/servers"
+		value_ = map[string]interface{}{caddyValidationServer: server}
+	default:
+		path_ = "/config/apps/http/servers/" + caddyValidationServer
+	}
+	return r.request(ctx, http.MethodPut, path_, value_, nil)
+}
+
+// Stop removes the route added in Start, and the temporary server if no other validation uses it.
+func (r *CaddyValidationResponder) Stop(ctx context.Context) (err error) {
+	if r.routeID != "" {
+		r.logger().Info("Removing caddy validation route", "route", r.routeID)
+		if err = r.request(ctx, http.MethodDelete, "/id/"+r.routeID, nil, nil); err == nil || isCaddyNotFound(err) {
+			r.routeID, err = "", nil
+		}
+	}
+	if r.tempServer == "" {
+		return
+	}
+	caddyMu.Lock()
+	defer caddyMu.Unlock()
+	server_ := r.tempServer
+	r.tempServer = ""
+	if tempServerUsers--; tempServerUsers > 0 {
+		return
+	}
+	r.logger().Info("Removing caddy server", "server", server_)
+	if serverErr := r.request(ctx, http.MethodDelete, "/config/apps/http/servers/"+server_, nil, nil); err == nil {
+		err = serverErr
+	}
+	return
+}
+
+func (r *CaddyValidationResponder) logger() *slog.Logger {
+	if r.Logger == nil {
+		return slog.Default()
+	}
+	return r.Logger
+}
+
+// servers returns http servers in the config, nil if there are none.
+func (c *caddyConfig) servers() map[string]caddyServer {
+	if c == nil || c.Apps == nil || c.Apps.Http == nil || c.Apps.Http.Servers == nil {
+		return nil
+	}
+	return *c.Apps.Http.Servers
+}
+
+// findCaddyServer returns name of the caddy http server listening on the port.
+func findCaddyServer(servers map[string]caddyServer, port string) string {
+	for k, v := range servers {
+		for _, l := range v.Listen {
+			if strings.HasSuffix(l, ":"+port) {
+				return k
+			}
+		}
+	}
+	return ""
+}
+
+// request sends json request to caddy admin api and decodes json response into out.
+func (r *CaddyValidationResponder) request(ctx context.Context, method, path string, in, out interface{}) (err error) {
+	var body_ io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body_ = bytes.NewReader(b)
+	}
+	req_, err := http.NewRequestWithContext(ctx, method, caddyAdminUrl(r.Admin, path), body_)
+	if err != nil {
+		return
+	}
+	if in != nil {
+		req_.Header.Set("Content-Type", "application/json")
+	}
+	resp_, err := http.DefaultClient.Do(req_)
+	if err != nil {
+		return
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			slog.Warn("Failed to close response body", "error", err)
+		}
+	}(resp_.Body)
+	if resp_.StatusCode < 200 || resp_.StatusCode > 299 {
+		msg_, _ := io.ReadAll(io.LimitReader(resp_.Body, 1024))
+		return &caddyAdminError{Method: method, Path: path, StatusCode: resp_.StatusCode,
+			Message: strings.TrimSpace(string(msg_))}
+	}
+	if out != nil {
+		err = json.NewDecoder(resp_.Body).Decode(out)
+	}
+	return
+}
+
+// caddyAdminUrl returns url of caddy admin api, admin address can be host:port or a full url.
+func caddyAdminUrl(admin, path string) string {
+	if strings.Contains(admin, "://") {
+		return strings.TrimSuffix(admin, "/") + path
+	}
+	url_ := &url.URL{Scheme: "http", Host: admin, Path: path}
+	return url_.String()
+}
@@ -0,0 +1,307 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	zerosslIPCert "github.com/tinkernels/zerossl-ip-cert"
+)
+
+func Test_loadCaddyConfig(t *testing.T) {
+	var gotType_, gotBody_, gotPath_ string
+	srv_ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body_, _ := io.ReadAll(r.Body)
+		gotPath_, gotType_, gotBody_ = r.URL.Path, r.Header.Get("Content-Type"), string(body_)
+	}))
+	defer srv_.Close()
+	caddyfile_ := filepath.Join(t.TempDir(), "Caddyfile")
+	if err := os.WriteFile(caddyfile_, []byte(":443 {\n\trespond ok\n}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	action_ := PostActionConf{Type: PostActionType.Caddy, CaddyAdmin: srv_.URL, CaddyConfig: caddyfile_,
+		CaddyAdapter: "caddyfile"}
+	if err := runPostActions(&CertConf{PostActions: []PostActionConf{action_}}, "abc", slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+	if gotPath_ != "/load" || gotType_ != "text/caddyfile" || !strings.Contains(gotBody_, "respond ok") {
+		t.Errorf("caddy load request: %v %v %q", gotPath_, gotType_, gotBody_)
+	}
+}
+
+func Test_caddyAdminUrl(t *testing.T) {
+	if u := caddyAdminUrl(DefaultCaddyAdmin, "/load"); u != "http://localhost:2019/load" {
+		t.Errorf("got %v", u)
+	}
+	if u := caddyAdminUrl("https://caddy.local:2019/", "/load"); u != "https://caddy.local:2019/load" {
+		t.Errorf("got %v", u)
+	}
+}
+
+// fakeCaddyAdmin mimics config paths of caddy admin api used by CaddyValidationResponder: PUT adds keys missing or
+// inserts into arrays, PATCH replaces keys existing, POST of the root sets the config, and DELETE removes keys or
+// routes of the @id. Paths through missing keys and duplicate @id fail like caddy.
+type fakeCaddyAdmin struct {
+	mu     sync.Mutex
+	config map[string]interface{} // nil if nothing is loaded
+}
+
+func (f *fakeCaddyAdmin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var value_ interface{}
+	_ = json.NewDecoder(r.Body).Decode(&value_)
+	if r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/id/") {
+		id_ := strings.TrimPrefix(r.URL.Path, "/id/")
+		for _, server := range f.servers() {
+			server_ := server.(map[string]interface{})
+			routes_, _ := server_["routes"].([]interface{})
+			for i, route := range routes_ {
+				if route.(map[string]interface{})["@id"] == id_ {
+					server_["routes"] = append(routes_[:i], routes_[i+1:]...)
+					return
+				}
+			}
+		}
+		http.Error(w, "unknown object ID", http.StatusNotFound)
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/config/") {
+		http.Error(w, "unexpected request", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		ids_ := make(map[string]int)
+		collectCaddyIDs(f.config, ids_)
+		collectCaddyIDs(value_, ids_)
+		for id, n := range ids_ {
+			if n > 1 {
+				http.Error(w, "duplicate ID '"+id+"'", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	parts_ := strings.FieldsFunc(strings.TrimPrefix(r.URL.Path, "/config/"), func(c rune) bool { return c == '/' })
+	if len(parts_) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			_ = json.NewEncoder(w).Encode(f.config)
+		case http.MethodPost:
+			f.config, _ = value_.(map[string]interface{})
+		default:
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+		}
+		return
+	}
+	// Keeping the map of the parent, to insert into arrays.
+	var parent_ interface{} = f.config
+	var grandParent_ map[string]interface{}
+	for _, part := range parts_[:len(parts_)-1] {
+		m, ok := parent_.(map[string]interface{})
+		if !ok || m == nil {
+			http.Error(w, "invalid traversal path", http.StatusBadRequest)
+			return
+		}
+		grandParent_, parent_ = m, m[part]
+	}
+	last_ := parts_[len(parts_)-1]
+	switch v := parent_.(type) {
+	case map[string]interface{}:
+		_, exists_ := v[last_]
+		switch {
+		case v == nil:
+			http.Error(w, "invalid traversal path", http.StatusBadRequest)
+		case r.Method == http.MethodGet && exists_:
+			_ = json.NewEncoder(w).Encode(v[last_])
+		case (r.Method == http.MethodPut && !exists_) || (r.Method == http.MethodPatch && exists_):
+			v[last_] = value_
+		case r.Method == http.MethodDelete && exists_:
+			delete(v, last_)
+		default:
+			http.Error(w, "key already exists or not found", http.StatusConflict)
+		}
+	case []interface{}:
+		i, err := strconv.Atoi(last_)
+		if r.Method != http.MethodPut || err != nil || i < 0 || i > len(v) {
+			http.Error(w, "invalid array index", http.StatusBadRequest)
+			return
+		}
+		grandParent_[parts_[len(parts_)-2]] = append(v[:i:i], append([]interface{}{value_}, v[i:]...)...)
+	default:
+		http.Error(w, "invalid traversal path", http.StatusBadRequest)
+	}
+}
+
+// collectCaddyIDs counts @id of objects in v.
+func collectCaddyIDs(v interface{}, ids map[string]int) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if id, ok := e.(string); ok && k == "@id" {
+				ids[id]++
+			}
+			collectCaddyIDs(e, ids)
+		}
+	case []interface{}:
+		for _, e := range v {
+			collectCaddyIDs(e, ids)
+		}
+	}
+}
+
+// servers returns apps.http.servers of the config, nil if missing.
+func (f *fakeCaddyAdmin) servers() map[string]interface{} {
+	apps_, _ := f.config["apps"].(map[string]interface{})
+	http_, _ := apps_["http"].(map[string]interface{})
+	servers_, _ := http_["servers"].(map[string]interface{})
+	return servers_
+}
+
+func (f *fakeCaddyAdmin) routes(server string) []interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	server_, _ := f.servers()[server].(map[string]interface{})
+	routes_, _ := server_["routes"].([]interface{})
+	return routes_
+}
+
+// caddyTestCertInfo returns cert info of the id with http file validation info of 1.1.1.1.
+func caddyTestCertInfo(id string) *zerosslIPCert.CertificateInfoModel {
+	return &zerosslIPCert.CertificateInfoModel{
+		ID:         id,
+		CommonName: "1.1.1.1",
+		Validation: zerosslIPCert.ValidationInfoModel{
+			OtherMethods: map[string]zerosslIPCert.OtherValidationInfoModel{
+				"1.1.1.1": {
+					FileValidationUrlHttp: "http://1.1.1.1/.well-known/pki-validation/715EE529C6FF317C938B79C7655710AC.txt",
+					FileValidationContent: []string{"ABCDEF1234567890", "comodoca.com", "abcdef1234567890"},
+				},
+			},
+		},
+	}
+}
+
+func TestCaddyValidationResponder(t *testing.T) {
+	certInfo_ := caddyTestCertInfo("abc")
+	for _, c := range []struct {
+		name   string
+		config string
+		// Server of the validation route, and its routes during validation and after.
+		wantServer                  string
+		wantRoutes, wantRoutesAfter int
+	}{
+		{name: "route inserted", wantServer: "srv1", wantRoutes: 2, wantRoutesAfter: 1,
+			config: `{"apps":{"http":{"servers":{"srv0":{"listen":[":443"]},` +
+				`"srv1":{"listen":[":80"],"routes":[{"@id":"other"}]}}}}}`},
+		{name: "routes missing", wantServer: "srv1", wantRoutes: 1,
+			config: `{"apps":{"http":{"servers":{"srv1":{"listen":[":80"]}}}}}`},
+		{name: "routes empty", wantServer: "srv1", wantRoutes: 1,
+			config: `{"apps":{"http":{"servers":{"srv1":{"listen":[":80"],"routes":[]}}}}}`},
+		{name: "no server on the port", wantServer: caddyValidationServer, wantRoutes: 1,
+			config: `{"apps":{"http":{"servers":{"srv0":{"listen":[":443"]}}}}}`},
+		{name: "servers missing", wantServer: caddyValidationServer, wantRoutes: 1,
+			config: `{"apps":{"http":{}}}`},
+		{name: "http app missing", wantServer: caddyValidationServer, wantRoutes: 1,
+			config: `{"apps":{"tls":{}}}`},
+		{name: "apps missing", wantServer: caddyValidationServer, wantRoutes: 1,
+			config: `{"admin":{"listen":"localhost:2019"}}`},
+		{name: "nothing loaded", wantServer: caddyValidationServer, wantRoutes: 1, config: `null`},
+		{name: "leftover route", wantServer: "srv1", wantRoutes: 2, wantRoutesAfter: 1,
+			config: `{"apps":{"http":{"servers":{"srv1":{"listen":[":80"],` +
+				`"routes":[{"@id":"other"},{"@id":"zerossl_validation_abc"}]}}}}}`},
+		{name: "leftover server", wantServer: "srv1", wantRoutes: 2, wantRoutesAfter: 1,
+			config: `{"apps":{"http":{"servers":{"srv1":{"listen":[":80"],"routes":[{"@id":"other"}]},` +
+				`"zerossl_validation":{"listen":[":80"],"routes":[{"@id":"zerossl_validation_old"}]}}}}}`},
+	} {
+		admin_ := &fakeCaddyAdmin{}
+		if err := json.Unmarshal([]byte(c.config), &admin_.config); err != nil {
+			t.Fatal(err)
+		}
+		srv_ := httptest.NewServer(admin_)
+		responder_ := &CaddyValidationResponder{Admin: srv_.URL}
+		if err := responder_.Start(context.Background(), certInfo_); err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		routes_ := admin_.routes(c.wantServer)
+		if len(routes_) != c.wantRoutes {
+			t.Fatalf("%v: routes %#v", c.name, routes_)
+		}
+		route_ := routes_[0].(map[string]interface{})
+		handle_ := route_["handle"].([]interface{})[0].(map[string]interface{})
+		if route_["@id"] != "zerossl_validation_abc" || handle_["handler"] != "static_response" ||
+			handle_["body"] != "ABCDEF1234567890\ncomodoca.com\nabcdef1234567890" {
+			t.Errorf("%v: route %#v", c.name, route_)
+		}
+		if err := responder_.Stop(context.Background()); err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if routes_ = admin_.routes(c.wantServer); len(routes_) != c.wantRoutesAfter {
+			t.Errorf("%v: routes after stop %#v", c.name, routes_)
+		}
+		if _, ok := admin_.servers()[caddyValidationServer]; ok {
+			t.Errorf("%v: validation server not removed", c.name)
+		}
+		if c.name == "apps missing" && admin_.config["admin"] == nil {
+			t.Errorf("%v: config replaced %#v", c.name, admin_.config)
+		}
+		srv_.Close()
+	}
+}
+
+func TestCaddyValidationResponder_sharedServer(t *testing.T) {
+	admin_ := &fakeCaddyAdmin{config: map[string]interface{}{}}
+	srv_ := httptest.NewServer(admin_)
+	defer srv_.Close()
+	ctx_ := context.Background()
+
+	// Validations in parallel share the temporary server, without waiting for each other.
+	first_ := &CaddyValidationResponder{Admin: srv_.URL}
+	second_ := &CaddyValidationResponder{Admin: srv_.URL}
+	if err := first_.Start(ctx_, caddyTestCertInfo("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := second_.Start(ctx_, caddyTestCertInfo("def")); err != nil {
+		t.Fatal(err)
+	}
+	if routes_ := admin_.routes(caddyValidationServer); len(routes_) != 2 {
+		t.Fatalf("routes %#v", routes_)
+	}
+	if err := first_.Stop(ctx_); err != nil {
+		t.Fatal(err)
+	}
+	if routes_ := admin_.routes(caddyValidationServer); len(routes_) != 1 ||
+		routes_[0].(map[string]interface{})["@id"] != "zerossl_validation_def" {
+		t.Fatalf("routes after first stop %#v", routes_)
+	}
+	if err := second_.Stop(ctx_); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := admin_.servers()[caddyValidationServer]; ok || tempServerUsers != 0 {
+		t.Errorf("validation server not removed, users %d", tempServerUsers)
+	}
+}
@@ -0,0 +1,240 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"text/tabwriter"
+	"time"
+
+	zerosslIPCert "github.com/tinkernels/zerossl-ip-cert"
+)
+
+// DefaultCleanUnfinishedMinAge is the default age unfinished certs must reach before being cleaned.
+const DefaultCleanUnfinishedMinAge = time.Hour
+
+// CleanAction represents what is done to an unfinished cert.
+var CleanAction = struct {
+	Cancelled   string
+	WouldCancel string
+	TooYoung    string
+	Failed      string
+}{
+	Cancelled:   "cancelled",
+	WouldCancel: "would cancel",
+	TooYoung:    "too young",
+	Failed:      "failed",
+}
+
+// CleanItem is an unfinished cert in scope of cleaning.
+type CleanItem struct {
+	CertID     string    `json:"certId"`
+	CommonName string    `json:"commonName"`
+	Status     string    `json:"status"`
+	Created    time.Time `json:"created"`
+	Action     string    `json:"action"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// cleanScope is the scope of cleaning certs of an api key.
+type cleanScope struct {
+	client *zerosslIPCert.Client
+	opts   zerosslIPCert.CleanOptions
+}
+
+// cleanUnfinishedMinAge returns the min age of unfinished certs to clean in the config.
+func cleanUnfinishedMinAge() time.Duration {
+	if usingConfig.CleanUnfinishedMinAge > 0 {
+		return time.Duration(usingConfig.CleanUnfinishedMinAge) * time.Minute
+	}
+	return DefaultCleanUnfinishedMinAge
+}
+
+// saveCreatedCert records the cert created for the cert config, keeping the latest MaxCertHistory ones of the cert
+// config, then writes current data.
+func saveCreatedCert(confID, certID string) error {
+	currentDataMu.Lock()
+	defer currentDataMu.Unlock()
+	kept_ := 0
+	created_ := []CreatedCert{{ConfID: confID, CertID: certID}}
+	for _, c := range currentData.Created {
+		if c.ConfID == confID {
+			if kept_++; kept_ >= MaxCertHistory {
+				continue
+			}
+		}
+		created_ = append(created_, c)
+	}
+	currentData.Created = created_
+	return saveCurrentData()
+}
+
+// removeCreatedCerts removes records of the certs created once they are issued or cancelled, currentDataMu must be
+// held. Current data is written by the caller.
+func removeCreatedCerts(certIDs ...string) (removed bool) {
+	ids_ := make(map[string]bool)
+	for _, id := range certIDs {
+		ids_[id] = true
+	}
+	created_ := currentData.Created[:0]
+	for _, c := range currentData.Created {
+		if ids_[c.CertID] {
+			removed = true
+			continue
+		}
+		created_ = append(created_, c)
+	}
+	currentData.Created = created_
+	return
+}
+
+// trackedCertIDs returns IDs of certs created for the cert config: the current cert and its history, the pending
+// issuance and certs created not issued yet.
+func trackedCertIDs(confID string) (ids []string) {
+	currentDataMu.Lock()
+	defer currentDataMu.Unlock()
+	for _, c := range currentData.Certs {
+		if c.ConfID == confID {
+			ids = append(append(ids, c.CertID), c.History...)
+		}
+	}
+	for _, p := range currentData.Pending {
+		if p.ConfID == confID {
+			ids = append(ids, p.CertID)
+		}
+	}
+	for _, c := range currentData.Created {
+		if c.ConfID == confID {
+			ids = append(ids, c.CertID)
+		}
+	}
+	return
+}
+
+// forgetCancelledCerts removes records of the certs created which are cancelled by cleaning.
+func forgetCancelledCerts(summary zerosslIPCert.CleanSummary, logger *slog.Logger) {
+	if summary.DryRun || len(summary.Cancelled) == 0 {
+		return
+	}
+	var ids_ []string
+	for _, cert := range summary.Cancelled {
+		ids_ = append(ids_, cert.ID)
+	}
+	currentDataMu.Lock()
+	defer currentDataMu.Unlock()
+	if !removeCreatedCerts(ids_...) {
+		return
+	}
+	if err := saveCurrentData(); err != nil {
+		logger.Error("Failed to write current data", "error", err)
+	}
+}
+
+// cleanScopes groups common names and tracked cert IDs of cert configs by api key, so only certs of this config or
+// created by this tool are cleaned, certs of pending issuances are excluded.
+func cleanScopes(confs []CertConf, minAge time.Duration, dryRun_ bool) (scopes []*cleanScope) {
+	byApiKey_ := make(map[Secret]*cleanScope)
+	for i := range confs {
+		conf_ := &confs[i]
+		scope_, ok := byApiKey_[conf_.ApiKey]
+		if !ok {
+			scope_ = &cleanScope{
+				client: newApiClient(conf_.ApiKey, slog.Default()),
+				opts:   zerosslIPCert.CleanOptions{MinAge: minAge, DryRun: dryRun_},
+			}
+			byApiKey_[conf_.ApiKey] = scope_
+			scopes = append(scopes, scope_)
+		}
+		scope_.opts.CommonNames = append(scope_.opts.CommonNames, conf_.CommonName)
+		scope_.opts.CertIDs = append(scope_.opts.CertIDs, trackedCertIDs(conf_.ConfID)...)
+		// Pending issuances are resumed instead.
+		if issuance_ := pendingIssuance(conf_.ConfID); issuance_ != nil {
+			scope_.opts.Exclude = append(scope_.opts.Exclude, issuance_.CertID)
+		}
+	}
+	return
+}
+
+// cleanUnfinished cancels unfinished certs in the scopes, returns the certs in scope and errors joined.
+func cleanUnfinished(scopes []*cleanScope) (items []CleanItem, err error) {
+	var errs_ []error
+	for _, scope := range scopes {
+		summary_, err := scope.client.CleanUnfinished(scope.opts)
+		if err != nil {
+			errs_ = append(errs_, err)
+		}
+		forgetCancelledCerts(summary_, slog.Default())
+		items = append(items, cleanItems(summary_)...)
+	}
+	return items, errors.Join(errs_...)
+}
+
+// cleanUnfinishedOf cancels unfinished certs of the cert config before issuing except the pending issuance,
+// failures are only logged.
+func cleanUnfinishedOf(conf *CertConf, client *zerosslIPCert.Client, logger *slog.Logger) {
+	opts_ := zerosslIPCert.CleanOptions{CommonNames: []string{conf.CommonName}, CertIDs: trackedCertIDs(conf.ConfID),
+		MinAge: cleanUnfinishedMinAge()}
+	if issuance_ := pendingIssuance(conf.ConfID); issuance_ != nil {
+		opts_.Exclude = []string{issuance_.CertID}
+	}
+	summary_, err := client.CleanUnfinished(opts_)
+	if err != nil {
+		logger.Warn("Failed to clean unfinished issuing certs", "error", err)
+	}
+	forgetCancelledCerts(summary_, logger)
+	logger.Info("Cleaned unfinished issuing certs", "cancelled", len(summary_.Cancelled),
+		"tooYoung", len(summary_.TooYoung), "failed", len(summary_.Failed))
+}
+
+func cleanItems(summary zerosslIPCert.CleanSummary) (items []CleanItem) {
+	add_ := func(cert zerosslIPCert.CertificateInfoModel, action, err string) {
+		items = append(items, CleanItem{CertID: cert.ID, CommonName: cert.CommonName, Status: cert.Status,
+			Created: cert.Created, Action: action, Error: err})
+	}
+	cancelled_ := CleanAction.Cancelled
+	if summary.DryRun {
+		cancelled_ = CleanAction.WouldCancel
+	}
+	for _, cert := range summary.Cancelled {
+		add_(cert, cancelled_, "")
+	}
+	for _, cert := range summary.TooYoung {
+		add_(cert, CleanAction.TooYoung, "")
+	}
+	for _, failure := range summary.Failed {
+		add_(failure.Cert, CleanAction.Failed, failure.Error)
+	}
+	return
+}
+
+// writeCleanTable writes unfinished certs in scope of cleaning as a table.
+func writeCleanTable(w io.Writer, items []CleanItem) error {
+	tw_ := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw_, "CERT ID\tCOMMON NAME\tSTATUS\tCREATED\tACTION")
+	for _, item := range items {
+		action_ := item.Action
+		if item.Error != "" {
+			action_ = fmt.Sprintf("%v: %v", action_, item.Error)
+		}
+		_, _ = fmt.Fprintf(tw_, "%v\t%v\t%v\t%v\t%v\n", item.CertID, item.CommonName, item.Status,
+			listTime(item.Created), action_)
+	}
+	return tw_.Flush()
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	zerosslIPCert "github.com/tinkernels/zerossl-ip-cert"
+)
+
+func Test_cmdClean(t *testing.T) {
+	configPath_ := setupCliTest(t)
+	fake_ := newFakeZeroSSL(t, testApiKey)
+	status_ := zerosslIPCert.CertStatus
+	old_, expires_ := time.Now().Add(-2*time.Hour), time.Now().Add(90*24*time.Hour)
+	oldC1_ := fake_.addCert("192.0.2.1", status_.Draft, old_, expires_)
+	youngC1_ := fake_.addCert("192.0.2.1", status_.PendingValidation, time.Now(), expires_)
+	oldC2_ := fake_.addCert("192.0.2.2", status_.Draft, old_, expires_)
+	// Cert of other tools sharing the api key.
+	foreign_ := fake_.addCert("198.51.100.1", status_.Draft, old_, expires_)
+	issued_ := fake_.addCert("192.0.2.1", status_.Issued, old_, expires_)
+	// Cert created for c2 before its common name is changed.
+	created_ := fake_.addCert("192.0.2.99", status_.Draft, old_, expires_)
+	dataDir_ := filepath.Join(filepath.Dir(configPath_), "data")
+	if err := os.MkdirAll(dataDir_, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteCurrentData(filepath.Join(dataDir_, "current.yaml"), &CurrentData{
+		Created: []CreatedCert{{ConfID: "c2", CertID: created_.ID}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	runClean_ := func(args ...string) (code int, actions map[string]string) {
+		code, out_ := runCliOutput(t, append(append([]string{"clean"}, args...), "-json", "-config", configPath_)...)
+		var items_ []CleanItem
+		if err := json.Unmarshal([]byte(out_), &items_); err != nil {
+			t.Fatalf("unexpected output %q: %v", out_, err)
+		}
+		actions = make(map[string]string)
+		for _, item := range items_ {
+			actions[item.CertID] = item.Action
+		}
+		return
+	}
+
+	code_, actions_ := runClean_("-dry-run")
+	if code_ != ExitCode.OK || len(actions_) != 4 || actions_[oldC1_.ID] != CleanAction.WouldCancel ||
+		actions_[oldC2_.ID] != CleanAction.WouldCancel || actions_[youngC1_.ID] != CleanAction.TooYoung ||
+		actions_[created_.ID] != CleanAction.WouldCancel {
+		t.Errorf("dry run: code %v, actions %v", code_, actions_)
+	}
+	for _, call := range fake_.apiCalls() {
+		if call == zerosslIPCert.ApiName.CancelCertificate {
+			t.Fatal("cancelled in dry run")
+		}
+	}
+
+	code_, actions_ = runClean_("-conf-id", "c1")
+	if code_ != ExitCode.OK || len(actions_) != 2 || actions_[oldC1_.ID] != CleanAction.Cancelled ||
+		actions_[youngC1_.ID] != CleanAction.TooYoung {
+		t.Errorf("clean c1: code %v, actions %v", code_, actions_)
+	}
+	for cert, want := range map[*zerosslIPCert.CertificateInfoModel]string{oldC1_: status_.Cancelled,
+		youngC1_: status_.PendingValidation, oldC2_: status_.Draft, foreign_: status_.Draft, issued_: status_.Issued} {
+		if got_ := fake_.cert(cert.ID).Status; got_ != want {
+			t.Errorf("status of %v: got %v, want %v", cert.CommonName, got_, want)
+		}
+	}
+
+	code_, actions_ = runClean_("-min-age", "0")
+	if code_ != ExitCode.OK || len(actions_) != 3 || actions_[youngC1_.ID] != CleanAction.Cancelled ||
+		actions_[oldC2_.ID] != CleanAction.Cancelled || actions_[created_.ID] != CleanAction.Cancelled {
+		t.Errorf("clean without min age: code %v, actions %v", code_, actions_)
+	}
+	if fake_.cert(foreign_.ID).Status != status_.Draft {
+		t.Error("cert out of scope cancelled")
+	}
+	// Cancelled certs are no longer tracked.
+	data_, err := ReadCurrentData(filepath.Join(dataDir_, "current.yaml"))
+	if err != nil || len(data_.Created) != 0 {
+		t.Errorf("current data %+v, error %v", data_, err)
+	}
+}
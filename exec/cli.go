@@ -0,0 +1,525 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	zerosslIPCert "github.com/tinkernels/zerossl-ip-cert"
+)
+
+// ExitCode represents exit codes of the cli.
+var ExitCode = struct {
+	OK      int // succeeded
+	Failure int // the operation failed, e.g. issuing, renewing or an api call
+	Usage   int // invalid command, flags or arguments
+	Config  int // config or current data can't be read or is invalid
+	Locked  int // data dir is locked by another process
+}{
+	OK:      0,
+	Failure: 1,
+	Usage:   2,
+	Config:  3,
+	Locked:  4,
+}
+
+// Command is a subcommand of the cli.
+type Command struct {
+	Name  string
+	Short string // one line description
+	Run   func(name string, args []string) (code int)
+}
+
+// commands returns all subcommands.
+func commands() []Command {
+	return []Command{
+		{Name: "issue", Short: "Issue certs, or renew them if already issued", Run: cmdIssue},
+		{Name: "renew", Short: "Renew issued certs only", Run: cmdRenew},
+		{Name: "status", Short: "Show status of configured and issued certs", Run: cmdStatus},
+		{Name: "list", Short: "List certs of the ZeroSSL account", Run: cmdList},
+		{Name: "revoke", Short: "Revoke an issued cert", Run: cmdRevoke},
+		{Name: "cancel", Short: "Cancel a cert not issued yet", Run: cmdCancel},
+		{Name: "download", Short: "Download a cert with ca bundle", Run: cmdDownload},
+		{Name: "clean", Short: "Cancel unfinished certs", Run: cmdClean},
+		{Name: "check-config", Short: "Validate the config file", Run: cmdCheckConfig},
+		{Name: "version", Short: "Print version", Run: cmdVersion},
+	}
+}
+
+// runCli runs the subcommand in args, or the legacy flags only cli when args start with a flag.
+func runCli(args []string) (code int) {
+	defer unlockDataDir()
+	defer closeStateStore()
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return cmdLegacy(args)
+	}
+	for _, c := range commands() {
+		if c.Name == args[0] {
+			return c.Run(c.Name, args[1:])
+		}
+	}
+	if args[0] == "help" {
+		printUsage(os.Stdout)
+		return ExitCode.OK
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+	printUsage(os.Stderr)
+	return ExitCode.Usage
+}
+
+func printUsage(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "\nVersion: %v\n\nUsage: %v COMMAND [ FLAGS ]\n\nCommands:\n", Version,
+		filepath.Base(os.Args[0]))
+	tw_ := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, c := range commands() {
+		_, _ = fmt.Fprintf(tw_, "  %v\t%v\n", c.Name, c.Short)
+	}
+	_ = tw_.Flush()
+	_, _ = fmt.Fprintf(w, "\nRun '%v COMMAND -h' for flags of the command.\n", filepath.Base(os.Args[0]))
+}
+
+// newFlagSet returns flag set of the command, with the config flag if config is not nil.
+func newFlagSet(name, usage string, config *string) (fs *flag.FlagSet) {
+	fs = flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		_, _ = fmt.Fprintf(fs.Output(), "\nUsage: %v %v\n\n", filepath.Base(os.Args[0]), usage)
+		fs.PrintDefaults()
+	}
+	if config != nil {
+		fs.StringVar(config, "config", "", "Config file")
+	}
+	return
+}
+
+// parseFlags parses args, returns ExitCode.OK if the command should go on, or the exit code otherwise.
+func parseFlags(fs *flag.FlagSet, args []string) (code int, done bool) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitCode.OK, true
+		}
+		return ExitCode.Usage, true
+	}
+	if fs.NArg() > 0 {
+		_, _ = fmt.Fprintf(fs.Output(), "unexpected arguments: %v\n", fs.Args())
+		fs.Usage()
+		return ExitCode.Usage, true
+	}
+	return ExitCode.OK, false
+}
+
+// loadConfig reads and validates the config file into usingConfig.
+func loadConfig(path string) (code int) {
+	if path == "" {
+		_, _ = fmt.Fprintln(os.Stderr, "config file not specified")
+		return ExitCode.Usage
+	}
+	config_, err := ReadConfig(path)
+	if config_ != nil {
+		// Validating before any api call, unknown keys are reported with other problems.
+		err = config_.Validate()
+	}
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return ExitCode.Config
+	}
+	usingConfig = config_
+	return ExitCode.OK
+}
+
+// setup loads the config and current data, and sets up logging to console, stderr for commands writing output to
+// stdout. Changing commands also log to the log file, create and lock data dir and open the storage of sharing
+// certs, others log to console only.
+func setup(configPath string, changing bool, console io.Writer) (code int) {
+	if code = loadConfig(configPath); code != ExitCode.OK {
+		return
+	}
+	// Certs are only shared by changing commands.
+	certStorage = nil
+	if !changing {
+		logger_, _ := NewLogger(usingConfig.LogLevel, usingConfig.LogFormat, console)
+		slog.SetDefault(logger_)
+	} else {
+		logFile_, err := os.OpenFile(usingConfig.LogFile, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0666)
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "log file create failed: %v\n", err)
+			return ExitCode.Config
+		}
+		// Write log to both console and file.
+		logger_, _ := NewLogger(usingConfig.LogLevel, usingConfig.LogFormat, console, logFile_)
+		slog.SetDefault(logger_)
+		slog.Info("Using config file", "path", configPath)
+		if err = CreateDirIfNotExists(usingConfig.DataDir, os.ModePerm); err != nil {
+			slog.Error("Failed to create data dir", "path", usingConfig.DataDir, "error", err)
+			return ExitCode.Config
+		}
+		// Locking before reading current data, which may be changed by the holder.
+		if dataDirLock, err = LockDataDir(usingConfig.DataDir, usingConfig.Lock); err != nil {
+			slog.Error("Failed to lock data dir", "error", err)
+			if errors.Is(err, ErrDataDirLocked) {
+				return ExitCode.Locked
+			}
+			return ExitCode.Failure
+		}
+		if certStorage, err = OpenStorage(usingConfig.Storage); err != nil {
+			slog.Error("Failed to open storage", "error", err)
+			return ExitCode.Config
+		}
+	}
+	if err := loadCurrentData(!changing); err != nil {
+		slog.Error("Failed to read current data", "error", err)
+		return ExitCode.Config
+	}
+	return ExitCode.OK
+}
+
+// runCerts issues or renews certs once, in daemon mode or in dry run. Only cert configs of confIDs are used if set.
+func runCerts(configPath string, renewOnly, daemon, dryRun_ bool, confIDs ...string) (code int) {
+	console_ := os.Stdout
+	if dryRun_ {
+		// Keeping stdout for the plan.
+		console_ = os.Stderr
+	}
+	if code = setup(configPath, !dryRun_, console_); code != ExitCode.OK {
+		return
+	}
+	if len(confIDs) > 0 {
+		var selected_ []CertConf
+		for _, id := range confIDs {
+			conf_, err := certConf(id)
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				return ExitCode.Usage
+			}
+			selected_ = append(selected_, *conf_)
+		}
+		usingConfig.CertConfigs = selected_
+	}
+	if dryRun_ {
+		if !dryRun(os.Stdout, renewOnly) {
+			return ExitCode.Failure
+		}
+		return ExitCode.OK
+	}
+	if daemon {
+		// Stopping on signals, so the data dir lock is released and the state store closed.
+		ctx_, stop_ := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop_()
+		runDaemon(ctx_, renewOnly)
+		return ExitCode.OK
+	}
+	if usingConfig.Metrics.Listen != "" {
+		slog.Warn("Metrics listen address is only used in daemon mode")
+	}
+	if err := runOnce(renewOnly, false); err != nil {
+		return ExitCode.Failure
+	}
+	return ExitCode.OK
+}
+
+// cmdLegacy runs the flags only cli of previous versions.
+func cmdLegacy(args []string) (code int) {
+	var config_ string
+	fs_ := newFlagSet("", "[ -renew ] [ -daemon | -dry-run ] -config CONFIG_FILE", &config_)
+	fs_.Usage = func() {
+		printUsage(fs_.Output())
+		_, _ = fmt.Fprintf(fs_.Output(), "\nOr: %v [ -renew ] [ -daemon | -dry-run ] -config CONFIG_FILE\n\n",
+			filepath.Base(os.Args[0]))
+		fs_.PrintDefaults()
+	}
+	renew_ := fs_.Bool("renew", false, "Renew existing certs only")
+	daemon_ := fs_.Bool("daemon", false, "Keep running and check certs periodically")
+	dryRun_ := fs_.Bool("dry-run", false,
+		"Validate config and show which certs would be issued, renewed or skipped, without changing anything")
+	if code, done := parseFlags(fs_, args); done {
+		return code
+	}
+	if config_ == "" {
+		fs_.Usage()
+		return ExitCode.Usage
+	}
+	return runCerts(config_, *renew_, *daemon_, *dryRun_)
+}
+
+func cmdIssue(name string, args []string) (code int) {
+	var config_ string
+	fs_ := newFlagSet(name, "issue [ -conf-id ID,... ] [ -daemon | -dry-run ] -config CONFIG_FILE", &config_)
+	confIDs_ := fs_.String("conf-id", "", "Comma separated confIds of certs to issue, all by default")
+	daemon_ := fs_.Bool("daemon", false, "Keep running and check certs periodically")
+	dryRun_ := fs_.Bool("dry-run", false, "Show which certs would be issued, renewed or skipped")
+	if code, done := parseFlags(fs_, args); done {
+		return code
+	}
+	var selected_ []string
+	if *confIDs_ != "" {
+		for _, id := range strings.Split(*confIDs_, ",") {
+			selected_ = append(selected_, strings.TrimSpace(id))
+		}
+	}
+	return runCerts(config_, false, *daemon_, *dryRun_, selected_...)
+}
+
+func cmdRenew(name string, args []string) (code int) {
+	var config_ string
+	fs_ := newFlagSet(name, "renew [ -daemon | -dry-run ] -config CONFIG_FILE", &config_)
+	daemon_ := fs_.Bool("daemon", false, "Keep running and check certs periodically")
+	dryRun_ := fs_.Bool("dry-run", false, "Show which certs would be renewed or skipped")
+	if code, done := parseFlags(fs_, args); done {
+		return code
+	}
+	return runCerts(config_, true, *daemon_, *dryRun_)
+}
+
+func cmdRevoke(name string, args []string) (code int) {
+	var config_ string
+	fs_ := newFlagSet(name, "revoke -conf-id ID | -cert-id ID [ -reason REASON ] -config CONFIG_FILE", &config_)
+	confID_ := fs_.String("conf-id", "", "Revoke the current cert of the cert config")
+	certID_ := fs_.String("cert-id", "", "Revoke the cert, using api key of -conf-id or the default api key")
+	reason_ := fs_.String("reason", "", "Reason: unspecified, keyCompromise, affiliationChanged, "+
+		"Superseded or cessationOfOperation")
+	if code, done := parseFlags(fs_, args); done {
+		return code
+	}
+	return certCommand(config_, *confID_, *certID_, true, func(client *zerosslIPCert.Client, certID string) error {
+		if err := client.RevokeCert(certID, *reason_); err != nil {
+			return fmt.Errorf("revoking cert %v: %w", certID, err)
+		}
+		slog.Info("Cert revoked, it is reissued in the next run", "certId", certID)
+		return nil
+	})
+}
+
+func cmdCancel(name string, args []string) (code int) {
+	var config_ string
+	fs_ := newFlagSet(name, "cancel -conf-id ID | -cert-id ID -config CONFIG_FILE", &config_)
+	confID_ := fs_.String("conf-id", "", "Cancel the current cert of the cert config")
+	certID_ := fs_.String("cert-id", "", "Cancel the cert, using api key of -conf-id or the default api key")
+	if code, done := parseFlags(fs_, args); done {
+		return code
+	}
+	return certCommand(config_, *confID_, *certID_, true, func(client *zerosslIPCert.Client, certID string) error {
+		if err := client.CancelCert(certID); err != nil {
+			return fmt.Errorf("cancelling cert %v: %w", certID, err)
+		}
+		slog.Info("Cert cancelled", "certId", certID)
+		return nil
+	})
+}
+
+func cmdDownload(name string, args []string) (code int) {
+	var config_ string
+	fs_ := newFlagSet(name, "download -conf-id ID | -cert-id ID [ -out FILE ] -config CONFIG_FILE", &config_)
+	confID_ := fs_.String("conf-id", "", "Download the current cert of the cert config")
+	certID_ := fs_.String("cert-id", "", "Download the cert, using api key of -conf-id or the default api key")
+	out_ := fs_.String("out", "", "Write the cert followed by ca bundle to the file, stdout by default")
+	if code, done := parseFlags(fs_, args); done {
+		return code
+	}
+	return certCommand(config_, *confID_, *certID_, false, func(client *zerosslIPCert.Client, certID string) error {
+		cert_, err := client.DownloadCertInline(certID, true)
+		if err != nil {
+			return fmt.Errorf("downloading cert %v: %w", certID, err)
+		}
+		if *out_ == "" {
+			_, err = fmt.Fprint(os.Stdout, fullChainPem(&cert_))
+			return err
+		}
+		if err = os.WriteFile(*out_, []byte(fullChainPem(&cert_)), 0644); err != nil {
+			return err
+		}
+		slog.Info("Cert downloaded", "certId", certID, "path", *out_)
+		return nil
+	})
+}
+
+// certCommand runs f with the client and the cert of flags -conf-id and -cert-id. Changing commands hold the data
+// dir lock, so they don't race with issuing or renewing.
+func certCommand(configPath, confID, certID string, changing bool,
+	f func(client *zerosslIPCert.Client, certID string) error) (code int) {
+	if confID == "" && certID == "" {
+		_, _ = fmt.Fprintln(os.Stderr, "either -conf-id or -cert-id is required")
+		return ExitCode.Usage
+	}
+	console_ := os.Stdout
+	if !changing {
+		// Keeping stdout for the output.
+		console_ = os.Stderr
+	}
+	if code = setup(configPath, changing, console_); code != ExitCode.OK {
+		return
+	}
+	client_, err := commandClient(confID)
+	if err == nil && certID == "" {
+		certID, err = currentCertID(confID)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return ExitCode.Usage
+	}
+	if err = f(client_, certID); err != nil {
+		slog.Error("Command failed", "error", err)
+		return ExitCode.Failure
+	}
+	return ExitCode.OK
+}
+
+func cmdClean(name string, args []string) (code int) {
+	var config_ string
+	fs_ := newFlagSet(name, "clean [ -conf-id ID,... ] [ -min-age MINUTES ] [ -dry-run ] [ -json ] -config CONFIG_FILE",
+		&config_)
+	confIDs_ := fs_.String("conf-id", "", "Comma separated confIds of certs to clean, all by default")
+	minAge_ := fs_.Int("min-age", -1, "Only clean certs created at least the minutes ago, "+
+		"cleanUnfinishedMinAge of the config by default")
+	dryRun_ := fs_.Bool("dry-run", false, "Show which certs would be cancelled")
+	json_ := fs_.Bool("json", false, "Output as json")
+	if code, done := parseFlags(fs_, args); done {
+		return code
+	}
+	// Cleaning cancels certs, so it holds the data dir lock, like issuing and renewing, except in dry run.
+	if code = setup(config_, !*dryRun_, os.Stderr); code != ExitCode.OK {
+		return
+	}
+	confs_ := usingConfig.CertConfigs
+	if *confIDs_ != "" {
+		confs_ = nil
+		for _, id := range strings.Split(*confIDs_, ",") {
+			conf_, err := certConf(strings.TrimSpace(id))
+			if err != nil {
+				_, _ = fmt.Fprintln(os.Stderr, err)
+				return ExitCode.Usage
+			}
+			confs_ = append(confs_, *conf_)
+		}
+	}
+	minAgeDuration_ := cleanUnfinishedMinAge()
+	if *minAge_ >= 0 {
+		minAgeDuration_ = time.Duration(*minAge_) * time.Minute
+	}
+	items_, err := cleanUnfinished(cleanScopes(confs_, minAgeDuration_, *dryRun_))
+	if *json_ {
+		code = writeJsonOutput(os.Stdout, items_)
+	} else if writeErr := writeCleanTable(os.Stdout, items_); writeErr != nil {
+		slog.Error("Failed to write output", "error", writeErr)
+		code = ExitCode.Failure
+	}
+	if err != nil {
+		slog.Error("Failed to clean unfinished certs", "error", err)
+		return ExitCode.Failure
+	}
+	return
+}
+
+func cmdCheckConfig(name string, args []string) (code int) {
+	var config_ string
+	fs_ := newFlagSet(name, "check-config -config CONFIG_FILE", &config_)
+	if code, done := parseFlags(fs_, args); done {
+		return code
+	}
+	if code = loadConfig(config_); code != ExitCode.OK {
+		return
+	}
+	_, _ = fmt.Fprintf(os.Stdout, "Config %v is valid, %d cert config(s)\n", config_, len(usingConfig.CertConfigs))
+	return ExitCode.OK
+}
+
+func cmdVersion(name string, args []string) (code int) {
+	fs_ := newFlagSet(name, "version", nil)
+	if code, done := parseFlags(fs_, args); done {
+		return code
+	}
+	_, _ = fmt.Fprintln(os.Stdout, Version)
+	return ExitCode.OK
+}
+
+// certConf returns the cert config of confID.
+func certConf(confID string) (conf *CertConf, err error) {
+	for i := range usingConfig.CertConfigs {
+		if usingConfig.CertConfigs[i].ConfID == confID {
+			return &usingConfig.CertConfigs[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no cert config of confId %q", confID)
+}
+
+// currentCertID returns id of the current cert of confID.
+func currentCertID(confID string) (certID string, err error) {
+	currentDataMu.Lock()
+	defer currentDataMu.Unlock()
+	for _, cert := range currentData.Certs {
+		if cert.ConfID == confID {
+			return cert.CertID, nil
+		}
+	}
+	return "", fmt.Errorf("no current cert of confId %q", confID)
+}
+
+// commandClient returns the client with api key of the cert config, or the default api key if confID is empty.
+// Without a default api key, the api key shared by all cert configs is used.
+func commandClient(confID string) (client *zerosslIPCert.Client, err error) {
+	if confID != "" {
+		conf_, err := certConf(confID)
+		if err != nil {
+			return nil, err
+		}
+		return newClient(conf_), nil
+	}
+	clients_ := apiKeyClients()
+	if usingConfig.ApiKey == "" && len(clients_) != 1 {
+		return nil, fmt.Errorf("no default api key, -conf-id is required")
+	}
+	return clients_[0], nil
+}
+
+// apiKeyClients returns a client of each api key, the default api key first.
+func apiKeyClients() (clients []*zerosslIPCert.Client) {
+	seen_ := make(map[Secret]bool)
+	add_ := func(apiKey Secret) {
+		if apiKey == "" || seen_[apiKey] {
+			return
+		}
+		seen_[apiKey] = true
+		clients = append(clients, newApiClient(apiKey, slog.Default()))
+	}
+	add_(usingConfig.ApiKey)
+	for _, conf := range usingConfig.CertConfigs {
+		add_(conf.ApiKey)
+	}
+	return
+}
+
+// writeJsonOutput writes v as indented json.
+func writeJsonOutput(w io.Writer, v interface{}) (code int) {
+	enc_ := json.NewEncoder(w)
+	enc_.SetIndent("", "  ")
+	if err := enc_.Encode(v); err != nil {
+		slog.Error("Failed to write output", "error", err)
+		return ExitCode.Failure
+	}
+	return ExitCode.OK
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	zerosslIPCert "github.com/tinkernels/zerossl-ip-cert"
+)
+
+// setupCliTest writes a config of two certs in a temp dir, returns path of the config file.
+func setupCliTest(t *testing.T) (configPath string) {
+	dir_ := t.TempDir()
+	configPath = filepath.Join(dir_, "config.yaml")
+	config_ := `dataDir: ` + filepath.ToSlash(filepath.Join(dir_, "data")) + `
+logFile: ` + filepath.ToSlash(filepath.Join(dir_, "log.txt")) + `
+apiKey: "` + testApiKey + `"
+defaults:
+  days: 90
+  keyType: ecdsa
+  keyCurve: P-256
+  sigAlg: ECDSA-SHA256
+certConfigs:
+  - confId: c1
+    commonName: 192.0.2.1
+    certFile: ` + filepath.ToSlash(filepath.Join(dir_, "cert1.pem")) + `
+    keyFile: ` + filepath.ToSlash(filepath.Join(dir_, "key1.pem")) + `
+  - confId: c2
+    commonName: 192.0.2.2
+    certFile: ` + filepath.ToSlash(filepath.Join(dir_, "cert2.pem")) + `
+    keyFile: ` + filepath.ToSlash(filepath.Join(dir_, "key2.pem")) + `
+`
+	if err := os.WriteFile(configPath, []byte(config_), 0600); err != nil {
+		t.Fatal(err)
+	}
+	origConfig_, origCurrentData_, origLogger_ := usingConfig, currentData, slog.Default()
+	t.Cleanup(func() {
+		usingConfig, currentData = origConfig_, origCurrentData_
+		slog.SetDefault(origLogger_)
+	})
+	return
+}
+
+// runCliOutput runs the cli, returns exit code and what's written to stdout.
+func runCliOutput(t *testing.T, args ...string) (code int, stdout string) {
+	file_, err := os.CreateTemp(t.TempDir(), "stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	origStdout_ := os.Stdout
+	os.Stdout = file_
+	code = runCli(args)
+	os.Stdout = origStdout_
+	if _, err = file_.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	out_, _ := io.ReadAll(file_)
+	_ = file_.Close()
+	return code, string(out_)
+}
+
+func Test_runCli_usage(t *testing.T) {
+	configPath_ := setupCliTest(t)
+	for _, c := range []struct {
+		args []string
+		want int
+	}{
+		{[]string{"version"}, ExitCode.OK},
+		{[]string{"issue", "-h"}, ExitCode.OK},
+		{[]string{"unknown"}, ExitCode.Usage},
+		{[]string{"status", "-unknown-flag"}, ExitCode.Usage},
+		{[]string{"status", "extra"}, ExitCode.Usage},
+		{[]string{"status"}, ExitCode.Usage},
+		{[]string{"revoke", "-config", configPath_}, ExitCode.Usage},
+		{[]string{"issue", "-conf-id", "none", "-dry-run", "-config", configPath_}, ExitCode.Usage},
+		{[]string{"check-config", "-config", configPath_}, ExitCode.OK},
+		{[]string{"check-config", "-config", configPath_ + ".none"}, ExitCode.Config},
+	} {
+		if code, _ := runCliOutput(t, c.args...); code != c.want {
+			t.Errorf("%v: exit code %d, want %d", c.args, code, c.want)
+		}
+	}
+	if _, out := runCliOutput(t, "version"); strings.TrimSpace(out) != Version {
+		t.Errorf("version output %q", out)
+	}
+}
+
+func Test_runCli_commands(t *testing.T) {
+	configPath_ := setupCliTest(t)
+	api_ := newFakeZeroSSL(t, testApiKey)
+
+	if code, _ := runCliOutput(t, "issue", "-conf-id", "c1", "-config", configPath_); code != ExitCode.OK {
+		t.Fatalf("issue exit code %d", code)
+	}
+	if len(currentData.Certs) != 1 || currentData.Certs[0].ConfID != "c1" {
+		t.Fatalf("current data %+v", currentData.Certs)
+	}
+	certID_ := currentData.Certs[0].CertID
+
+	// Failing as c2 is not issued yet.
+	code_, out_ := runCliOutput(t, "status", "-json", "-config", configPath_)
+	var status_ []CertStatusItem
+	if err := json.Unmarshal([]byte(out_), &status_); code_ != ExitCode.Failure || err != nil {
+		t.Fatalf("status exit code %d, error %v, output %v", code_, err, out_)
+	}
+	if len(status_) != 2 || status_[0].CertID != certID_ || status_[1].CertID != "" {
+		t.Errorf("status %+v", status_)
+	}
+
+	code_, out_ = runCliOutput(t, "list", "-config", configPath_)
+	if code_ != ExitCode.OK || !strings.Contains(out_, certID_) {
+		t.Errorf("list exit code %d, output %v", code_, out_)
+	}
+
+	outFile_ := filepath.Join(t.TempDir(), "cert.pem")
+	code_, _ = runCliOutput(t, "download", "-conf-id", "c1", "-out", outFile_, "-config", configPath_)
+	if code_ != ExitCode.OK {
+		t.Errorf("download exit code %d", code_)
+	}
+	if content_, err := os.ReadFile(outFile_); err != nil || !strings.Contains(string(content_), "CERTIFICATE") {
+		t.Errorf("downloaded %q, error %v", content_, err)
+	}
+
+	code_, _ = runCliOutput(t, "revoke", "-conf-id", "c1", "-reason", "keyCompromise", "-config", configPath_)
+	if code_ != ExitCode.OK {
+		t.Errorf("revoke exit code %d", code_)
+	}
+	if status_ := api_.cert(certID_).Status; status_ != zerosslIPCert.CertStatus.Revoked {
+		t.Errorf("status after revoke %v", status_)
+	}
+
+	draft_ := api_.addCert("192.0.2.3", zerosslIPCert.CertStatus.Draft, time.Now(), time.Now().AddDate(0, 0, 90))
+	if code, _ := runCliOutput(t, "cancel", "-cert-id", draft_.ID, "-config", configPath_); code != ExitCode.OK {
+		t.Errorf("cancel exit code %d", code)
+	}
+	if draft_.Status != zerosslIPCert.CertStatus.Cancelled {
+		t.Errorf("status after cancel %v", draft_.Status)
+	}
+
+	// The revoked cert is due for renewal.
+	code_, out_ = runCliOutput(t, "renew", "-dry-run", "-config", configPath_)
+	if code_ != ExitCode.OK || !strings.Contains(out_, PlanAction.Renew) {
+		t.Errorf("renew dry run exit code %d, output %v", code_, out_)
+	}
+
+	api_.failApi[zerosslIPCert.ApiName.GetCertificate] = io.ErrUnexpectedEOF
+	if code, _ := runCliOutput(t, "renew", "-config", configPath_); code != ExitCode.Failure {
+		t.Errorf("failed renew exit code %d", code)
+	}
+}
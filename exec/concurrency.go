@@ -0,0 +1,115 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultApiRateLimit is the default max api calls per second of each api key.
+const DefaultApiRateLimit = 10
+
+// rateLimiter is a token bucket allowing rate calls per second with bursts of rate calls.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// Wait blocks until a call is allowed or ctx is done.
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	l.mu.Lock()
+	now_ := time.Now()
+	l.tokens += now_.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now_
+	// Taking the token in advance, so waiting calls are queued.
+	l.tokens--
+	wait_ := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if wait_ <= 0 {
+		return nil
+	}
+	timer_ := time.NewTimer(wait_)
+	defer timer_.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer_.C:
+		return nil
+	}
+}
+
+var apiRateLimitersMu sync.Mutex
+var apiRateLimiters = make(map[Secret]*rateLimiter)
+
+// apiRateLimiter returns the rate limiter shared by clients of the api key.
+func apiRateLimiter(apiKey Secret) *rateLimiter {
+	apiRateLimitersMu.Lock()
+	defer apiRateLimitersMu.Unlock()
+	limiter_, ok := apiRateLimiters[apiKey]
+	if !ok {
+		rate_ := usingConfig.ApiRateLimit
+		if rate_ <= 0 {
+			rate_ = DefaultApiRateLimit
+		}
+		limiter_ = newRateLimiter(rate_)
+		apiRateLimiters[apiKey] = limiter_
+	}
+	return limiter_
+}
+
+// concurrency returns the number of certs issued in parallel.
+func concurrency() int {
+	if usingConfig.Concurrency > 1 {
+		return usingConfig.Concurrency
+	}
+	return 1
+}
+
+// forEachCert calls fn for each cert config with at most concurrency() calls in parallel,
+// returns errors of all calls joined in order of confs.
+func forEachCert(confs []*CertConf, fn func(conf *CertConf) error) error {
+	errs_ := make([]error, len(confs))
+	jobs_ := make(chan int)
+	var wg_ sync.WaitGroup
+	for w := 0; w < concurrency() && w < len(confs); w++ {
+		wg_.Add(1)
+		go func() {
+			defer wg_.Done()
+			for i := range jobs_ {
+				errs_[i] = fn(confs[i])
+			}
+		}()
+	}
+	for i := range confs {
+		jobs_ <- i
+	}
+	close(jobs_)
+	wg_.Wait()
+	return errors.Join(errs_...)
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_rateLimiter(t *testing.T) {
+	limiter_ := newRateLimiter(20)
+	start_ := time.Now()
+	for i := 0; i < 20; i++ {
+		if err := limiter_.Wait(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed_ := time.Since(start_); elapsed_ > 20*time.Millisecond {
+		t.Errorf("burst waited %v", elapsed_)
+	}
+	if err := limiter_.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed_ := time.Since(start_); elapsed_ < 40*time.Millisecond {
+		t.Errorf("call after burst waited only %v", elapsed_)
+	}
+	ctx_, cancel_ := context.WithCancel(context.Background())
+	cancel_()
+	if err := limiter_.Wait(ctx_); !errors.Is(err, context.Canceled) {
+		t.Errorf("expect context canceled, got %v", err)
+	}
+}
+
+func Test_forEachCert(t *testing.T) {
+	origConfig_ := usingConfig
+	t.Cleanup(func() { usingConfig = origConfig_ })
+	usingConfig = &Config{Concurrency: 3}
+	var confs_ []*CertConf
+	for i := 0; i < 10; i++ {
+		confs_ = append(confs_, &CertConf{ConfID: fmt.Sprint(i)})
+	}
+	var mu_ sync.Mutex
+	running_, maxRunning_ := 0, 0
+	err := forEachCert(confs_, func(conf *CertConf) error {
+		mu_.Lock()
+		running_++
+		if running_ > maxRunning_ {
+			maxRunning_ = running_
+		}
+		mu_.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu_.Lock()
+		running_--
+		mu_.Unlock()
+		if conf.ConfID == "3" || conf.ConfID == "7" {
+			return fmt.Errorf("failed %v", conf.ConfID)
+		}
+		return nil
+	})
+	if maxRunning_ < 2 || maxRunning_ > 3 {
+		t.Errorf("max running %d", maxRunning_)
+	}
+	if err == nil || err.Error() != "failed 3\nfailed 7" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func Test_issueCerts_concurrency(t *testing.T) {
+	configPath_ := setupCliTest(t)
+	file_, err := os.OpenFile(configPath_, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = file_.WriteString("concurrency: 2\napiRateLimit: 1000\n")
+	_ = file_.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newFakeZeroSSL(t, testApiKey)
+	if code, _ := runCliOutput(t, "issue", "-config", configPath_); code != ExitCode.OK {
+		t.Fatalf("issue exit code %d", code)
+	}
+	var confIDs_ []string
+	for _, cert := range currentData.Certs {
+		confIDs_ = append(confIDs_, cert.ConfID)
+	}
+	if len(confIDs_) != 2 || !strings.Contains(strings.Join(confIDs_, ","), "c1") ||
+		!strings.Contains(strings.Join(confIDs_, ","), "c2") {
+		t.Errorf("unexpected current certs %v", confIDs_)
+	}
+	for _, conf := range usingConfig.CertConfigs {
+		if _, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile); err != nil {
+			t.Errorf("%v: %v", conf.ConfID, err)
+		}
+	}
+}
@@ -17,80 +17,141 @@
 package main
 
 import (
+	"fmt"
 	"gopkg.in/yaml.v3"
 	"io/ioutil"
-	"os"
+	"reflect"
 )
 
 type CertConf struct {
-	ConfID           string `yaml:"confId"`
-	ApiKey           string `yaml:"apiKey"`
-	Country          string `yaml:"country"`
-	Province         string `yaml:"province"`
-	City             string `yaml:"city"`
-	Locality         string `yaml:"locality"`
-	Organization     string `yaml:"organization"`
-	OrganizationUnit string `yaml:"organizationUnit"`
-	CommonName       string `yaml:"commonName"`
-	Days             int    `yaml:"days"`
-	KeyType          string `yaml:"keyType"`
-	KeyBits          int    `yaml:"keyBits"`
-	KeyCurve         string `yaml:"keyCurve"`
-	SigAlg           string `yaml:"sigAlg"`
-	StrictDomains    int    `yaml:"strictDomains"`
-	VerifyMethod     string `yaml:"verifyMethod"`
-	VerifyHook       string `yaml:"verifyHook"`
-	PostHook         string `yaml:"postHook"`
-	CertFile         string `yaml:"certFile"`
-	KeyFile          string `yaml:"keyFile"`
+	ConfID           string              `yaml:"confId"`
+	ApiKey           Secret              `yaml:"apiKey"`
+	Country          string              `yaml:"country"`
+	Province         string              `yaml:"province"`
+	City             string              `yaml:"city"`
+	Locality         string              `yaml:"locality"`
+	Organization     string              `yaml:"organization"`
+	OrganizationUnit string              `yaml:"organizationUnit"`
+	CommonName       string              `yaml:"commonName"`
+	Days             int                 `yaml:"days"`
+	KeyType          string              `yaml:"keyType"`
+	KeyBits          int                 `yaml:"keyBits"`
+	KeyCurve         string              `yaml:"keyCurve"`
+	SigAlg           string              `yaml:"sigAlg"`
+	StrictDomains    int                 `yaml:"strictDomains"`
+	VerifyMethod     string              `yaml:"verifyMethod"`
+	VerifyResponder  VerifyResponderConf `yaml:"verifyResponder"`
+	VerifyHook       HookCmd             `yaml:"verifyHook"`
+	CleanupHook      HookCmd             `yaml:"cleanupHook"`
+	PostHook         HookCmd             `yaml:"postHook"`
+	PostActions      []PostActionConf    `yaml:"postActions"`
+	CertFile         string              `yaml:"certFile"`
+	KeyFile          string              `yaml:"keyFile"`
 }
 
 type Config struct {
-	DataDir         string     `yaml:"dataDir"`
-	LogFile         string     `yaml:"logFile"`
-	CleanUnfinished bool       `yaml:"cleanUnfinished"`
-	CertConfigs     []CertConf `yaml:"certConfigs"`
+	// Default API key of certConfigs without apiKey.
+	ApiKey          Secret `yaml:"apiKey"`
+	DataDir         string `yaml:"dataDir"`
+	LogFile         string `yaml:"logFile"`
+	LogLevel        string `yaml:"logLevel"`
+	LogFormat       string `yaml:"logFormat"`
+	CleanUnfinished bool   `yaml:"cleanUnfinished"`
+	// Minutes unfinished certs must have been created before being cleaned.
+	CleanUnfinishedMinAge int `yaml:"cleanUnfinishedMinAge"`
+	// Defaults of certConfigs, merged into each of certConfigs by ReadConfig.
+	Defaults    CertConf   `yaml:"defaults"`
+	CertConfigs []CertConf `yaml:"certConfigs"`
+	// Notifiers of issuance, renewal and failure events.
+	Notifiers []NotifierConf `yaml:"notifiers"`
+	// Days before expiry to send expiring events when renewal fails.
+	NotifyExpiringDays int `yaml:"notifyExpiringDays"`
+	// Metrics exposing.
+	Metrics MetricsConf `yaml:"metrics"`
+	// Interval in minutes of checking certs in daemon mode.
+	DaemonInterval int `yaml:"daemonInterval"`
+	// Number of certs issued in parallel, 1 by default.
+	Concurrency int `yaml:"concurrency"`
+	// Max api calls per second of each api key.
+	ApiRateLimit int `yaml:"apiRateLimit"`
+	// Locking of the data dir.
+	Lock LockConf `yaml:"lock"`
+	// Store of current data.
+	State StateConf `yaml:"state"`
+	// Storage of sharing certs between instances.
+	Storage StorageConf `yaml:"storage"`
+
+	// node is the root node of the config file, for reporting lines of problems.
+	node *yaml.Node
+	// unknownKeys are reported by Validate with other problems.
+	unknownKeys ConfigErrors
 }
 
-// ReadConfig reads the config file and returns a Config struct.
+// ReadConfig reads the config file and returns a Config struct, unknown keys are rejected: ConfigErrors of them are
+// returned with the config still decoded, whose Validate reports them with other problems.
+// Top-level keys prefixed with "x-" are ignored, which can be used for defining yaml anchors.
 func ReadConfig(path string) (config *Config, err error) {
 	var input_ []byte
-	input_, err = ioutil.ReadFile(path)
-	err = yaml.Unmarshal(input_, &config)
+	if input_, err = ioutil.ReadFile(path); err != nil {
+		return nil, err
+	}
+	var doc_ yaml.Node
+	err = yaml.Unmarshal(input_, &doc_)
 	if err != nil {
 		return nil, err
 	}
-	return
-}
-
-type CurrentData struct {
-	Certs []CurrentCertData `yaml:"certs"`
-}
-
-type CurrentCertData struct {
-	CommonName string `yaml:"commonName"`
-	ConfID     string `yaml:"confId"`
-	CertID     string `yaml:"certId"`
-	CertFile   string `yaml:"certFile"`
-	KeyFile    string `yaml:"keyFile"`
-}
-
-// ReadCurrentData reads the current data file and returns a CurrentData struct.
-func ReadCurrentData(path string) (data *CurrentData, err error) {
-	var input_ []byte
-	input_, err = ioutil.ReadFile(path)
-	if err = yaml.Unmarshal(input_, &data); err != nil {
+	if doc_.Kind == 0 {
+		return nil, fmt.Errorf("empty config file %v", path)
+	}
+	merged_ := mergeDefaults(&doc_)
+	root_ := merged_.Content[0]
+	unknownKeys_ := checkKeys(root_, reflect.TypeOf(Config{}), nil)
+	if err = merged_.Decode(&config); err != nil {
 		return nil, err
 	}
+	if config == nil {
+		return nil, fmt.Errorf("empty config file %v", path)
+	}
+	config.node = root_
+	if err = config.resolveSecrets(); err != nil {
+		return nil, err
+	}
+	if len(unknownKeys_) > 0 {
+		config.unknownKeys = unknownKeys_
+		return config, unknownKeys_
+	}
 	return
 }
 
-// WriteCurrentData writes the current data file.
-func WriteCurrentData(path string, data *CurrentData) (err error) {
-	var output []byte
-	output, err = yaml.Marshal(data)
-	if err = ioutil.WriteFile(path, output, os.ModePerm); err != nil {
-		return err
+// resolveSecrets sets the default API key to certConfigs without one, and resolves secret references.
+func (c *Config) resolveSecrets() (err error) {
+	// Resolving the default API key once, commands of exec references are not run repeatedly.
+	defaultApiKey_, err := c.ApiKey.Resolve()
+	if err != nil {
+		return fmt.Errorf("resolving apiKey: %w", err)
+	}
+	c.ApiKey = defaultApiKey_
+	for i := range c.CertConfigs {
+		conf_ := &c.CertConfigs[i]
+		if conf_.ApiKey == "" {
+			conf_.ApiKey = c.ApiKey
+			continue
+		}
+		if conf_.ApiKey, err = conf_.ApiKey.Resolve(); err != nil {
+			return fmt.Errorf("resolving apiKey of certConfig %v: %w", conf_.ConfID, err)
+		}
+	}
+	for i := range c.Notifiers {
+		notifier_ := &c.Notifiers[i]
+		if notifier_.SmtpPassword, err = notifier_.SmtpPassword.Resolve(); err != nil {
+			return fmt.Errorf("resolving smtpPassword of notifier %v: %w", i, err)
+		}
+	}
+	if c.Storage.AccessKey, err = c.Storage.AccessKey.Resolve(); err != nil {
+		return fmt.Errorf("resolving accessKey of storage: %w", err)
+	}
+	if c.Storage.SecretKey, err = c.Storage.SecretKey.Resolve(); err != nil {
+		return fmt.Errorf("resolving secretKey of storage: %w", err)
 	}
 	return
 }
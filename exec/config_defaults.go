@@ -0,0 +1,116 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"gopkg.in/yaml.v3"
+)
+
+// mergeKeyTag is the tag of "<<" keys in yaml mappings.
+const mergeKeyTag = "!!merge"
+
+// expandNode returns a copy of the node with aliases replaced by copies of their anchors and merge keys ("<<")
+// expanded, so that every cert config owns its values and merged keys are visible for defaults merging.
+// Merge keys are shallow as the yaml spec says: keys of the mapping win over merged ones, and earlier merged
+// mappings win over later ones.
+func expandNode(node *yaml.Node) *yaml.Node {
+	switch node.Kind {
+	case yaml.AliasNode:
+		return expandNode(node.Alias)
+	case yaml.MappingNode:
+		copy_ := *node
+		copy_.Content = nil
+		var merged_ []*yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key_, value_ := node.Content[i], node.Content[i+1]
+			if key_.Kind == yaml.ScalarNode && key_.Tag == mergeKeyTag {
+				value_ = expandNode(value_)
+				if value_.Kind == yaml.SequenceNode {
+					merged_ = append(merged_, value_.Content...)
+				} else {
+					merged_ = append(merged_, value_)
+				}
+				continue
+			}
+			copy_.Content = append(copy_.Content, expandNode(key_), expandNode(value_))
+		}
+		for _, m := range merged_ {
+			mergeMapping(&copy_, m, false)
+		}
+		return &copy_
+	default:
+		copy_ := *node
+		copy_.Content = nil
+		for _, n := range node.Content {
+			copy_.Content = append(copy_.Content, expandNode(n))
+		}
+		return &copy_
+	}
+}
+
+// mergeMapping adds keys of src absent in dst to dst, merges nested mappings too when deep is set.
+// Sequences and scalars are never merged, the values in dst win.
+func mergeMapping(dst, src *yaml.Node, deep bool) {
+	if dst.Kind != yaml.MappingNode || src.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(src.Content); i += 2 {
+		key_, value_ := src.Content[i], src.Content[i+1]
+		dstValue_ := mappingValue(dst, key_.Value)
+		if dstValue_ == nil {
+			// Copying, nodes of src are merged into more than one mapping.
+			dst.Content = append(dst.Content, expandNode(key_), expandNode(value_))
+			continue
+		}
+		if deep {
+			mergeMapping(dstValue_, value_, deep)
+		}
+	}
+}
+
+// mappingValue returns the value of the key in the mapping node, or nil if not found.
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	if mapping == nil || mapping.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// mergeDefaults expands the config document, and merges the "defaults" mapping into each of "certConfigs".
+// Values set in a cert config, including merged by "<<", win over defaults. Nested mappings
+// (e.g. verifyResponder) are merged key by key, sequences (e.g. hooks, postActions) are replaced as a whole.
+func mergeDefaults(doc *yaml.Node) *yaml.Node {
+	doc = expandNode(doc)
+	root_ := doc
+	if root_.Kind == yaml.DocumentNode && len(root_.Content) > 0 {
+		root_ = root_.Content[0]
+	}
+	defaults_ := mappingValue(root_, "defaults")
+	certConfigs_ := mappingValue(root_, "certConfigs")
+	if defaults_ == nil || certConfigs_ == nil || certConfigs_.Kind != yaml.SequenceNode {
+		return doc
+	}
+	for _, c := range certConfigs_.Content {
+		mergeMapping(c, defaults_, true)
+	}
+	return doc
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadConfig_defaults(t *testing.T) {
+	path_ := filepath.Join(t.TempDir(), "config.yaml")
+	content_ := `
+apiKey: key
+x-csr: &csr
+  country: US
+  organization: Example
+defaults:
+  days: 90
+  keyType: ECDSA
+  keyCurve: P-256
+  strictDomains: 1
+  verifyResponder:
+    type: caddy
+    caddyAdmin: http://localhost:2019
+  postHook: [ reload.sh ]
+certConfigs:
+  - confId: c1
+    commonName: 192.0.2.1
+    <<: *csr
+  - confId: c2
+    commonName: 192.0.2.2
+    <<: *csr
+    organization: Other
+    strictDomains: 0
+    verifyResponder:
+      caddyServer: srv1
+    postHook: [ other.sh ]
+`
+	if err := os.WriteFile(path_, []byte(content_), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf_, err := ReadConfig(path_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := conf_.CertConfigs[0], conf_.CertConfigs[1]
+	if c1.Country != "US" || c1.Organization != "Example" || c1.Days != 90 || c1.KeyCurve != "P-256" ||
+		c1.StrictDomains != 1 || c1.VerifyResponder.CaddyAdmin != "http://localhost:2019" ||
+		!reflect.DeepEqual(c1.PostHook, HookCmd{"reload.sh"}) {
+		t.Errorf("c1 = %+v", c1)
+	}
+	// Values of the cert config win, including zero values, nested mappings are merged key by key.
+	if c2.Country != "US" || c2.Organization != "Other" || c2.StrictDomains != 0 ||
+		c2.VerifyResponder.Type != VerifyResponderType.Caddy || c2.VerifyResponder.CaddyServer != "srv1" ||
+		!reflect.DeepEqual(c2.PostHook, HookCmd{"other.sh"}) {
+		t.Errorf("c2 = %+v", c2)
+	}
+	// Values of the anchor are not changed by merging.
+	if c1.VerifyResponder.CaddyServer != "" {
+		t.Errorf("defaults changed by merging: %+v", c1.VerifyResponder)
+	}
+}
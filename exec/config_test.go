@@ -17,35 +17,83 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 )
 
 func TestReadConfig(t *testing.T) {
-	conf_, err := ReadConfig("config.yaml")
+	t.Setenv("ZEROSSL_API_KEY", "key")
+	t.Setenv("SMTP_PASSWORD", "password")
+	t.Setenv("S3_ACCESS_KEY", "access")
+	t.Setenv("S3_SECRET_KEY", "secret")
+	conf_, err := ReadConfig("sample-config.yaml")
 	if err != nil {
 		t.Errorf("ReadConfig failed: %s", err)
 	}
 	t.Logf("config: %+v", conf_)
 }
 
+func TestReadConfig_apiKey(t *testing.T) {
+	path_ := filepath.Join(t.TempDir(), "config.yaml")
+	t.Setenv("TEST_ZEROSSL_API_KEY", "default-key")
+	content_ := `
+apiKey: env:TEST_ZEROSSL_API_KEY
+certConfigs:
+  - confId: inherited
+  - confId: own
+    apiKey: own-key
+`
+	if err := os.WriteFile(path_, []byte(content_), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf_, err := ReadConfig(path_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := conf_.CertConfigs[0].ApiKey.Value(); got != "default-key" {
+		t.Errorf("inherited apiKey = %q", got)
+	}
+	if got := conf_.CertConfigs[1].ApiKey.Value(); got != "own-key" {
+		t.Errorf("own apiKey = %q", got)
+	}
+
+	t.Setenv("TEST_ZEROSSL_API_KEY", "")
+	if _, err = ReadConfig(path_); err == nil {
+		t.Errorf("expected error of empty apiKey reference")
+	}
+}
+
 func TestReadCurrentData(t *testing.T) {
-	data_, err := ReadCurrentData("current.yaml")
+	data_, err := ReadCurrentData("sample-current.yaml")
 	if err != nil {
-		t.Errorf("ReadCurrentData failed: %s", err)
+		t.Fatalf("ReadCurrentData failed: %s", err)
+	}
+	if data_ == nil || len(data_.Certs) == 0 {
+		t.Fatalf("no certs in sample current data: %+v", data_)
+	}
+	if data_, err = ReadCurrentData(filepath.Join(t.TempDir(), "current.yaml")); err != nil || data_ != nil {
+		t.Errorf("missing file: data %+v, error %v", data_, err)
 	}
-	t.Logf("data: %+v", data_)
 }
 
 func TestWriteCurrentData(t *testing.T) {
-	data_, err := ReadCurrentData("current.yaml")
+	data_, err := ReadCurrentData("sample-current.yaml")
 	if err != nil {
-		t.Errorf("ReadCurrentData failed: %s", err)
+		t.Fatalf("ReadCurrentData failed: %s", err)
 	}
 	for k := range data_.Certs {
 		data_.Certs[k].CertID += "1"
 	}
-	err = WriteCurrentData("current.yaml", data_)
+	path_ := filepath.Join(t.TempDir(), "current.yaml")
+	if err = WriteCurrentData(path_, data_); err != nil {
+		t.Fatalf("WriteCurrentData failed: %s", err)
+	}
+	written_, err := ReadCurrentData(path_)
 	if err != nil {
-		t.Errorf("WriteCurrentData failed: %s", err)
+		t.Fatal(err)
+	}
+	if len(written_.Certs) != len(data_.Certs) || written_.Certs[0].CertID != data_.Certs[0].CertID {
+		t.Errorf("written %+v, want %+v", written_.Certs, data_.Certs)
 	}
 }
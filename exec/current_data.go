@@ -0,0 +1,299 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CurrentDataVersion is the version of current data written, older versions are migrated when read.
+const CurrentDataVersion = 2
+
+// MaxCertHistory is the max number of previous cert IDs kept in a cert record.
+const MaxCertHistory = 10
+
+type CurrentData struct {
+	// Version of the file, files without version are version 1.
+	Version int               `yaml:"version"`
+	Certs   []CurrentCertData `yaml:"certs"`
+	// Issuances in progress, resumed in the next run if the process dies or they fail after the cert is created.
+	Pending []PendingIssuance `yaml:"pending,omitempty"`
+	// Certs created and not issued yet, the only unfinished certs cleaned besides certs of configured common names.
+	Created []CreatedCert `yaml:"created,omitempty"`
+}
+
+// CreatedCert is a cert created for the cert config.
+type CreatedCert struct {
+	ConfID string `yaml:"confId"`
+	CertID string `yaml:"certId"`
+}
+
+type CurrentCertData struct {
+	CommonName string `yaml:"commonName"`
+	ConfID     string `yaml:"confId"`
+	CertID     string `yaml:"certId"`
+	CertFile   string `yaml:"certFile"`
+	KeyFile    string `yaml:"keyFile"`
+	// Details of the installed cert.
+	Issued      time.Time `yaml:"issued,omitempty"`
+	Expires     time.Time `yaml:"expires,omitempty"`
+	KeyType     string    `yaml:"keyType,omitempty"`
+	SANs        []string  `yaml:"sans,omitempty"`
+	Fingerprint string    `yaml:"fingerprint,omitempty"` // sha256 of the cert in hex
+	// Last renewal attempt and its error, empty if succeeded.
+	LastAttempt time.Time `yaml:"lastAttempt,omitempty"`
+	LastError   string    `yaml:"lastError,omitempty"`
+	// Previous cert IDs of the cert config, the latest first.
+	History []string `yaml:"history,omitempty"`
+}
+
+// PendingIssuance is an issuance in progress of a cert config.
+type PendingIssuance struct {
+	ConfID string `yaml:"confId"`
+	CertID string `yaml:"certId"`
+	// Phase is the last phase started, see Phase.
+	Phase   string    `yaml:"phase"`
+	WorkDir string    `yaml:"workDir"`
+	KeyFile string    `yaml:"keyFile"`
+	Started time.Time `yaml:"started"`
+	// Attempts of the issuance, including the first one.
+	Attempts int `yaml:"attempts"`
+}
+
+// currentDataMigrations migrate current data of version i+1 to version i+2.
+var currentDataMigrations = []func(doc *yaml.Node) error{
+	// Version 1 to 2: confID in early sample files is renamed to confId.
+	func(doc *yaml.Node) error {
+		certs_ := mappingValue(doc, "certs")
+		if certs_ == nil || certs_.Kind != yaml.SequenceNode {
+			return nil
+		}
+		for _, cert := range certs_.Content {
+			if cert.Kind != yaml.MappingNode || mappingValue(cert, "confId") != nil {
+				continue
+			}
+			for i := 0; i+1 < len(cert.Content); i += 2 {
+				if cert.Content[i].Value == "confID" {
+					cert.Content[i].Value = "confId"
+				}
+			}
+		}
+		return nil
+	},
+}
+
+// ReadCurrentData reads the current data file and returns a CurrentData struct, migrated from older versions.
+// Data is nil if the file doesn't exist or is empty.
+func ReadCurrentData(path string) (data *CurrentData, err error) {
+	input_, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	var root_ yaml.Node
+	if err = yaml.Unmarshal(input_, &root_); err != nil {
+		return nil, err
+	}
+	// Empty file.
+	if len(root_.Content) == 0 {
+		return
+	}
+	doc_ := root_.Content[0]
+	if doc_.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("current data is not a mapping")
+	}
+	version_ := 1
+	if v := mappingValue(doc_, "version"); v != nil {
+		if err = v.Decode(&version_); err != nil {
+			return nil, fmt.Errorf("decoding version: %w", err)
+		}
+	}
+	if version_ > CurrentDataVersion || version_ < 1 {
+		return nil, fmt.Errorf("unsupported current data version %d, %d is supported", version_, CurrentDataVersion)
+	}
+	for v := version_; v < CurrentDataVersion; v++ {
+		if err = currentDataMigrations[v-1](doc_); err != nil {
+			return nil, fmt.Errorf("migrating current data from version %d: %w", v, err)
+		}
+	}
+	if err = doc_.Decode(&data); err != nil {
+		return nil, err
+	}
+	data.Version = CurrentDataVersion
+	return
+}
+
+// WriteCurrentData writes the current data file atomically with mode 0600.
+func WriteCurrentData(path string, data *CurrentData) (err error) {
+	data.Version = CurrentDataVersion
+	output_, err := yaml.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("marshalling current data: %w", err)
+	}
+	return writeFileAtomic(path, output_, 0600)
+}
+
+// saveCurrentData saves current data into the state store, callers hold currentDataMu.
+func saveCurrentData() error {
+	return stateStore.Save(currentData)
+}
+
+// writeFileAtomic writes data to a temp file in the dir of path and renames it to path, so path is either the old
+// or the new content even if the process dies.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	temp_, err := stageFile(path, data, perm)
+	if err != nil {
+		return
+	}
+	if err = os.Rename(temp_, path); err != nil {
+		_ = os.Remove(temp_)
+	}
+	return
+}
+
+// stageFile writes and syncs data to a temp file in the dir of path, which is to be renamed to path.
+func stageFile(path string, data []byte, perm os.FileMode) (temp string, err error) {
+	file_, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = file_.Close()
+			_ = os.Remove(file_.Name())
+		}
+	}()
+	if err = file_.Chmod(perm); err != nil {
+		return
+	}
+	if _, err = file_.Write(data); err != nil {
+		return
+	}
+	if err = file_.Sync(); err != nil {
+		return
+	}
+	if err = file_.Close(); err != nil {
+		return
+	}
+	return file_.Name(), nil
+}
+
+// certRecord returns the record of the cert installed for the cert config, details are read from the cert file.
+// History is kept from prev, with the cert ID of prev added if it is replaced.
+func certRecord(conf *CertConf, certID string, prev *CurrentCertData) (record CurrentCertData, err error) {
+	record = CurrentCertData{
+		CommonName: conf.CommonName,
+		ConfID:     conf.ConfID,
+		CertID:     certID,
+		CertFile:   conf.CertFile,
+		KeyFile:    conf.KeyFile,
+		KeyType:    conf.KeyType,
+	}
+	if prev != nil {
+		record.History = prev.History
+		if prev.CertID != "" && prev.CertID != certID {
+			record.History = append([]string{prev.CertID}, record.History...)
+		}
+		if len(record.History) > MaxCertHistory {
+			record.History = record.History[:MaxCertHistory]
+		}
+	}
+	cert_, err := readCertFile(conf.CertFile)
+	if err != nil {
+		return
+	}
+	record.Issued, record.Expires = cert_.NotBefore.UTC(), cert_.NotAfter.UTC()
+	record.SANs = certSANs(cert_)
+	record.Fingerprint = certFingerprint(cert_)
+	return
+}
+
+// certFingerprint returns sha256 of the cert in hex.
+func certFingerprint(cert *x509.Certificate) string {
+	sum_ := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum_[:])
+}
+
+// certSANs returns dns names and ip addresses of the cert.
+func certSANs(cert *x509.Certificate) (sans []string) {
+	sans = append(sans, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, net.IP.String(ip))
+	}
+	return
+}
+
+// saveCertRecord replaces the record of cert prevID, or adds a record if not found, with the record of the cert
+// certID installed for the cert config, then writes current data.
+func saveCertRecord(conf *CertConf, prevID, certID string, logger *slog.Logger) {
+	currentDataMu.Lock()
+	defer currentDataMu.Unlock()
+	index_ := -1
+	var prev_ *CurrentCertData
+	for i := range currentData.Certs {
+		// Use original cert ID to match cert.
+		if prevID != "" && currentData.Certs[i].CertID == prevID {
+			index_, prev_ = i, &currentData.Certs[i]
+			break
+		}
+	}
+	record_, err := certRecord(conf, certID, prev_)
+	if err != nil {
+		logger.Warn("Failed to read details of installed cert", "error", err)
+	}
+	record_.LastAttempt = time.Now().UTC()
+	// Issued, not to be cleaned.
+	removeCreatedCerts(certID)
+	if index_ < 0 {
+		currentData.Certs = append(currentData.Certs, record_)
+	} else {
+		currentData.Certs[index_] = record_
+	}
+	if err = saveCurrentData(); err != nil {
+		logger.Error("Failed to write current data", "error", err)
+	}
+}
+
+// saveRenewalFailure records the failed renewal attempt of cert id, then writes current data.
+func saveRenewalFailure(id string, renewErr error, logger *slog.Logger) {
+	currentDataMu.Lock()
+	defer currentDataMu.Unlock()
+	for i := range currentData.Certs {
+		if currentData.Certs[i].CertID == id {
+			currentData.Certs[i].LastAttempt = time.Now().UTC()
+			currentData.Certs[i].LastError = renewErr.Error()
+			if err := saveCurrentData(); err != nil {
+				logger.Error("Failed to write current data", "error", err)
+			}
+			return
+		}
+	}
+}
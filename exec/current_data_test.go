@@ -0,0 +1,112 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadCurrentDataMigrate(t *testing.T) {
+	path_ := filepath.Join(t.TempDir(), "current.yaml")
+	v1_ := "certs:\n  - commonName: 1.2.3.4\n    confID: xx1\n    certId: id1\n"
+	if err := os.WriteFile(path_, []byte(v1_), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data_, err := ReadCurrentData(path_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data_.Version != CurrentDataVersion || len(data_.Certs) != 1 || data_.Certs[0].ConfID != "xx1" {
+		t.Errorf("unexpected migrated data %+v", data_)
+	}
+	// Sample is readable.
+	if _, err = ReadCurrentData("sample-current.yaml"); err != nil {
+		t.Error(err)
+	}
+	if err = os.WriteFile(path_, []byte("version: 99\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ReadCurrentData(path_); err == nil || !strings.Contains(err.Error(), "version 99") {
+		t.Errorf("expected unsupported version error, got %v", err)
+	}
+}
+
+func TestWriteCurrentDataAtomic(t *testing.T) {
+	dir_ := t.TempDir()
+	path_ := filepath.Join(dir_, "current.yaml")
+	if err := os.WriteFile(path_, []byte("certs: []\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data_ := &CurrentData{Certs: []CurrentCertData{{ConfID: "xx1", CertID: "id1", History: []string{"id0"}}}}
+	if err := WriteCurrentData(path_, data_); err != nil {
+		t.Fatal(err)
+	}
+	info_, err := os.Stat(path_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info_.Mode().Perm() != 0600 {
+		t.Errorf("mode %v, want 0600", info_.Mode().Perm())
+	}
+	entries_, _ := os.ReadDir(dir_)
+	if len(entries_) != 1 {
+		t.Errorf("temp files left: %v", entries_)
+	}
+	read_, err := ReadCurrentData(path_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read_.Version != CurrentDataVersion || read_.Certs[0].History[0] != "id0" {
+		t.Errorf("unexpected data %+v", read_)
+	}
+}
+
+func TestSaveCertRecord(t *testing.T) {
+	conf_, _ := setupIssueTest(t)
+	writeTestCert(t, conf_.CertFile, conf_.CommonName, time.Now(), time.Now().Add(90*24*time.Hour))
+	currentData.Certs = []CurrentCertData{{ConfID: conf_.ConfID, CertID: "old", History: []string{"older"}}}
+	currentData.Created = []CreatedCert{{ConfID: conf_.ConfID, CertID: "new"}, {ConfID: conf_.ConfID, CertID: "other"}}
+	saveRenewalFailure("old", errors.New("boom"), slog.Default())
+	if c := currentData.Certs[0]; c.LastError != "boom" || c.LastAttempt.IsZero() {
+		t.Errorf("renewal failure not recorded: %+v", c)
+	}
+	saveCertRecord(conf_, "old", "new", slog.Default())
+	data_, err := stateStore.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data_.Certs) != 1 {
+		t.Fatalf("unexpected certs %+v", data_.Certs)
+	}
+	c := data_.Certs[0]
+	if c.CertID != "new" || c.LastError != "" || c.Expires.Before(time.Now()) || c.Issued.IsZero() ||
+		len(c.Fingerprint) != 64 || len(c.SANs) != 1 || c.SANs[0] != conf_.CommonName ||
+		strings.Join(c.History, ",") != "old,older" {
+		t.Errorf("unexpected record %+v", c)
+	}
+	// The issued cert is no longer tracked as created.
+	if len(data_.Created) != 1 || data_.Created[0].CertID != "other" {
+		t.Errorf("unexpected created certs %+v", data_.Created)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"text/tabwriter"
+)
+
+// PlanAction represents what would be done with a cert.
+var PlanAction = struct {
+	Issue string // no current cert, a new one would be issued
+	Renew string // current cert is due for renewal
+	Skip  string // nothing would be done
+	Fail  string // the action can't be decided or would fail
+}{
+	Issue: "issue",
+	Renew: "renew",
+	Skip:  "skip",
+	Fail:  "fail",
+}
+
+// PlanItem is what would be done with a cert and why.
+type PlanItem struct {
+	ConfID     string
+	CommonName string
+	CertID     string
+	Action     string
+	Reason     string
+}
+
+// planCerts returns what a run would do with the certs, using the same logic as issueCerts (or renew if renewOnly)
+// and renewCert, but without changing anything: CSRs are generated but not submitted, only certs info is
+// requested from ZeroSSL.
+func planCerts(renewOnly bool) (items []PlanItem) {
+	current_ := make(map[string]CurrentCertData)
+	for _, cert := range currentData.Certs {
+		current_[cert.ConfID] = cert
+	}
+	configured_ := make(map[string]bool)
+	for i := range usingConfig.CertConfigs {
+		conf_ := &usingConfig.CertConfigs[i]
+		configured_[conf_.ConfID] = true
+		cert_, ok := current_[conf_.ConfID]
+		if !ok && renewOnly {
+			items = append(items, PlanItem{ConfID: conf_.ConfID, CommonName: conf_.CommonName,
+				Action: PlanAction.Skip, Reason: "no current cert to renew"})
+			continue
+		}
+		items = append(items, planCert(conf_, cert_.CertID))
+	}
+	for _, cert := range currentData.Certs {
+		if !configured_[cert.ConfID] {
+			items = append(items, PlanItem{ConfID: cert.ConfID, CommonName: cert.CommonName, CertID: cert.CertID,
+				Action: PlanAction.Skip, Reason: "no config for current cert"})
+		}
+	}
+	return
+}
+
+// planCert returns what would be done with the cert of config, certID is the current cert or empty if none.
+func planCert(conf *CertConf, certID string) (item PlanItem) {
+	logger_ := certLogger(conf)
+	item = PlanItem{ConfID: conf.ConfID, CommonName: conf.CommonName, CertID: certID}
+	if _, _, err := generateCSR(conf, logger_); err != nil {
+		item.Action, item.Reason = PlanAction.Fail, err.Error()
+		return
+	}
+	if issuance_ := pendingIssuance(conf.ConfID); issuance_ != nil {
+		defer func() {
+			if item.Action == PlanAction.Issue || item.Action == PlanAction.Renew {
+				item.Reason += fmt.Sprintf(", resuming pending cert %v at %v", issuance_.CertID, issuance_.Phase)
+			}
+		}()
+	}
+	if certID == "" {
+		item.Action, item.Reason = PlanAction.Issue, "no current cert"
+		return
+	}
+	certInfo_, err := newClient(conf).GetCert(certID)
+	if err != nil {
+		item.Action, item.Reason = PlanAction.Fail, fmt.Sprintf("getting cert info: %v", err)
+		return
+	}
+	due_, reason_ := renewalDue(&certInfo_)
+	item.Action, item.Reason = PlanAction.Skip, reason_
+	if due_ {
+		item.Action = PlanAction.Renew
+	}
+	return
+}
+
+// writePlan writes the plan as a table.
+func writePlan(w io.Writer, items []PlanItem) error {
+	tw_ := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw_, "CONF ID\tCOMMON NAME\tCERT ID\tACTION\tREASON")
+	for _, item := range items {
+		_, _ = fmt.Fprintf(tw_, "%v\t%v\t%v\t%v\t%v\n", item.ConfID, item.CommonName, item.CertID, item.Action,
+			item.Reason)
+	}
+	return tw_.Flush()
+}
+
+// dryRun writes what a run would do, returns false if anything would fail.
+func dryRun(w io.Writer, renewOnly bool) (ok bool) {
+	items_ := planCerts(renewOnly)
+	if err := writePlan(w, items_); err != nil {
+		slog.Error("Failed to write plan", "error", err)
+		return false
+	}
+	ok = true
+	for _, item := range items_ {
+		if item.Action == PlanAction.Fail {
+			ok = false
+		}
+	}
+	return
+}
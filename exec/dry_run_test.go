@@ -0,0 +1,95 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	zerosslIPCert "github.com/tinkernels/zerossl-ip-cert"
+)
+
+func Test_dryRun(t *testing.T) {
+	conf_, _ := setupIssueTest(t)
+	api_ := newFakeZeroSSL(t, testApiKey)
+	now_ := time.Now()
+	expiring_ := api_.addCert("192.0.2.2", zerosslIPCert.CertStatus.Issued, now_.AddDate(0, 0, -80),
+		now_.AddDate(0, 0, 10))
+	valid_ := api_.addCert("192.0.2.3", zerosslIPCert.CertStatus.Issued, now_, now_.AddDate(0, 0, 80))
+	newConf_ := func(confID, commonName string) CertConf {
+		c := *conf_
+		c.ConfID, c.CommonName = confID, commonName
+		return c
+	}
+	badSigAlg_ := newConf_("bad", "192.0.2.5")
+	badSigAlg_.SigAlg = "MD5-RSA"
+	usingConfig.CertConfigs = []CertConf{newConf_("new", "192.0.2.1"), newConf_("expiring", "192.0.2.2"),
+		newConf_("valid", "192.0.2.3"), newConf_("gone", "192.0.2.4"), badSigAlg_}
+	origCurrentData_ := currentData
+	t.Cleanup(func() { currentData = origCurrentData_ })
+	currentData = &CurrentData{Certs: []CurrentCertData{
+		{ConfID: "expiring", CommonName: "192.0.2.2", CertID: expiring_.ID},
+		{ConfID: "valid", CommonName: "192.0.2.3", CertID: valid_.ID},
+		{ConfID: "gone", CommonName: "192.0.2.4", CertID: "unknown"},
+		{ConfID: "orphan", CommonName: "192.0.2.9", CertID: "orphan1"},
+	}}
+
+	actions_ := func(items []PlanItem) (actions map[string]string) {
+		actions = make(map[string]string)
+		for _, item := range items {
+			actions[item.ConfID] = item.Action
+		}
+		return
+	}
+	want_ := map[string]string{
+		"new":      PlanAction.Issue,
+		"expiring": PlanAction.Renew,
+		"valid":    PlanAction.Skip,
+		"gone":     PlanAction.Fail,
+		"bad":      PlanAction.Fail,
+		"orphan":   PlanAction.Skip,
+	}
+	if got_ := actions_(planCerts(false)); !reflect.DeepEqual(got_, want_) {
+		t.Errorf("planCerts() = %v, want %v", got_, want_)
+	}
+	want_["new"] = PlanAction.Skip
+	want_["bad"] = PlanAction.Skip
+	if got_ := actions_(planCerts(true)); !reflect.DeepEqual(got_, want_) {
+		t.Errorf("planCerts(renewOnly) = %v, want %v", got_, want_)
+	}
+	for _, api := range api_.apiCalls() {
+		if api != zerosslIPCert.ApiName.GetCertificate && api != "not_found" {
+			t.Errorf("dry run called %v", api)
+		}
+	}
+
+	out_ := new(bytes.Buffer)
+	if dryRun(out_, false) {
+		t.Errorf("dryRun() should fail")
+	}
+	if !strings.Contains(out_.String(), "ACTION") || !strings.Contains(out_.String(), "no config for current cert") {
+		t.Errorf("unexpected output:\n%v", out_)
+	}
+	usingConfig.CertConfigs = usingConfig.CertConfigs[:3]
+	currentData.Certs = currentData.Certs[:2]
+	if !dryRun(new(bytes.Buffer), false) {
+		t.Errorf("dryRun() should succeed")
+	}
+}
@@ -0,0 +1,268 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	zerosslIPCert "github.com/tinkernels/zerossl-ip-cert"
+)
+
+// genTestCertPEM returns a self-signed certificate valid in [notBefore, notAfter] in pem format.
+func genTestCertPEM(t *testing.T, commonName string, notBefore, notAfter time.Time) []byte {
+	return genTestCertPEMOfKey(t, commonName, notBefore, notAfter, nil)
+}
+
+// genTestCertPEMOfKey returns a certificate of the public key valid in [notBefore, notAfter] in pem format,
+// which is self-signed if pub is nil.
+func genTestCertPEMOfKey(t *testing.T, commonName string, notBefore, notAfter time.Time, pub interface{}) []byte {
+	key_, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub == nil {
+		pub = &key_.PublicKey
+	}
+	template_ := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	if ip_ := net.ParseIP(commonName); ip_ != nil {
+		template_.IPAddresses = []net.IP{ip_}
+	}
+	der_, err := x509.CreateCertificate(rand.Reader, template_, template_, pub, key_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der_})
+}
+
+// fakeZeroSSL is an in-memory ZeroSSL API, installed as transport of the default http client.
+// Certificates are issued as soon as domains verification is requested.
+type fakeZeroSSL struct {
+	t      *testing.T
+	apiKey string
+
+	mu     sync.Mutex
+	certs  []*zerosslIPCert.CertificateInfoModel
+	nextID int
+	calls  []string
+	// csrs of created certs, downloaded certs are issued for public keys of them.
+	csrs map[string]*x509.CertificateRequest
+	// failApi makes calls of the api fail with a transport error.
+	failApi map[string]error
+}
+
+func newFakeZeroSSL(t *testing.T, apiKey string) *fakeZeroSSL {
+	f := &fakeZeroSSL{t: t, apiKey: apiKey, failApi: make(map[string]error),
+		csrs: make(map[string]*x509.CertificateRequest)}
+	orig_ := http.DefaultClient.Transport
+	http.DefaultClient.Transport = f
+	t.Cleanup(func() { http.DefaultClient.Transport = orig_ })
+	return f
+}
+
+// addCert adds a certificate in the status, expiring at expires.
+func (f *fakeZeroSSL) addCert(commonName, status string, created, expires time.Time) *zerosslIPCert.CertificateInfoModel {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.addCertLocked(commonName, status, created, expires)
+}
+
+func (f *fakeZeroSSL) addCertLocked(commonName, status string, created,
+	expires time.Time) *zerosslIPCert.CertificateInfoModel {
+	f.nextID++
+	id_ := fmt.Sprintf("fake%04d", f.nextID)
+	cert_ := &zerosslIPCert.CertificateInfoModel{
+		ID:         id_,
+		Type:       "1",
+		CommonName: commonName,
+		Created:    created.UTC().Truncate(time.Second),
+		Expires:    expires.UTC().Truncate(time.Second),
+		Status:     status,
+		Validation: zerosslIPCert.ValidationInfoModel{
+			OtherMethods: map[string]zerosslIPCert.OtherValidationInfoModel{
+				commonName: {
+					FileValidationUrlHttp: "http://" + commonName + "/.well-known/pki-validation/" + id_ + ".txt",
+					FileValidationContent: []string{id_, "comodoca.com", "fake"},
+				},
+			},
+		},
+	}
+	f.certs = append(f.certs, cert_)
+	return cert_
+}
+
+func (f *fakeZeroSSL) cert(id string) *zerosslIPCert.CertificateInfoModel {
+	for _, c := range f.certs {
+		if c.ID == id {
+			return c
+		}
+	}
+	return nil
+}
+
+// apiCalls returns names of the api called.
+func (f *fakeZeroSSL) apiCalls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+func (f *fakeZeroSSL) RoundTrip(req *http.Request) (*http.Response, error) {
+	rec_ := httptest.NewRecorder()
+	if req.URL.Host != zerosslIPCert.ApiEndpoint {
+		return nil, fmt.Errorf("unexpected host %v", req.URL.Host)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	api_ := f.serve(rec_, req)
+	f.calls = append(f.calls, api_)
+	if err, ok := f.failApi[api_]; ok {
+		return nil, err
+	}
+	return rec_.Result(), nil
+}
+
+func (f *fakeZeroSSL) serve(w *httptest.ResponseRecorder, req *http.Request) (api string) {
+	writeJson_ := func(v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(v)
+	}
+	if req.URL.Query().Get("access_key") != f.apiKey {
+		w.WriteHeader(http.StatusUnauthorized)
+		return "unauthorized"
+	}
+	parts_ := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(parts_) == 1 && req.Method == http.MethodPost {
+		_ = req.ParseForm()
+		now_ := time.Now()
+		days_, _ := strconv.Atoi(req.PostForm.Get("certificate_validity_days"))
+		cert_ := f.addCertLocked(req.PostForm.Get("certificate_domains"), zerosslIPCert.CertStatus.Draft, now_,
+			now_.AddDate(0, 0, days_))
+		if block_, _ := pem.Decode([]byte(req.PostForm.Get("certificate_csr"))); block_ != nil {
+			if csr_, err := x509.ParseCertificateRequest(block_.Bytes); err == nil {
+				f.csrs[cert_.ID] = csr_
+			}
+		}
+		writeJson_(cert_)
+		return zerosslIPCert.ApiName.CreateCertificate
+	}
+	if len(parts_) == 1 && req.Method == http.MethodGet {
+		q_ := req.URL.Query()
+		var results_ []zerosslIPCert.CertificateInfoModel
+		statuses_ := strings.Split(q_.Get("certificate_status"), ",")
+		for _, c := range f.certs {
+			if q_.Get("certificate_status") != "" && !containsString(statuses_, c.Status) {
+				continue
+			}
+			if q_.Get("search") != "" && !strings.Contains(c.CommonName, q_.Get("search")) {
+				continue
+			}
+			results_ = append(results_, *c)
+		}
+		limit_, _ := strconv.Atoi(q_.Get("limit"))
+		if limit_ <= 0 {
+			limit_ = 100
+		}
+		page_, _ := strconv.Atoi(q_.Get("page"))
+		if page_ <= 0 {
+			page_ = 1
+		}
+		total_ := len(results_)
+		start_, end_ := (page_-1)*limit_, page_*limit_
+		if start_ > total_ {
+			start_ = total_
+		}
+		if end_ > total_ {
+			end_ = total_
+		}
+		writeJson_(map[string]interface{}{
+			"total_count":  total_,
+			"result_count": end_ - start_,
+			"page":         strconv.Itoa(page_),
+			"limit":        limit_,
+			"results":      results_[start_:end_],
+		})
+		return zerosslIPCert.ApiName.ListCertificates
+	}
+	cert_ := f.cert(parts_[1])
+	if cert_ == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return "not_found"
+	}
+	switch {
+	case len(parts_) == 2:
+		writeJson_(cert_)
+		return zerosslIPCert.ApiName.GetCertificate
+	case parts_[2] == "challenges":
+		cert_.Status = zerosslIPCert.CertStatus.Issued
+		writeJson_(map[string]interface{}{"success": false})
+		return zerosslIPCert.ApiName.VerifyDomains
+	case parts_[2] == "status":
+		writeJson_(map[string]interface{}{"validation_completed": 1})
+		return zerosslIPCert.ApiName.VerificationStatus
+	case parts_[2] == "cancel":
+		cert_.Status = zerosslIPCert.CertStatus.Cancelled
+		writeJson_(map[string]interface{}{"success": 1})
+		return zerosslIPCert.ApiName.CancelCertificate
+	case parts_[2] == "revoke":
+		cert_.Status = zerosslIPCert.CertStatus.Revoked
+		writeJson_(map[string]interface{}{"success": 1})
+		return zerosslIPCert.ApiName.RevokeCertificate
+	case parts_[2] == "download":
+		created_, expires_ := cert_.Created, cert_.Expires
+		var pub_ interface{}
+		if csr_, ok := f.csrs[cert_.ID]; ok {
+			pub_ = csr_.PublicKey
+		}
+		writeJson_(zerosslIPCert.CertificateContentModel{
+			Certificate: string(genTestCertPEMOfKey(f.t, cert_.CommonName, created_, expires_, pub_)),
+			CaBundle:    string(genTestCertPEM(f.t, "Fake CA", created_, expires_)),
+		})
+		return zerosslIPCert.ApiName.DownloadCertificateInline
+	}
+	w.WriteHeader(http.StatusNotFound)
+	return "not_found"
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,149 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	zerosslIPCert "github.com/tinkernels/zerossl-ip-cert"
+	"gopkg.in/yaml.v3"
+)
+
+// HookCmd is a hook command, the first element is the executable and the rest are arguments.
+// In config file it can be either a single executable path or a list of command and arguments.
+type HookCmd []string
+
+// UnmarshalYAML accepts both scalar and sequence values.
+func (h *HookCmd) UnmarshalYAML(value *yaml.Node) (err error) {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		var cmd_ string
+		if err = value.Decode(&cmd_); err != nil {
+			return
+		}
+		if cmd_ == "" {
+			*h = nil
+			return
+		}
+		*h = HookCmd{cmd_}
+	case yaml.SequenceNode:
+		var cmd_ []string
+		if err = value.Decode(&cmd_); err != nil {
+			return
+		}
+		*h = cmd_
+	default:
+		return fmt.Errorf("line %d: hook must be a string or a list of strings", value.Line)
+	}
+	return
+}
+
+// IsSet reports whether the hook is configured.
+func (h HookCmd) IsSet() bool {
+	return len(h) > 0 && h[0] != ""
+}
+
+// String returns the hook command line.
+func (h HookCmd) String() string {
+	return strings.Join(h, " ")
+}
+
+// runHook runs hook command with extra env, unset hook is skipped.
+func runHook(name string, hook HookCmd, env []string, logger *slog.Logger) (err error) {
+	if !hook.IsSet() {
+		logger.Debug("Hook not set, skip", "hook", name)
+		return
+	}
+	logger.Info("Running hook", "hook", name, "command", hook.String())
+	cmd_ := exec.Command(hook[0], hook[1:]...)
+	cmd_.Env = append(os.Environ(), env...)
+	cmd_.Stdout = os.Stdout
+	cmd_.Stderr = os.Stdout
+	if err = cmd_.Run(); err != nil {
+		return fmt.Errorf("%v hook %v failed: %w", name, hook, err)
+	}
+	return
+}
+
+// runVerifyHook runs verify hook.
+func runVerifyHook(hook HookCmd, cerInfo *zerosslIPCert.CertificateInfoModel, logger *slog.Logger) (err error) {
+	var env_ []string
+	if hook.IsSet() {
+		if env_, err = httpFileValidationEnv(cerInfo); err != nil {
+			return
+		}
+	}
+	return runHook("verify", hook, env_, logger)
+}
+
+// runCleanupHook runs cleanup hook.
+func runCleanupHook(hook HookCmd, cerInfo *zerosslIPCert.CertificateInfoModel, logger *slog.Logger) (err error) {
+	var env_ []string
+	if hook.IsSet() {
+		if env_, err = httpFileValidationEnv(cerInfo); err != nil {
+			return
+		}
+	}
+	return runHook("cleanup", hook, env_, logger)
+}
+
+// runPostHook runs post hook.
+func runPostHook(certConf *CertConf, logger *slog.Logger) (err error) {
+	env_ := []string{
+		fmt.Sprintf("%v=%v", "ZEROSSL_CERT_FPATH", certConf.CertFile),
+		fmt.Sprintf("%v=%v", "ZEROSSL_KEY_FPATH", certConf.KeyFile),
+	}
+	return runHook("post", certConf.PostHook, env_, logger)
+}
+
+// httpFileValidationEnv returns hook env of http file validation info for the common name.
+func httpFileValidationEnv(cerInfo *zerosslIPCert.CertificateInfoModel) (env []string, err error) {
+	v, ok := cerInfo.Validation.OtherMethods[cerInfo.CommonName]
+	if !ok {
+		return nil, fmt.Errorf("no validation info for %v", cerInfo.CommonName)
+	}
+	validateHttpUrl_, err := url.Parse(v.FileValidationUrlHttp)
+	if err != nil {
+		return
+	}
+	host_ := validateHttpUrl_.Host
+	path_ := validateHttpUrl_.Path
+	port_ := validateHttpUrl_.Port()
+	if port_ == "" {
+		port_ = "80"
+	}
+	var content_ string
+	// Concatenate file content with spaces.
+	if runtime.GOOS == "windows" {
+		content_ = strings.Join(v.FileValidationContent, " ")
+	} else {
+		content_ = strings.Join(v.FileValidationContent, "\n")
+	}
+	env = []string{
+		fmt.Sprintf("%v=%v", "ZEROSSL_HTTP_FV_HOST", host_),
+		fmt.Sprintf("%v=%v", "ZEROSSL_HTTP_FV_PATH", path_),
+		fmt.Sprintf("%v=%v", "ZEROSSL_HTTP_FV_PORT", port_),
+		fmt.Sprintf("%v=%v", "ZEROSSL_HTTP_FV_CONTENT", content_),
+	}
+	return
+}
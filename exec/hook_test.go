@@ -0,0 +1,168 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/tinkernels/zerossl-ip-cert"
+	"gopkg.in/yaml.v3"
+)
+
+func Test_verifyHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell script hook")
+	}
+	certInfoTest_ := zerosslIPCert.CertificateInfoModel{
+		CommonName: "1.1.1.1",
+		Validation: zerosslIPCert.ValidationInfoModel{
+			OtherMethods: map[string]zerosslIPCert.OtherValidationInfoModel{
+				"1.1.1.1": {
+					FileValidationUrlHttp: "http://1.1.1.1/.well-known/pki-validation/715EE529C6FF317C938B79C7655710AC.txt",
+					FileValidationContent: []string{
+						"ABCDEF1234567890",
+						" comodoca.com",
+						"abcdef1234567890",
+					},
+				},
+			},
+		},
+	}
+	dir_ := t.TempDir()
+	out_ := filepath.Join(dir_, "out.txt")
+	content_ := filepath.Join(dir_, "content.txt")
+	hook_ := filepath.Join(dir_, "verify-hook.sh")
+	script_ := "#!/bin/sh\necho \"$1|$2|$ZEROSSL_HTTP_FV_HOST|$ZEROSSL_HTTP_FV_PORT|$ZEROSSL_HTTP_FV_PATH\" > " + out_ +
+		"\nprintf '%s' \"$ZEROSSL_HTTP_FV_CONTENT\" > " + content_ + "\n"
+	if err := os.WriteFile(hook_, []byte(script_), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := runVerifyHook(HookCmd{hook_, "nginx", "with space"}, &certInfoTest_, slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+	got_, err := os.ReadFile(out_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want_ := "nginx|with space|1.1.1.1|80|/.well-known/pki-validation/715EE529C6FF317C938B79C7655710AC.txt"
+	if strings.TrimSpace(string(got_)) != want_ {
+		t.Errorf("verify hook args and env: got %q, want %q", got_, want_)
+	}
+	if got_, err = os.ReadFile(content_); err != nil {
+		t.Fatal(err)
+	}
+	if string(got_) != "ABCDEF1234567890\n comodoca.com\nabcdef1234567890" {
+		t.Errorf("verify hook content: got %q", got_)
+	}
+}
+
+func Test_cleanupHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell script hook")
+	}
+	certInfoTest_ := zerosslIPCert.CertificateInfoModel{
+		CommonName: "1.1.1.1",
+		Validation: zerosslIPCert.ValidationInfoModel{
+			OtherMethods: map[string]zerosslIPCert.OtherValidationInfoModel{
+				"1.1.1.1": {
+					FileValidationUrlHttp: "http://1.1.1.1/.well-known/pki-validation/715EE529C6FF317C938B79C7655710AC.txt",
+					FileValidationContent: []string{"ABCDEF1234567890", "comodoca.com", "abcdef1234567890"},
+				},
+			},
+		},
+	}
+	// Unset cleanup hook is skipped.
+	if err := runCleanupHook(nil, &certInfoTest_, slog.Default()); err != nil {
+		t.Error(err)
+		return
+	}
+	dir_ := t.TempDir()
+	out_ := filepath.Join(dir_, "out.txt")
+	hook_ := filepath.Join(dir_, "cleanup-hook.sh")
+	script_ := "#!/bin/sh\necho \"$ZEROSSL_HTTP_FV_HOST $ZEROSSL_HTTP_FV_PORT $ZEROSSL_HTTP_FV_PATH\" > " + out_ + "\n"
+	if err := os.WriteFile(hook_, []byte(script_), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := runCleanupHook(HookCmd{hook_}, &certInfoTest_, slog.Default()); err != nil {
+		t.Error(err)
+		return
+	}
+	got_, err := os.ReadFile(out_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want_ := "1.1.1.1 80 /.well-known/pki-validation/715EE529C6FF317C938B79C7655710AC.txt"
+	if strings.TrimSpace(string(got_)) != want_ {
+		t.Errorf("cleanup hook env: got %q, want %q", got_, want_)
+	}
+}
+
+func TestHookCmd_UnmarshalYAML(t *testing.T) {
+	var conf_ struct {
+		Script  HookCmd `yaml:"script"`
+		Command HookCmd `yaml:"command"`
+		Empty   HookCmd `yaml:"empty"`
+	}
+	input_ := "script: /var/local/zerossl/post-hook.sh\ncommand: [systemctl, reload, nginx]\nempty: \"\"\n"
+	if err := yaml.Unmarshal([]byte(input_), &conf_); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(conf_.Script, HookCmd{"/var/local/zerossl/post-hook.sh"}) {
+		t.Errorf("script: got %#v", conf_.Script)
+	}
+	if !reflect.DeepEqual(conf_.Command, HookCmd{"systemctl", "reload", "nginx"}) {
+		t.Errorf("command: got %#v", conf_.Command)
+	}
+	if conf_.Empty.IsSet() {
+		t.Errorf("empty: got %#v", conf_.Empty)
+	}
+	if err := yaml.Unmarshal([]byte("script: {a: b}\n"), &conf_); err == nil {
+		t.Error("expect error for mapping hook")
+	}
+}
+
+func Test_runPostHookArgs(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell hook")
+	}
+	out_ := filepath.Join(t.TempDir(), "out.txt")
+	conf_ := &CertConf{
+		CertFile: "/tmp/cert.pem",
+		KeyFile:  "/tmp/key.pem",
+		PostHook: HookCmd{"sh", "-c", "echo \"$0 $ZEROSSL_CERT_FPATH\" > " + out_, "reloaded"},
+	}
+	if err := runPostHook(conf_, slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+	got_, err := os.ReadFile(out_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(got_)) != "reloaded /tmp/cert.pem" {
+		t.Errorf("post hook output: got %q", got_)
+	}
+	// Unset post hook is skipped.
+	if err = runPostHook(&CertConf{}, slog.Default()); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"time"
+
+	zerosslIPCert "github.com/tinkernels/zerossl-ip-cert"
+)
+
+// pendingIssuance returns a copy of the pending issuance of the cert config, nil if there is none.
+func pendingIssuance(confID string) *PendingIssuance {
+	currentDataMu.Lock()
+	defer currentDataMu.Unlock()
+	for _, p := range currentData.Pending {
+		if p.ConfID == confID {
+			return &p
+		}
+	}
+	return nil
+}
+
+// savePendingIssuance records the issuance in the current data file, replacing the one of the same cert config.
+func savePendingIssuance(issuance *PendingIssuance) error {
+	currentDataMu.Lock()
+	defer currentDataMu.Unlock()
+	for i, p := range currentData.Pending {
+		if p.ConfID == issuance.ConfID {
+			currentData.Pending[i] = *issuance
+			return saveCurrentData()
+		}
+	}
+	currentData.Pending = append(currentData.Pending, *issuance)
+	return saveCurrentData()
+}
+
+// removePendingIssuance removes the pending issuance of the cert config from the current data file.
+func removePendingIssuance(confID string) error {
+	currentDataMu.Lock()
+	defer currentDataMu.Unlock()
+	for i, p := range currentData.Pending {
+		if p.ConfID == confID {
+			currentData.Pending = append(currentData.Pending[:i], currentData.Pending[i+1:]...)
+			return saveCurrentData()
+		}
+	}
+	return nil
+}
+
+// setIssuancePhase records the phase of the issuance, failures are only logged as the issuance can go on.
+func setIssuancePhase(issuance *PendingIssuance, phase string, logger *slog.Logger) {
+	issuance.Phase = phase
+	if err := savePendingIssuance(issuance); err != nil {
+		logger.Warn("Failed to record issuance phase", "error", err)
+	}
+}
+
+// MaxIssuanceAttempts is the max number of attempts of a pending issuance not issued yet.
+const MaxIssuanceAttempts = 5
+
+// MaxIssuanceAge is the max age of a pending issuance not issued yet to be resumed.
+const MaxIssuanceAge = 7 * 24 * time.Hour
+
+// resumeIssuance returns the pending issuance of the cert config with its cert info if it can be resumed, i.e. the
+// private key is kept and the cert is not cancelled or expired. Pending issuances can't be resumed are abandoned,
+// certs not issued after MaxIssuanceAttempts attempts or MaxIssuanceAge are cancelled and abandoned, so cert
+// configs don't get stuck with certs never validated.
+func resumeIssuance(conf *CertConf, client *zerosslIPCert.Client, logger *slog.Logger) (
+	issuance *PendingIssuance, certInfo zerosslIPCert.CertificateInfoModel, err error) {
+	issuance = pendingIssuance(conf.ConfID)
+	if issuance == nil {
+		return
+	}
+	logger = logger.With("certId", issuance.CertID)
+	if !PathExists(issuance.KeyFile) {
+		logger.Warn("Abandoning pending issuance, private key not found", "keyFile", issuance.KeyFile)
+		return nil, certInfo, removeIssuance(issuance, logger)
+	}
+	if certInfo, err = client.GetCert(issuance.CertID); err != nil {
+		return nil, certInfo, fmt.Errorf("getting cert info of pending issuance: %w", err)
+	}
+	switch certInfo.Status {
+	case zerosslIPCert.CertStatus.Draft, zerosslIPCert.CertStatus.PendingValidation:
+		if issuance.Attempts >= MaxIssuanceAttempts || time.Since(issuance.Started) > MaxIssuanceAge {
+			logger.Warn("Cancelling and abandoning pending issuance not validated", "status", certInfo.Status,
+				"attempts", issuance.Attempts, "started", issuance.Started)
+			if cancelErr := client.CancelCert(issuance.CertID); cancelErr != nil {
+				logger.Warn("Failed to cancel cert of abandoned issuance", "error", cancelErr)
+			}
+			return nil, certInfo, removeIssuance(issuance, logger)
+		}
+		fallthrough
+	case zerosslIPCert.CertStatus.Issued:
+		issuance.Attempts++
+		logger.Info("Resuming pending issuance", "phase", issuance.Phase, "status", certInfo.Status,
+			"started", issuance.Started, "attempt", issuance.Attempts)
+		if err = savePendingIssuance(issuance); err != nil {
+			logger.Warn("Failed to record attempt of pending issuance", "error", err)
+			err = nil
+		}
+		return
+	}
+	logger.Warn("Abandoning pending issuance", "status", certInfo.Status)
+	return nil, certInfo, removeIssuance(issuance, logger)
+}
+
+// removeIssuance removes the record and the working dir of the issuance, when finished or abandoned.
+func removeIssuance(issuance *PendingIssuance, logger *slog.Logger) error {
+	removeWorkDir(issuance.WorkDir, logger)
+	if err := removePendingIssuance(issuance.ConfID); err != nil {
+		return fmt.Errorf("removing pending issuance: %w", err)
+	}
+	return nil
+}
+
+// startIssuance generates the private key and csr in a new working dir, creates the cert and records the issuance.
+// The working dir is removed if the cert is not created.
+func startIssuance(conf *CertConf, client *zerosslIPCert.Client, logger *slog.Logger) (
+	issuance *PendingIssuance, certInfo zerosslIPCert.CertificateInfoModel, err error) {
+	workDir_, err := newWorkDir(conf, logger)
+	if err != nil {
+		return nil, certInfo, fmt.Errorf("creating working dir: %w", err)
+	}
+	defer func() {
+		if issuance == nil {
+			removeWorkDir(workDir_, logger)
+		}
+	}()
+	keyFile_ := filepath.Join(workDir_, "privkey.pem")
+	privKey_, csrStr_, err := generateCSR(conf, logger)
+	if err != nil {
+		return
+	}
+	// Write PrivateKey to file.
+	logger.Debug("Writing private key", "path", keyFile_)
+	if err = zerosslIPCert.WritePrivKeyWrapper(conf.KeyType, privKey_, keyFile_); err != nil {
+		return nil, certInfo, fmt.Errorf("writing private key: %w", err)
+	}
+	// Create Cert.
+	logger = logger.With("phase", Phase.Create)
+	logger.Info("Creating cert")
+	certInfo, err = client.CreateCert(zerosslIPCert.CreateCertRequest{
+		Domains:       []string{conf.CommonName},
+		CSR:           []byte(csrStr_),
+		ValidityDays:  conf.Days,
+		StrictDomains: conf.StrictDomains == 1,
+	})
+	if err != nil {
+		return nil, certInfo, fmt.Errorf("creating cert: %w", err)
+	}
+	logger.Debug("Cert created", "certId", certInfo.ID, "status", certInfo.Status, "expires", certInfo.Expires)
+	issuance = &PendingIssuance{ConfID: conf.ConfID, CertID: certInfo.ID, Phase: Phase.Create, WorkDir: workDir_,
+		KeyFile: keyFile_, Started: time.Now().UTC(), Attempts: 1}
+	if err = saveCreatedCert(conf.ConfID, certInfo.ID); err != nil {
+		logger.Warn("Failed to record created cert", "certId", certInfo.ID, "error", err)
+	}
+	if err = savePendingIssuance(issuance); err != nil {
+		logger.Warn("Failed to record pending issuance, it can't be resumed", "certId", certInfo.ID, "error", err)
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	zerosslIPCert "github.com/tinkernels/zerossl-ip-cert"
+)
+
+// countCalls returns times of the api called.
+func countCalls(calls []string, api string) (n int) {
+	for _, call := range calls {
+		if call == api {
+			n++
+		}
+	}
+	return
+}
+
+func Test_issueCertImpl_resume(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		// status of the cert when resumed, crashed after created if empty
+		status     string
+		failApi    string
+		wantVerify int
+	}{
+		{name: "crashed after created", wantVerify: 1},
+		{name: "download failed", failApi: zerosslIPCert.ApiName.DownloadCertificateInline, wantVerify: 1},
+		{name: "issued", status: zerosslIPCert.CertStatus.Issued},
+		// Verification is requested again, validation may have failed.
+		{name: "pending validation", status: zerosslIPCert.CertStatus.PendingValidation, wantVerify: 1},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			conf_, _ := setupIssueTest(t)
+			api_ := newFakeZeroSSL(t, testApiKey)
+			var issuance_ *PendingIssuance
+			if c.failApi != "" {
+				api_.failApi[c.failApi] = errors.New("connection reset")
+				if _, err := issueCertImpl(conf_); err == nil {
+					t.Fatal("expected error")
+				}
+				delete(api_.failApi, c.failApi)
+				issuance_ = pendingIssuance(conf_.ConfID)
+			} else {
+				var err error
+				client_ := newClient(conf_)
+				if issuance_, _, err = startIssuance(conf_, client_, certLogger(conf_)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if issuance_ == nil || !PathExists(issuance_.KeyFile) {
+				t.Fatalf("pending issuance not recorded: %+v", issuance_)
+			}
+			// Recorded in current data file.
+			data_, err := stateStore.Load()
+			if err != nil || len(data_.Pending) != 1 || data_.Pending[0].CertID != issuance_.CertID ||
+				len(data_.Created) != 1 || data_.Created[0].CertID != issuance_.CertID {
+				t.Fatalf("unexpected current data %+v, error %v", data_, err)
+			}
+			if c.status != "" {
+				api_.cert(issuance_.CertID).Status = c.status
+			}
+			certID_, err := issueCertImpl(conf_)
+			if err != nil {
+				t.Fatal(err)
+			}
+			calls_ := api_.apiCalls()
+			if certID_ != issuance_.CertID || countCalls(calls_, zerosslIPCert.ApiName.CreateCertificate) != 1 ||
+				countCalls(calls_, zerosslIPCert.ApiName.VerifyDomains) != c.wantVerify {
+				t.Errorf("cert %v resumed as %v, api calls %v", issuance_.CertID, certID_, calls_)
+			}
+			// Issued with the key of the pending issuance.
+			if _, err = tls.LoadX509KeyPair(conf_.CertFile, conf_.KeyFile); err != nil {
+				t.Error(err)
+			}
+			if pendingIssuance(conf_.ConfID) != nil || PathExists(issuance_.WorkDir) {
+				t.Error("finished issuance not removed")
+			}
+		})
+	}
+}
+
+func Test_issueCertImpl_abandon(t *testing.T) {
+	conf_, _ := setupIssueTest(t)
+	api_ := newFakeZeroSSL(t, testApiKey)
+	issuance_, _, err := startIssuance(conf_, newClient(conf_), certLogger(conf_))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api_.cert(issuance_.CertID).Status = zerosslIPCert.CertStatus.Cancelled
+	certID_, err := issueCertImpl(conf_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certID_ == issuance_.CertID || countCalls(api_.apiCalls(), zerosslIPCert.ApiName.CreateCertificate) != 2 {
+		t.Errorf("cancelled cert %v resumed", certID_)
+	}
+	entries_, _ := os.ReadDir(filepath.Dir(issuance_.WorkDir))
+	if len(entries_) != 0 || pendingIssuance(conf_.ConfID) != nil {
+		t.Errorf("abandoned issuance not removed: %v", entries_)
+	}
+}
+
+func Test_issueCertImpl_abandonStuck(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		attempts int
+		started  time.Time
+	}{
+		{name: "too many attempts", attempts: MaxIssuanceAttempts, started: time.Now()},
+		{name: "too old", attempts: 1, started: time.Now().Add(-MaxIssuanceAge - time.Hour)},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			conf_, _ := setupIssueTest(t)
+			api_ := newFakeZeroSSL(t, testApiKey)
+			issuance_, _, err := startIssuance(conf_, newClient(conf_), certLogger(conf_))
+			if err != nil {
+				t.Fatal(err)
+			}
+			api_.cert(issuance_.CertID).Status = zerosslIPCert.CertStatus.PendingValidation
+			issuance_.Attempts, issuance_.Started = c.attempts, c.started
+			if err = savePendingIssuance(issuance_); err != nil {
+				t.Fatal(err)
+			}
+			certID_, err := issueCertImpl(conf_)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if certID_ == issuance_.CertID || api_.cert(issuance_.CertID).Status != zerosslIPCert.CertStatus.Cancelled {
+				t.Errorf("stuck cert %v not cancelled, issued %v", issuance_.CertID, certID_)
+			}
+		})
+	}
+}
+
+func Test_resumeIssuance_attempts(t *testing.T) {
+	conf_, _ := setupIssueTest(t)
+	api_ := newFakeZeroSSL(t, testApiKey)
+	client_ := newClient(conf_)
+	issuance_, _, err := startIssuance(conf_, client_, certLogger(conf_))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api_.cert(issuance_.CertID).Status = zerosslIPCert.CertStatus.PendingValidation
+	for want := 2; want <= MaxIssuanceAttempts; want++ {
+		if resumed_, _, err := resumeIssuance(conf_, client_, certLogger(conf_)); err != nil || resumed_ == nil {
+			t.Fatalf("not resumed, error %v", err)
+		}
+		if p := pendingIssuance(conf_.ConfID); p == nil || p.Attempts != want {
+			t.Fatalf("attempts %+v, want %v", p, want)
+		}
+	}
+	if resumed_, _, err := resumeIssuance(conf_, client_, certLogger(conf_)); err != nil || resumed_ != nil {
+		t.Errorf("resumed after %v attempts, error %v", MaxIssuanceAttempts, err)
+	}
+}
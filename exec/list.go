@@ -0,0 +1,166 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	zerosslIPCert "github.com/tinkernels/zerossl-ip-cert"
+)
+
+// ListFormat represents output formats of list command.
+var ListFormat = struct {
+	Table string
+	Json  string
+	Csv   string
+}{
+	Table: "table",
+	Json:  "json",
+	Csv:   "csv",
+}
+
+// ListItem is a cert in the ZeroSSL account, managed if it's a current cert of this config.
+type ListItem struct {
+	CertID     string    `json:"certId"`
+	CommonName string    `json:"commonName"`
+	Status     string    `json:"status"`
+	Created    time.Time `json:"created"`
+	Expires    time.Time `json:"expires"`
+	Managed    bool      `json:"managed"`
+	ConfID     string    `json:"confId,omitempty"`
+}
+
+// ListFilter filters certs to list, zero values don't filter.
+type ListFilter struct {
+	zerosslIPCert.CertsFilter
+	// Only certs expiring within the duration, expired ones included.
+	ExpiringWithin time.Duration
+}
+
+// listCerts returns certs of all pages matching the filter.
+func listCerts(ctx context.Context, client *zerosslIPCert.Client, filter ListFilter) (items []ListItem, err error) {
+	managed_ := make(map[string]string)
+	for _, cert := range currentData.Certs {
+		managed_[cert.CertID] = cert.ConfID
+	}
+	err = client.AllCerts(ctx, filter.CertsFilter, func(cert zerosslIPCert.CertificateInfoModel) error {
+		if filter.ExpiringWithin > 0 {
+			if cert.Expires.IsZero() || cert.Expires.After(time.Now().Add(filter.ExpiringWithin)) {
+				return nil
+			}
+		}
+		confID_, ok := managed_[cert.ID]
+		items = append(items, ListItem{CertID: cert.ID, CommonName: cert.CommonName, Status: cert.Status,
+			Created: cert.Created, Expires: cert.Expires, Managed: ok, ConfID: confID_})
+		return nil
+	})
+	return
+}
+
+// writeList writes certs in the format.
+func writeList(w io.Writer, items []ListItem, format string) (err error) {
+	switch format {
+	case ListFormat.Json:
+		enc_ := json.NewEncoder(w)
+		enc_.SetIndent("", "  ")
+		return enc_.Encode(items)
+	case ListFormat.Csv:
+		csv_ := csv.NewWriter(w)
+		_ = csv_.Write([]string{"certId", "commonName", "status", "created", "expires", "managed", "confId"})
+		for _, item := range items {
+			_ = csv_.Write([]string{item.CertID, item.CommonName, item.Status, listTime(item.Created),
+				listTime(item.Expires), strconv.FormatBool(item.Managed), item.ConfID})
+		}
+		csv_.Flush()
+		return csv_.Error()
+	default:
+		tw_ := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintln(tw_, "CERT ID\tCOMMON NAME\tSTATUS\tCREATED\tEXPIRES\tMANAGED")
+		for _, item := range items {
+			managed_ := "unknown"
+			if item.Managed {
+				managed_ = item.ConfID
+			}
+			_, _ = fmt.Fprintf(tw_, "%v\t%v\t%v\t%v\t%v\t%v\n", item.CertID, item.CommonName, item.Status,
+				listTime(item.Created), listTime(item.Expires), managed_)
+		}
+		return tw_.Flush()
+	}
+}
+
+func cmdList(name string, args []string) (code int) {
+	var config_ string
+	fs_ := newFlagSet(name, "list [ -conf-id ID ] [ -status STATUS,... ] [ -search TEXT ] [ -expiring-within DAYS ] "+
+		"[ -format table|json|csv ] -config CONFIG_FILE", &config_)
+	confID_ := fs_.String("conf-id", "", "Use api key of the cert config, the default api key by default")
+	status_ := fs_.String("status", "", "Comma separated statuses to list, all by default")
+	search_ := fs_.String("search", "", "Search text of common names")
+	expiringWithin_ := fs_.Int("expiring-within", 0, "Only certs expiring within the days, expired ones included")
+	format_ := fs_.String("format", ListFormat.Table, "Output format, table, json or csv")
+	if code, done := parseFlags(fs_, args); done {
+		return code
+	}
+	switch *format_ {
+	case ListFormat.Table, ListFormat.Json, ListFormat.Csv:
+	default:
+		_, _ = fmt.Fprintf(os.Stderr, "invalid format %q\n", *format_)
+		return ExitCode.Usage
+	}
+	if code = setup(config_, false, os.Stderr); code != ExitCode.OK {
+		return
+	}
+	client_, err := commandClient(*confID_)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		return ExitCode.Usage
+	}
+	filter_ := ListFilter{ExpiringWithin: time.Duration(*expiringWithin_) * 24 * time.Hour}
+	filter_.Search = *search_
+	if *status_ != "" {
+		for _, status := range strings.Split(*status_, ",") {
+			filter_.Statuses = append(filter_.Statuses, strings.TrimSpace(status))
+		}
+	}
+	items_, err := listCerts(context.Background(), client_, filter_)
+	if err != nil {
+		slog.Error("Failed to list certs", "error", err)
+		return ExitCode.Failure
+	}
+	if err = writeList(os.Stdout, items_, *format_); err != nil {
+		slog.Error("Failed to write output", "error", err)
+		return ExitCode.Failure
+	}
+	return ExitCode.OK
+}
+
+// listTime formats time in api format for table and csv, zero time is empty.
+func listTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(zerosslIPCert.TimeLayout)
+}
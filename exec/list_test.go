@@ -0,0 +1,86 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	zerosslIPCert "github.com/tinkernels/zerossl-ip-cert"
+)
+
+func Test_listCerts(t *testing.T) {
+	conf_, _ := setupIssueTest(t)
+	api_ := newFakeZeroSSL(t, testApiKey)
+	now_ := time.Now()
+	for i := 0; i < 250; i++ {
+		api_.addCert(fmt.Sprintf("192.0.2.%d", i), zerosslIPCert.CertStatus.Issued, now_, now_.AddDate(0, 0, 90))
+	}
+	expiring_ := api_.addCert("198.51.100.1", zerosslIPCert.CertStatus.ExpiringSoon, now_.AddDate(0, 0, -80),
+		now_.AddDate(0, 0, 10))
+	api_.addCert("198.51.100.2", zerosslIPCert.CertStatus.Draft, now_, now_.AddDate(0, 0, 90))
+	origCurrentData_ := currentData
+	t.Cleanup(func() { currentData = origCurrentData_ })
+	currentData = &CurrentData{Certs: []CurrentCertData{{ConfID: "managed", CertID: expiring_.ID}}}
+	client_ := newClient(conf_)
+
+	items_, err := listCerts(context.Background(), client_, ListFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items_) != 252 {
+		t.Errorf("listed %d certs", len(items_))
+	}
+	items_, err = listCerts(context.Background(), client_, ListFilter{CertsFilter: zerosslIPCert.CertsFilter{
+		Statuses: []string{zerosslIPCert.CertStatus.Issued, zerosslIPCert.CertStatus.ExpiringSoon},
+		Search:   "198.51.100",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items_) != 1 || !items_[0].Managed || items_[0].ConfID != "managed" {
+		t.Errorf("filtered %+v", items_)
+	}
+	items_, err = listCerts(context.Background(), client_, ListFilter{ExpiringWithin: 30 * 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items_) != 1 || items_[0].CertID != expiring_.ID {
+		t.Errorf("expiring %+v", items_)
+	}
+
+	out_ := new(bytes.Buffer)
+	if err = writeList(out_, items_, ListFormat.Csv); err != nil {
+		t.Fatal(err)
+	}
+	records_, err := csv.NewReader(out_).ReadAll()
+	if err != nil || len(records_) != 2 || records_[1][0] != expiring_.ID || records_[1][5] != "true" {
+		t.Errorf("csv %v, error %v", records_, err)
+	}
+	out_.Reset()
+	if err = writeList(out_, []ListItem{{CertID: "x"}}, ListFormat.Table); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out_.String(), "unknown") {
+		t.Errorf("table:\n%v", out_)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LockMode represents what to do when the data dir is locked by another process.
+var LockMode = struct {
+	Fail string
+	Wait string
+}{
+	Fail: "fail",
+	Wait: "wait",
+}
+
+// LockConf configures locking of the data dir.
+type LockConf struct {
+	// Mode is fail (default) or wait.
+	Mode string `yaml:"mode"`
+	// Timeout in seconds of waiting for the lock, 0 waits forever.
+	Timeout int `yaml:"timeout"`
+}
+
+// lockPollInterval is the interval of trying to lock again when waiting.
+var lockPollInterval = time.Second
+
+// errLocked is returned by tryLockFile when the file is locked by another process.
+var errLocked = errors.New("locked")
+
+// ErrDataDirLocked is returned when the data dir is locked by another process.
+var ErrDataDirLocked = errors.New("data dir is locked by another process")
+
+// DataDirLock is an advisory lock on the data dir held by this process, released when the process exits.
+type DataDirLock struct {
+	file *os.File
+}
+
+// dataDirLock is the lock held by the running command.
+var dataDirLock *DataDirLock
+
+// LockDataDir locks the data dir, so processes can't change current data and temp files at the same time.
+// When locked by another process, it fails or waits according to conf, errors name pid of the holder.
+func LockDataDir(dir string, conf LockConf) (lock *DataDirLock, err error) {
+	path_ := filepath.Join(dir, "lock")
+	file_, err := os.OpenFile(path_, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("opening lock file: %w", err)
+	}
+	var deadline_ time.Time
+	if conf.Timeout > 0 {
+		deadline_ = time.Now().Add(time.Duration(conf.Timeout) * time.Second)
+	}
+	for waiting_ := false; ; waiting_ = true {
+		if err = tryLockFile(file_); err == nil {
+			break
+		}
+		if !errors.Is(err, errLocked) {
+			_ = file_.Close()
+			return nil, fmt.Errorf("locking %v: %w", path_, err)
+		}
+		holder_ := lockHolder(file_)
+		if conf.Mode != LockMode.Wait || (!deadline_.IsZero() && time.Now().After(deadline_)) {
+			_ = file_.Close()
+			return nil, fmt.Errorf("%w: %v is held by pid %v", ErrDataDirLocked, path_, holder_)
+		}
+		if !waiting_ {
+			slog.Info("Waiting for lock of data dir", "path", path_, "holderPid", holder_)
+		}
+		time.Sleep(lockPollInterval)
+	}
+	// Recording pid of the holder.
+	if err = file_.Truncate(0); err == nil {
+		_, err = file_.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		_ = unlockFile(file_)
+		_ = file_.Close()
+		return nil, fmt.Errorf("writing lock file: %w", err)
+	}
+	return &DataDirLock{file: file_}, nil
+}
+
+// Unlock releases the lock.
+func (l *DataDirLock) Unlock() (err error) {
+	_ = l.file.Truncate(0)
+	err = unlockFile(l.file)
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return
+}
+
+// lockHolder returns pid in the lock file, or "unknown".
+func lockHolder(file *os.File) string {
+	buf_ := make([]byte, 32)
+	n, _ := file.ReadAt(buf_, 0)
+	if pid_ := strings.TrimSpace(string(buf_[:n])); pid_ != "" {
+		return pid_
+	}
+	return "unknown"
+}
+
+// unlockDataDir releases the lock of the running command if held.
+func unlockDataDir() {
+	if dataDirLock == nil {
+		return
+	}
+	if err := dataDirLock.Unlock(); err != nil {
+		slog.Warn("Failed to unlock data dir", "error", err)
+	}
+	dataDirLock = nil
+}
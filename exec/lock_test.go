@@ -0,0 +1,104 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockDataDir(t *testing.T) {
+	dir_ := t.TempDir()
+	origInterval_ := lockPollInterval
+	lockPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() { lockPollInterval = origInterval_ })
+	lock_, err := LockDataDir(dir_, LockConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LockDataDir(dir_, LockConf{Mode: LockMode.Fail})
+	if !errors.Is(err, ErrDataDirLocked) || !strings.Contains(err.Error(), "pid "+strconv.Itoa(os.Getpid())) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	start_ := time.Now()
+	if _, err = LockDataDir(dir_, LockConf{Mode: LockMode.Wait, Timeout: 1}); !errors.Is(err, ErrDataDirLocked) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if time.Since(start_) < time.Second {
+		t.Errorf("waited only %v", time.Since(start_))
+	}
+	// Waiting until unlocked.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		if err := lock_.Unlock(); err != nil {
+			t.Error(err)
+		}
+	}()
+	lock2_, err := LockDataDir(dir_, LockConf{Mode: LockMode.Wait})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = lock2_.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_runCli_locked(t *testing.T) {
+	configPath_ := setupCliTest(t)
+	newFakeZeroSSL(t, testApiKey)
+	if code, _ := runCliOutput(t, "check-config", "-config", configPath_); code != ExitCode.OK {
+		t.Fatalf("check-config exit code %d", code)
+	}
+	if err := CreateDirIfNotExists(usingConfig.DataDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	lock_, err := LockDataDir(usingConfig.DataDir, LockConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"issue"},
+		{"clean"},
+		{"cancel", "-cert-id", "cert-1"},
+		{"revoke", "-cert-id", "cert-1"},
+	} {
+		if code, _ := runCliOutput(t, append(args, "-config", configPath_)...); code != ExitCode.Locked {
+			t.Errorf("%v exit code %d", args, code)
+		}
+	}
+	// Dry run and read-only commands don't lock.
+	for _, args := range [][]string{{"issue", "-dry-run"}, {"clean", "-dry-run"}, {"status", "-offline"}, {"list"}} {
+		// Status fails for certs not issued yet, but not for the lock.
+		if code, _ := runCliOutput(t, append(args, "-config", configPath_)...); code == ExitCode.Locked {
+			t.Errorf("%v exit code %d", args, code)
+		}
+	}
+	if err = lock_.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := runCliOutput(t, "issue", "-config", configPath_); code != ExitCode.OK {
+		t.Errorf("issue exit code %d", code)
+	}
+	// Released after the command.
+	if code, _ := runCliOutput(t, "renew", "-config", configPath_); code != ExitCode.OK {
+		t.Errorf("renew exit code %d", code)
+	}
+}
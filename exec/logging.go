@@ -0,0 +1,77 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// LogFormat represents formats of log output.
+var LogFormat = struct {
+	Text string
+	Json string
+}{
+	Text: "text",
+	Json: "json",
+}
+
+// Phase represents phases of issuing a cert, used as the phase field in logs.
+var Phase = struct {
+	Prepare  string // generating key and csr
+	Create   string // creating cert
+	Verify   string // domain validation
+	Download string // downloading cert
+	Install  string // copying cert and key to destinations
+	Post     string // post hook and actions
+}{
+	Prepare:  "prepare",
+	Create:   "create",
+	Verify:   "verify",
+	Download: "download",
+	Install:  "install",
+	Post:     "post",
+}
+
+// NewLogger returns a logger writing to all writers with the level (debug, info, warn or error, info by default)
+// and format (text or json, text by default).
+func NewLogger(level, format string, writers ...io.Writer) (logger *slog.Logger, err error) {
+	var level_ slog.Level
+	if level != "" {
+		if err = level_.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("invalid log level %q", level)
+		}
+	}
+	opts_ := &slog.HandlerOptions{Level: level_, AddSource: level_ <= slog.LevelDebug}
+	wr_ := io.MultiWriter(writers...)
+	switch strings.ToLower(format) {
+	case "", LogFormat.Text:
+		logger = slog.New(slog.NewTextHandler(wr_, opts_))
+	case LogFormat.Json:
+		logger = slog.New(slog.NewJSONHandler(wr_, opts_))
+	default:
+		return nil, fmt.Errorf("invalid log format %q", format)
+	}
+	return
+}
+
+// certLogger returns the default logger with fields of the cert config.
+func certLogger(conf *CertConf) *slog.Logger {
+	return slog.With("confId", conf.ConfID, "commonName", conf.CommonName)
+}
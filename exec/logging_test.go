@@ -0,0 +1,53 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNewLogger(t *testing.T) {
+	buf_ := &bytes.Buffer{}
+	logger_, err := NewLogger("warn", LogFormat.Json, buf_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf_ := &CertConf{ConfID: "xx1", CommonName: "1.2.3.4"}
+	logger_.Info("dropped")
+	logger_.With("confId", conf_.ConfID, "phase", Phase.Verify).Warn("kept", "certId", "abc")
+	lines_ := strings.Split(strings.TrimSpace(buf_.String()), "\n")
+	if len(lines_) != 1 {
+		t.Fatalf("log lines: %q", lines_)
+	}
+	var record_ map[string]interface{}
+	if err = json.Unmarshal([]byte(lines_[0]), &record_); err != nil {
+		t.Fatal(err)
+	}
+	if record_["level"] != "WARN" || record_["msg"] != "kept" || record_["confId"] != "xx1" ||
+		record_["phase"] != "verify" || record_["certId"] != "abc" {
+		t.Errorf("log record: %v", record_)
+	}
+	if _, err = NewLogger("verbose", "", buf_); err == nil {
+		t.Error("expect invalid level error")
+	}
+	if _, err = NewLogger("", "xml", buf_); err == nil {
+		t.Error("expect invalid format error")
+	}
+}
@@ -17,18 +17,14 @@
 package main
 
 import (
+	"context"
 	"crypto/x509/pkix"
-	"flag"
 	"fmt"
-	"io"
-	"log"
-	"net/url"
+	"log/slog"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"runtime"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	zerosslIPCert "github.com/tinkernels/zerossl-ip-cert"
@@ -37,405 +33,523 @@ import (
 // Version is the version of this application.
 const Version = "v1.0.1"
 
-var (
-	renewFlag  = flag.Bool("renew", false, "Renew existing certs only")
-	configFlag = flag.String("config", "", "Config file")
-)
+// DefaultDaemonInterval is the default interval of checking certs in daemon mode.
+const DefaultDaemonInterval = 12 * time.Hour
 
 var usingConfig *Config
 var currentData *CurrentData
-var currentDataFilePath string
 
-func main() {
-	flag.Usage = func() {
-		w := flag.CommandLine.Output()
-		_, _ = fmt.Fprintf(w, "\nVersion: %v\n\nUsage: %v [ -renew ] -config CONFIG_FILE\n\n",
-			Version, filepath.Base(os.Args[0]))
-		flag.PrintDefaults()
-	}
+// currentDataMu guards currentData and its store when certs are issued in parallel.
+var currentDataMu sync.Mutex
 
-	flag.Parse()
+func main() {
+	os.Exit(runCli(os.Args[1:]))
+}
 
-	if !PathExists(*configFlag) {
-		flag.Usage()
-		panic("Config file not found")
+// loadCurrentData opens the state store configured and reads current data, or starts with empty current data if
+// nothing is stored yet. Current data of current.yaml is imported into empty kv stores.
+func loadCurrentData(readOnly bool) (err error) {
+	closeStateStore()
+	if stateStore, err = OpenStateStore(usingConfig.State, usingConfig.DataDir, readOnly); err != nil {
+		return
 	}
-	usingConfig_, err := ReadConfig(*configFlag)
-	if err != nil {
-		flag.Usage()
-		panic(err)
+	fileData_ := filepath.Join(usingConfig.DataDir, "current.yaml")
+	if imported_, err := importStateFile(stateStore, fileData_); err != nil {
+		return fmt.Errorf("importing %v into %v: %w", fileData_, stateStore, err)
+	} else if imported_ {
+		slog.Info("Imported current data", "path", fileData_, "store", stateStore)
 	}
-	usingConfig = usingConfig_
-	// Enable line numbers in logging.
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-	logFile_, err := os.OpenFile(usingConfig.LogFile, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0666)
+	currentData_, err := stateStore.Load()
 	if err != nil {
-		fmt.Println("log file create failed")
-		panic(err)
+		return fmt.Errorf("reading %v: %w", stateStore, err)
 	}
-	// Write log to both console and file.
-	multiLogWr_ := io.MultiWriter(os.Stdout, logFile_)
-	log.SetOutput(multiLogWr_)
-
-	log.Printf("Using config file: %v", *configFlag)
+	if currentData_ == nil {
+		slog.Info("No current data stored", "store", stateStore)
+		currentData = &CurrentData{}
+	} else {
+		currentData = currentData_
+	}
+	return
+}
 
-	err = CreateDirIfNotExists(usingConfig.DataDir, os.ModePerm)
-	if err != nil {
-		flag.Usage()
-		panic(err)
+// runOnce issues or renews certs, or pulls them from the leader when sharing certs, then updates metrics. The leader
+// lock is kept for the next run if keepLeader, or released.
+func runOnce(renewOnly, keepLeader bool) (err error) {
+	if certStorage != nil {
+		err = runShared(renewOnly, keepLeader)
+	} else if renewOnly {
+		err = renew()
+	} else {
+		err = issueCerts()
 	}
-	currentDataFilePath = filepath.Join(usingConfig.DataDir, "/current.yaml")
-	if PathExists(currentDataFilePath) {
-		currentData_, err := ReadCurrentData(currentDataFilePath)
-		if err != nil {
-			flag.Usage()
-			panic(err)
+	observeCurrentCerts()
+	if usingConfig.Metrics.Textfile != "" {
+		if err := metrics.WriteTextfile(usingConfig.Metrics.Textfile); err != nil {
+			slog.Error("Failed to write metrics textfile", "path", usingConfig.Metrics.Textfile, "error", err)
 		}
-		if currentData_ == nil {
-			currentData = &CurrentData{}
-		} else {
-			currentData = currentData_
-		}
-	} else {
-		log.Printf("Current Config File not found: %s", currentDataFilePath)
-		currentData = &CurrentData{}
 	}
-	if *renewFlag {
-		renew()
-	} else {
-		issueCerts()
+	return
+}
+
+// daemonInterval returns the interval of checking certs in daemon mode.
+func daemonInterval() time.Duration {
+	if usingConfig.DaemonInterval > 0 {
+		return time.Duration(usingConfig.DaemonInterval) * time.Minute
 	}
+	return DefaultDaemonInterval
 }
 
-// issueCerts issues certs referenced in the config file.
-func issueCerts() {
-	log.Printf("Issuing certs")
-	for _, c := range usingConfig.CertConfigs {
-		log.Printf("Issuing cert for domain: %v", c.CommonName)
-		err := issueCert(&c)
-		if err != nil {
-			log.Printf("Failed to issue cert for domain %v: %v\n", c.CommonName, err)
-		}
+// daemonWait waits for d between checks in daemon mode, returns the error of ctx if it's done first.
+var daemonWait = func(ctx context.Context, d time.Duration) error {
+	timer_ := time.NewTimer(d)
+	defer timer_.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer_.C:
+		return nil
 	}
 }
 
-// issueCert issues a cert for the given domain config.
-func issueCert(conf *CertConf) (err error) {
-	for _, cert := range currentData.Certs {
-		// Use ConfID to match.
-		if cert.ConfID == conf.ConfID {
-			log.Printf("Cert for domain %v already exists, try renew.\n", conf.CommonName)
-			err = renewCert(cert.CertID, conf)
+// runDaemon checks certs periodically until ctx is done, serving metrics meanwhile, as scraping metrics needs a
+// long-running process.
+func runDaemon(ctx context.Context, renewOnly bool) {
+	if usingConfig.Metrics.Listen != "" {
+		server_ := serveMetrics(usingConfig.Metrics.Listen)
+		defer func() { _ = server_.Close() }()
+	}
+	interval_ := daemonInterval()
+	for {
+		// Failures are logged and notified, retrying in next check.
+		_ = runOnce(renewOnly, true)
+		slog.Info("Next check", "in", interval_)
+		if err := daemonWait(ctx, interval_); err != nil {
+			slog.Info("Daemon stopped", "reason", err)
+			releaseLeading()
 			return
 		}
 	}
-	log.Printf("Cert for domain %v does not exist, try issue.\n", conf.CommonName)
-	client_ := &zerosslIPCert.Client{ApiKey: conf.ApiKey}
-	if usingConfig.CleanUnfinished {
-		if err := client_.CleanUnfinished(); err != nil {
-			log.Printf("Failed to clean unfinished issuing certificate: %v\n", err)
+}
+
+// newClient returns ZeroSSL client of the cert config.
+func newClient(conf *CertConf) *zerosslIPCert.Client {
+	return newApiClient(conf.ApiKey, certLogger(conf))
+}
+
+// newApiClient returns ZeroSSL client of the api key, rate limited with other clients of the api key.
+func newApiClient(apiKey Secret, logger *slog.Logger) *zerosslIPCert.Client {
+	return &zerosslIPCert.Client{
+		ApiKey:      apiKey.Value(),
+		OnApiCall:   metrics.ObserveApiCall,
+		Logger:      logger,
+		RateLimiter: apiRateLimiter(apiKey),
+	}
+}
+
+// issueCerts issues certs referenced in the config file in parallel, returns errors of all failed certs.
+func issueCerts() error {
+	slog.Info("Issuing certs", "concurrency", concurrency())
+	var confs_ []*CertConf
+	for i := range usingConfig.CertConfigs {
+		confs_ = append(confs_, &usingConfig.CertConfigs[i])
+	}
+	return forEachCert(confs_, func(conf *CertConf) error {
+		if err := keepLeading(); err != nil {
+			return fmt.Errorf("%v: %w", conf.ConfID, err)
+		}
+		if err := issueCert(conf); err != nil {
+			certLogger(conf).Error("Failed to issue cert", "error", err)
+			return fmt.Errorf("%v: %w", conf.ConfID, err)
 		}
+		return nil
+	})
+}
+
+// issueCert issues a cert for the given domain config.
+func issueCert(conf *CertConf) (err error) {
+	logger_ := certLogger(conf)
+	// Use ConfID to match.
+	if certID_, err := currentCertID(conf.ConfID); err == nil {
+		logger_.Info("Cert already exists, try renew", "certId", certID_)
+		return renewCert(certID_, conf)
+	}
+	logger_.Info("Cert does not exist, try issue")
+	client_ := newClient(conf)
+	if usingConfig.CleanUnfinished {
+		cleanUnfinishedOf(conf, client_, logger_)
 	}
+	start_ := time.Now()
 	certId_, err := issueCertImpl(conf)
-	if err == nil {
-		log.Printf("Cert for domain %v issued successfully.\n", conf.CommonName)
-		currentData.Certs = append(currentData.Certs, CurrentCertData{
-			CommonName: conf.CommonName,
-			CertID:     certId_,
-			CertFile:   conf.CertFile,
-			KeyFile:    conf.KeyFile,
-			ConfID:     conf.ConfID,
-		})
-		if err = WriteCurrentData(currentDataFilePath, currentData); err != nil {
-			log.Printf("Failed to write current data: %v\n", err)
-		}
+	metrics.ObserveAttempt(conf, start_, err)
+	if err != nil {
+		event_ := newNotifyEvent(NotifyEventType.Failed, conf, "", err)
+		event_.Operation = NotifyOperation.Issue
+		notify(usingConfig.Notifiers, event_)
+		return
 	}
+	logger_.Info("Cert issued successfully", "certId", certId_, "duration", time.Since(start_))
+	notify(usingConfig.Notifiers, newNotifyEvent(NotifyEventType.Issued, conf, certId_, nil))
+	saveCertRecord(conf, "", certId_, logger_)
 	return
 }
 
+// issueCertImpl issues the cert, or resumes the pending issuance of the cert config. The issuance is recorded in
+// current data once the cert is created, and kept for resuming in the next run if it fails afterwards.
 func issueCertImpl(conf *CertConf) (certID string, err error) {
-	tempDir_ := filepath.Join(usingConfig.DataDir, "/temp")
-	tempPrivKeyPath_ := filepath.Join(tempDir_, "/privkey.pem")
-	log.Printf("tempPrivKeyPath: %v\n", tempPrivKeyPath_)
-	tempCertPath_ := filepath.Join(tempDir_, "/cert-fullchain.pem")
-	log.Printf("tempCertPath: %v\n", tempCertPath_)
-	log.Printf("Cleaning temp dir: %v\n", tempDir_)
-	if err = os.RemoveAll(tempDir_); err != nil {
+	logger_ := certLogger(conf).With("phase", Phase.Prepare)
+	client_ := newClient(conf)
+	issuance_, certInfo_, err := resumeIssuance(conf, client_, logger_)
+	if err != nil {
 		return
 	}
-	log.Printf("Creating temp dir: %v\n", tempDir_)
-	if err = CreateDirIfNotExists(tempDir_, os.ModePerm); err != nil {
-		return
+	if issuance_ == nil {
+		if issuance_, certInfo_, err = startIssuance(conf, client_, logger_); err != nil {
+			return
+		}
 	}
-	client_ := &zerosslIPCert.Client{ApiKey: conf.ApiKey}
-	// Generate PrivateKey.
-	log.Printf("Generating private key for %v\n", conf.CommonName)
-	privKey_ := zerosslIPCert.KeyGeneratorWrapper(conf.KeyType, conf.KeyBits, conf.KeyCurve)
-	subj_ := pkix.Name{
-		Country:            []string{conf.Country},
-		Province:           []string{conf.Province},
-		Locality:           []string{conf.Locality},
-		Organization:       []string{conf.Organization},
-		OrganizationalUnit: []string{conf.OrganizationUnit},
-		CommonName:         conf.CommonName,
+	logger_ = logger_.With("certId", certInfo_.ID)
+	defer func() {
+		if err != nil {
+			logger_.Warn("Issuance is kept for resuming in the next run", "phase", issuance_.Phase)
+			return
+		}
+		// No private key is left in the working dir.
+		if err := removeIssuance(issuance_, logger_); err != nil {
+			logger_.Warn("Failed to remove finished issuance", "error", err)
+		}
+	}()
+	// Validation phase, skipped if issued already.
+	if certInfo_.Status != zerosslIPCert.CertStatus.Issued {
+		setIssuancePhase(issuance_, Phase.Verify, logger_)
+		// Domains verification is requested again when resumed, as validation of the last attempt may have failed.
+		err = validateCert(client_, conf, &certInfo_, logger_.With("phase", Phase.Verify))
+		if err != nil {
+			return "", fmt.Errorf("validating cert %v: %w", certInfo_.ID, err)
+		}
 	}
-	// Generate CSR.
-	log.Printf("Generating CSR for %v\n", conf.CommonName)
-	csr_, err := zerosslIPCert.CSRGeneratorWrapper(conf.KeyType, subj_, privKey_, conf.SigAlg)
+	// Download cert.
+	setIssuancePhase(issuance_, Phase.Download, logger_)
+	logger_ = logger_.With("phase", Phase.Download)
+	logger_.Info("Downloading cert")
+	cert_, err := client_.DownloadCertInline(certInfo_.ID, true)
 	if err != nil {
-		log.Println(err)
-		return
+		return "", fmt.Errorf("downloading cert %v: %w", certInfo_.ID, err)
 	}
-	csrStr_ := zerosslIPCert.GetCSRString(csr_)
-	log.Printf("CSR for %v: %v\n", conf.CommonName, csrStr_)
-	if csrStr_ == "" {
-		log.Println("failed to get csr string")
-		return
+	logger_.Debug("Cert downloaded", "certificate", cert_.Certificate, "caBundle", cert_.CaBundle)
+	fullChainPem_ := fullChainPem(&cert_)
+	// Write cert to file.
+	tempCertPath_ := filepath.Join(issuance_.WorkDir, "cert-fullchain.pem")
+	if err = os.WriteFile(tempCertPath_, []byte(fullChainPem_), 0600); err != nil {
+		return "", fmt.Errorf("writing cert: %w", err)
 	}
-	// Write PrivateKey to file.
-	log.Printf("Writing private key to file %v\n", tempPrivKeyPath_)
-	if err = zerosslIPCert.WritePrivKeyWrapper(conf.KeyType, privKey_, tempPrivKeyPath_); err != nil {
-		log.Println(err)
-		return
+	// Copy cert files to dest.
+	setIssuancePhase(issuance_, Phase.Install, logger_)
+	logger_ = logger_.With("phase", Phase.Install)
+	logger_.Info("Installing cert", "certFile", conf.CertFile, "keyFile", conf.KeyFile)
+	if err = CopyFile(tempCertPath_, conf.CertFile, 0644); err != nil {
+		return "", fmt.Errorf("installing cert: %w", err)
 	}
-	// Create Cert.
-	log.Printf("Creating cert for %v\n", conf.CommonName)
-	certInfo_, err := client_.CreateCert(conf.CommonName, csrStr_, strconv.Itoa(conf.Days),
-		strconv.Itoa(conf.StrictDomains))
-	if err != nil {
-		log.Println(err)
+	if err = CopyFile(issuance_.KeyFile, conf.KeyFile, 0600); err != nil {
+		return "", fmt.Errorf("installing key: %w", err)
+	}
+	// Run post hook.
+	setIssuancePhase(issuance_, Phase.Post, logger_)
+	logger_ = logger_.With("phase", Phase.Post)
+	if err = runPostHook(conf, logger_); err != nil {
 		return
 	}
-	log.Printf("cert info: %+v\n", certInfo_)
-	if err = runVerifyHook(conf.VerifyHook, &certInfo_); err != nil {
-		log.Println(err)
+	// Run built-in post actions.
+	if err = runPostActions(conf, certInfo_.ID, logger_); err != nil {
 		return
 	}
-	// Verify Domains.
-	if err = verifyHttpCsrHash(client_, &certInfo_); err != nil {
-		log.Printf("verifying error: %v\n", err)
+	certID = certInfo_.ID
+	return
+}
+
+// StaleWorkDirAge is the age of working dirs left by crashed attempts, which are removed in the next attempt.
+const StaleWorkDirAge = 24 * time.Hour
+
+// newWorkDir creates a working dir only accessible by the owner under temp dir of data dir, unique for each
+// attempt of issuing the cert. Stale working dirs of the cert are removed.
+func newWorkDir(conf *CertConf, logger *slog.Logger) (dir string, err error) {
+	tempDir_ := filepath.Join(usingConfig.DataDir, "/temp")
+	if err = os.MkdirAll(tempDir_, 0700); err != nil {
 		return
 	}
-	// Download cert.
-	cert_, err := client_.DownloadCertInline(certInfo_.ID, "1")
+	prefix_ := safeFileName(conf.ConfID) + "-"
+	entries_, err := os.ReadDir(tempDir_)
 	if err != nil {
-		log.Println(err)
 		return
 	}
-	log.Printf("cert + ca: %+v\n", cert_)
-	fullChainPem_ := fmt.Sprintf("%s\n%s\n", strings.TrimSpace(cert_.Certificate), strings.TrimSpace(cert_.CaBundle))
-	// Write cert to file.
-	file_, err := os.Create(tempCertPath_)
+	for _, entry := range entries_ {
+		// Random part of names of working dirs is digits, not matching working dirs of confIds with the prefix.
+		suffix_, ok := strings.CutPrefix(entry.Name(), prefix_)
+		if !ok || !entry.IsDir() || strings.Trim(suffix_, "0123456789") != "" {
+			continue
+		}
+		if info_, err := entry.Info(); err == nil && time.Since(info_.ModTime()) > StaleWorkDirAge {
+			removeWorkDir(filepath.Join(tempDir_, entry.Name()), logger)
+		}
+	}
+	return os.MkdirTemp(tempDir_, prefix_)
+}
+
+// removeWorkDir shreds files in the working dir and removes it, failures are only logged.
+func removeWorkDir(dir string, logger *slog.Logger) {
+	logger.Debug("Removing working dir", "path", dir)
+	entries_, err := os.ReadDir(dir)
 	if err != nil {
-		log.Println(err)
-		return
+		logger.Warn("Failed to read working dir", "path", dir, "error", err)
+	}
+	for _, entry := range entries_ {
+		if entry.Type().IsRegular() {
+			if err = shredFile(filepath.Join(dir, entry.Name())); err != nil {
+				logger.Warn("Failed to shred file", "path", filepath.Join(dir, entry.Name()), "error", err)
+			}
+		}
+	}
+	if err = os.RemoveAll(dir); err != nil {
+		logger.Warn("Failed to remove working dir", "path", dir, "error", err)
+	}
+}
+
+// generateCSR generates a private key and the CSR in pem format.
+func generateCSR(conf *CertConf, logger *slog.Logger) (privKey interface{}, csr string, err error) {
+	// Generate PrivateKey.
+	logger.Info("Generating private key", "keyType", conf.KeyType)
+	privKey = zerosslIPCert.KeyGeneratorWrapper(conf.KeyType, conf.KeyBits, conf.KeyCurve)
+	if privKey == nil {
+		return nil, "", fmt.Errorf("generating private key: invalid key type %q", conf.KeyType)
+	}
+	subj_ := pkix.Name{
+		Country:            []string{conf.Country},
+		Province:           []string{conf.Province},
+		Locality:           []string{conf.Locality},
+		Organization:       []string{conf.Organization},
+		OrganizationalUnit: []string{conf.OrganizationUnit},
+		CommonName:         conf.CommonName,
 	}
-	_, err = file_.WriteString(fullChainPem_)
+	// Generate CSR.
+	logger.Info("Generating CSR", "sigAlg", conf.SigAlg)
+	csr_, err := zerosslIPCert.CSRGeneratorWrapper(conf.KeyType, subj_, privKey, conf.SigAlg)
 	if err != nil {
-		return
+		return nil, "", fmt.Errorf("generating csr: %w", err)
 	}
-	// Copy cert files to dest.
-	if err = CopyFile(tempCertPath_, conf.CertFile, os.ModePerm); err != nil {
-		log.Println(err)
+	csr = zerosslIPCert.GetCSRString(csr_)
+	if csr == "" {
+		return nil, "", fmt.Errorf("failed to get csr string")
+	}
+	logger.Debug("CSR generated", "csr", csr)
+	return
+}
+
+// fullChainPem returns the certificate followed by the ca bundle.
+func fullChainPem(cert *zerosslIPCert.CertificateContentModel) string {
+	return fmt.Sprintf("%s\n%s\n", strings.TrimSpace(cert.Certificate), strings.TrimSpace(cert.CaBundle))
+}
+
+// validateCert starts the verify responder, runs the verify hook and verifies domains, the cleanup hook and stopping
+// the responder are always run afterwards.
+func validateCert(client *zerosslIPCert.Client, conf *CertConf, certInfo *zerosslIPCert.CertificateInfoModel,
+	logger *slog.Logger) (err error) {
+	defer func() {
+		if err := runCleanupHook(conf.CleanupHook, certInfo, logger); err != nil {
+			logger.Warn("Cleanup hook failed", "error", err)
+		}
+	}()
+	stopResponder_, err := startVerifyResponder(&conf.VerifyResponder, certInfo, logger)
+	if err != nil {
 		return
 	}
-	if err = CopyFile(tempPrivKeyPath_, conf.KeyFile, os.ModePerm); err != nil {
-		log.Println(err)
+	if stopResponder_ != nil {
+		defer stopResponder_()
+	}
+	if err = runVerifyHook(conf.VerifyHook, certInfo, logger); err != nil {
 		return
 	}
-	// Run post hook.
-	if err = runPostHook(conf); err != nil {
-		log.Println(err)
+	// Verify Domains.
+	if err = verifyHttpCsrHash(client, certInfo, logger); err != nil {
 		return
 	}
-	// Clean temp files.
-	log.Printf("Cleaning temp files\n")
-	_ = os.RemoveAll(tempDir_)
-	certID = certInfo_.ID
 	return
 }
 
-func verifyHttpCsrHash(client *zerosslIPCert.Client, certInfo *zerosslIPCert.CertificateInfoModel) (err error) {
+func verifyHttpCsrHash(client *zerosslIPCert.Client, certInfo *zerosslIPCert.CertificateInfoModel,
+	logger *slog.Logger) (err error) {
 	for retrying_ := 0; retrying_ < 20; retrying_++ {
 		verifyRsp_, err := client.VerifyDomains(certInfo.ID, zerosslIPCert.VerifyDomainsMethod.HttpCsrHash, "")
 		if err != nil {
-			log.Printf("verify error: %v\n", err)
+			logger.Warn("Verifying domains failed, retrying", "error", err, "retry", retrying_)
 			time.Sleep(time.Second * 15)
 			continue
 		}
 		// NOTICE: ZeroSSL always return "Success:false" in HttpCsrHash verification.
-		log.Printf("domains verification result: %+v\n", verifyRsp_)
+		logger.Debug("Domains verification result", "success", verifyRsp_.Success,
+			"errorType", verifyRsp_.Error.Type)
 		certInfoTmp_, err := client.GetCert(certInfo.ID)
 		if err != nil {
-			log.Printf("get cert error: %v\n", err)
+			logger.Warn("Getting cert failed, retrying", "error", err, "retry", retrying_)
 			time.Sleep(time.Second * 15)
 			continue
 		}
 		if certInfoTmp_.Status != zerosslIPCert.CertStatus.PendingValidation &&
 			certInfoTmp_.Status != zerosslIPCert.CertStatus.Issued {
-			log.Printf("cert in %v status\n", certInfoTmp_.Status)
+			logger.Info("Waiting for validation", "status", certInfoTmp_.Status, "retry", retrying_)
 			time.Sleep(time.Second * 30)
 			continue
 		}
 		break
 	}
 	// Wait for cert to be ready.
-	if err = waitCert2BReady(client, certInfo); err != nil {
+	if err = waitCert2BReady(client, certInfo, logger); err != nil {
 		return err
 	}
 	return
 }
 
-// runVerifyHook runs verify hook.
-func runVerifyHook(executable string, cerInfo *zerosslIPCert.CertificateInfoModel) (err error) {
-	if !PathExists(executable) {
-		return fmt.Errorf("verify hook executable %v not exists", executable)
-	}
-	log.Println("try make verify hook file executable")
-	err = ChmodPlusX(executable)
-	if err != nil {
-		log.Printf("chmod verify hook file permission failed: %v\n", err)
-	}
-	for k, v := range cerInfo.Validation.OtherMethods {
-		if k == cerInfo.CommonName {
-			validateHttpUrl_, err := url.Parse(v.FileValidationUrlHttp)
-			if err != nil {
-				log.Println(err)
-				return err
-			}
-			host_ := validateHttpUrl_.Host
-			path_ := validateHttpUrl_.Path
-			port_ := validateHttpUrl_.Port()
-			if port_ == "" {
-				port_ = "80"
-			}
-			var content_ string
-			// Concatenate file content with spaces.
-			if runtime.GOOS == "windows" {
-				content_ = strings.Join(v.FileValidationContent, " ")
-			} else {
-				content_ = strings.Join(v.FileValidationContent, "\n")
-			}
-			// Prepare hook exec env.
-			cmdEnv_ := os.Environ()
-			cmdEnv_ = append(cmdEnv_, fmt.Sprintf("%v=%v", "ZEROSSL_HTTP_FV_HOST", host_))
-			cmdEnv_ = append(cmdEnv_, fmt.Sprintf("%v=%v", "ZEROSSL_HTTP_FV_PATH", path_))
-			cmdEnv_ = append(cmdEnv_, fmt.Sprintf("%v=%v", "ZEROSSL_HTTP_FV_PORT", port_))
-			cmdEnv_ = append(cmdEnv_, fmt.Sprintf("%v=%v", "ZEROSSL_HTTP_FV_CONTENT", content_))
-			cmd_ := exec.Command(executable)
-			cmd_.Env = cmdEnv_
-			cmd_.Stdout = os.Stdout
-			cmd_.Stderr = os.Stdout
-			if err = cmd_.Run(); err != nil {
-				return err
-			}
-			return err
-		}
-	}
-	return
-}
-
 // waitCert2BReady waits for the cert to be ready.
-func waitCert2BReady(client *zerosslIPCert.Client, certInfo *zerosslIPCert.CertificateInfoModel) (err error) {
+func waitCert2BReady(client *zerosslIPCert.Client, certInfo *zerosslIPCert.CertificateInfoModel,
+	logger *slog.Logger) (err error) {
 	for i := 0; i < 10; i++ {
 		// loop every other seconds until cert is ready.
 		certInfo_, err := client.GetCert(certInfo.ID)
 		if err != nil {
-			log.Println(err)
 			return err
 		}
 		if certInfo_.Status == zerosslIPCert.CertStatus.Issued {
-			log.Printf("cert is ready: %+v\n", certInfo_)
+			logger.Info("Cert is ready", "expires", certInfo_.Expires)
 			return nil
 		}
+		logger.Debug("Waiting for cert to be ready", "status", certInfo_.Status)
 		time.Sleep(time.Second * 30)
 	}
 	return fmt.Errorf("timeout of waiting cert to be ready")
 }
 
-func runPostHook(certConf *CertConf) (err error) {
-	if !PathExists(certConf.PostHook) {
-		return fmt.Errorf("post hook executable %v not exists", certConf.PostHook)
-	}
-	log.Println("try make post hook file executable")
-	err = ChmodPlusX(certConf.PostHook)
-	if err != nil {
-		log.Printf("chmod +x post hook file failed: %v\n", err)
-	}
-	// Prepare hook exec env.
-	cmdEnv_ := os.Environ()
-	cmdEnv_ = append(cmdEnv_, fmt.Sprintf("%v=%v", "ZEROSSL_CERT_FPATH", certConf.CertFile))
-	cmdEnv_ = append(cmdEnv_, fmt.Sprintf("%v=%v", "ZEROSSL_KEY_FPATH", certConf.KeyFile))
-	cmd_ := exec.Command(certConf.PostHook)
-	cmd_.Env = cmdEnv_
-	cmd_.Stdout = os.Stdout
-	cmd_.Stderr = os.Stdout
-	if err = cmd_.Run(); err != nil {
-		return err
-	}
-	return
-}
-
-// renew current certs.
-func renew() {
-	log.Println("will renew current certs")
+// renew current certs in parallel.
+func renew() error {
+	slog.Info("Renewing current certs", "concurrency", concurrency())
+	var confs_ []*CertConf
+	certIDs_ := make(map[*CertConf]string)
 loopRenew:
 	for _, cert := range currentData.Certs {
-		log.Printf("try renew cert: %v\n", cert.CommonName)
-		for _, c := range usingConfig.CertConfigs {
+		for i := range usingConfig.CertConfigs {
 			// ConfID to match cert config.
-			if c.ConfID == cert.ConfID {
-				err := renewCert(cert.CertID, &c)
-				if err != nil {
-					log.Printf("Failed to renew cert for domain %v: %v\n", c.CommonName, err)
-				}
+			if c := &usingConfig.CertConfigs[i]; c.ConfID == cert.ConfID {
+				confs_ = append(confs_, c)
+				certIDs_[c] = cert.CertID
 				continue loopRenew
 			}
 		}
-		log.Printf("no config for renewing cert: %v\n", cert.CommonName)
+		slog.Warn("No config for renewing cert", "confId", cert.ConfID, "commonName", cert.CommonName,
+			"certId", cert.CertID)
 	}
+	return forEachCert(confs_, func(conf *CertConf) error {
+		if err := keepLeading(); err != nil {
+			return fmt.Errorf("%v: %w", conf.ConfID, err)
+		}
+		if err := renewCert(certIDs_[conf], conf); err != nil {
+			certLogger(conf).Error("Failed to renew cert", "certId", certIDs_[conf], "error", err)
+			return fmt.Errorf("%v: %w", conf.ConfID, err)
+		}
+		return nil
+	})
 }
 
 func renewCert(id string, conf *CertConf) (err error) {
-	log.Printf("Renewing cert %v with config: %v\n", conf.CommonName, conf.ConfID)
-	client_ := &zerosslIPCert.Client{ApiKey: conf.ApiKey}
+	logger_ := certLogger(conf).With("certId", id)
+	logger_.Info("Renewing cert")
+	client_ := newClient(conf)
 	certInfo_, err := client_.GetCert(id)
 	if err != nil {
-		log.Printf("Failed to get cert info: %v\n", err)
-		return err
+		err = fmt.Errorf("getting cert info: %w", err)
+		notifyRenewFailed(conf, id, time.Time{}, err)
+		saveRenewalFailure(id, err, logger_)
+		return
 	}
-	expireTime_, err := time.Parse("2006-01-02 15:04:05", certInfo_.Expires)
-	if err != nil {
-		log.Printf("Failed to convert expiring time: %v\n", err)
-	} else {
-		if certInfo_.Status != zerosslIPCert.CertStatus.ExpiringSoon &&
-			time.Now().Add(time.Hour*24*29).Before(expireTime_) {
-			log.Printf("Cert %v is not due for renewal, skip renewing.\n", conf.CommonName)
-			return nil
-		}
+	due_, reason_ := renewalDue(&certInfo_)
+	if !due_ {
+		logger_.Info("Cert is not due for renewal, skip renewing", "reason", reason_)
+		return nil
 	}
+	logger_.Info("Cert is due for renewal", "reason", reason_)
 	if usingConfig.CleanUnfinished {
-		if err := client_.CleanUnfinished(); err != nil {
-			log.Printf("Failed to clean unfinished issuing certificate: %v\n", err)
-		}
+		cleanUnfinishedOf(conf, client_, logger_)
 	}
+	start_ := time.Now()
 	certId_, err := issueCertImpl(conf)
-	if err == nil {
-		log.Printf("Cert for domain %v issued successfully.\n", conf.CommonName)
-		for i, c := range currentData.Certs {
-			// Use original cert ID to match cert.
-			if c.CertID == id {
-				currentData.Certs[i].ConfID = conf.ConfID
-				currentData.Certs[i].CommonName = conf.CommonName
-				currentData.Certs[i].CertID = certId_
-				currentData.Certs[i].CertFile = conf.CertFile
-				currentData.Certs[i].KeyFile = conf.KeyFile
-				break
-			}
-		}
-		if err = WriteCurrentData(currentDataFilePath, currentData); err != nil {
-			log.Printf("Failed to write current data: %v\n", err)
-		}
+	metrics.ObserveAttempt(conf, start_, err)
+	if err != nil {
+		notifyRenewFailed(conf, id, certInfo_.Expires, err)
+		saveRenewalFailure(id, err, logger_)
+		return
 	}
+	logger_.Info("Cert renewed successfully", "newCertId", certId_, "duration", time.Since(start_))
+	notify(usingConfig.Notifiers, newNotifyEvent(NotifyEventType.Renewed, conf, certId_, nil))
+	saveCertRecord(conf, id, certId_, logger_)
 	return
 }
+
+// RenewBeforeDays is the number of days before expiry when certs are renewed.
+const RenewBeforeDays = 29
+
+// renewalDue returns whether the cert is due for renewal and why.
+// Certs expiring soon, expired, revoked or cancelled, and certs with unparsable expiring time are renewed.
+func renewalDue(certInfo *zerosslIPCert.CertificateInfoModel) (due bool, reason string) {
+	switch certInfo.Status {
+	case zerosslIPCert.CertStatus.ExpiringSoon, zerosslIPCert.CertStatus.Expired, zerosslIPCert.CertStatus.Revoked,
+		zerosslIPCert.CertStatus.Cancelled:
+		return true, fmt.Sprintf("status is %v", certInfo.Status)
+	}
+	if certInfo.Expires.IsZero() {
+		return true, "expiring time unknown"
+	}
+	expires_ := certInfo.Expires.Format(zerosslIPCert.TimeLayout)
+	daysLeft_ := int(time.Until(certInfo.Expires).Hours() / 24)
+	if time.Now().Add(time.Hour * 24 * RenewBeforeDays).Before(certInfo.Expires) {
+		return false, fmt.Sprintf("expires at %v, %d days left", expires_, daysLeft_)
+	}
+	return true, fmt.Sprintf("expires at %v, %d days left, less than %d", expires_, daysLeft_, RenewBeforeDays)
+}
+
+// notifyRenewFailed sends failed event, and expiring event if the current cert expires soon. If expires is unknown,
+// e.g. the cert info can't be got, expiry of the installed cert is used.
+func notifyRenewFailed(conf *CertConf, certID string, expires time.Time, err error) {
+	event_ := newNotifyEvent(NotifyEventType.Failed, conf, certID, err)
+	event_.Operation = NotifyOperation.Renew
+	notify(usingConfig.Notifiers, event_)
+	if expires.IsZero() {
+		expires = installedCertExpires(conf, certID)
+	}
+	if expires.IsZero() {
+		return
+	}
+	expiringDays_ := usingConfig.NotifyExpiringDays
+	if expiringDays_ <= 0 {
+		expiringDays_ = DefaultNotifyExpiringDays
+	}
+	daysLeft_ := int(time.Until(expires).Hours() / 24)
+	if daysLeft_ < expiringDays_ {
+		event_ = newNotifyEvent(NotifyEventType.Expiring, conf, certID, err)
+		event_.Operation = NotifyOperation.Renew
+		event_.Expires = expires.Format(zerosslIPCert.TimeLayout)
+		event_.DaysLeft = daysLeft_
+		notify(usingConfig.Notifiers, event_)
+	}
+}
+
+// installedCertExpires returns expiry of the cert file of the cert config, or recorded in current data for the cert
+// if the file can't be read, zero if unknown.
+func installedCertExpires(conf *CertConf, certID string) time.Time {
+	if cert_, err := readCertFile(conf.CertFile); err == nil {
+		return cert_.NotAfter
+	}
+	currentDataMu.Lock()
+	defer currentDataMu.Unlock()
+	for _, cert := range currentData.Certs {
+		if cert.ConfID == conf.ConfID && cert.CertID == certID {
+			return cert.Expires
+		}
+	}
+	return time.Time{}
+}
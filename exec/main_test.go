@@ -17,29 +17,211 @@
 package main
 
 import (
-	"github.com/tinkernels/zerossl-ip-cert"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
+
+	zerosslIPCert "github.com/tinkernels/zerossl-ip-cert"
 )
 
-func Test_verifyHook(t *testing.T) {
-	certInfoTest_ := zerosslIPCert.CertificateInfoModel{
-		CommonName: "1.1.1.1",
-		Validation: zerosslIPCert.ValidationInfoModel{
-			OtherMethods: map[string]zerosslIPCert.OtherValidationInfoModel{
-				"1.1.1.1": {
-					FileValidationUrlHttp: "http://1.1.1.1/.well-known/pki-validation/715EE529C6FF317C938B79C7655710AC.txt",
-					FileValidationContent: []string{
-						"ABCDEF1234567890",
-						" comodoca.com",
-						"abcdef1234567890",
-					},
-				},
-			},
-		},
-	}
-	err := runVerifyHook("/Users/donjohnny/forge/sources/zerossl-ip-cert/exec/sample-nginx-verify-hook.sh", &certInfoTest_)
+func Test_newWorkDir(t *testing.T) {
+	conf_, _ := setupIssueTest(t)
+	tempDir_ := filepath.Join(usingConfig.DataDir, "temp")
+	dir1_, err := newWorkDir(conf_, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir2_, err := newWorkDir(conf_, slog.Default())
 	if err != nil {
+		t.Fatal(err)
+	}
+	if dir1_ == dir2_ || filepath.Dir(dir1_) != tempDir_ {
+		t.Errorf("unexpected working dirs %v, %v", dir1_, dir2_)
+	}
+	if info_, err := os.Stat(dir1_); err != nil {
 		t.Error(err)
-		return
+	} else if runtime.GOOS != "windows" && info_.Mode().Perm() != 0700 {
+		t.Errorf("working dir mode %v", info_.Mode().Perm())
+	}
+	// Stale working dir of the cert is removed, others are kept.
+	stale_ := dir1_
+	otherConf_ := filepath.Join(tempDir_, conf_.ConfID+"-other-123")
+	if err = os.Mkdir(otherConf_, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filepath.Join(stale_, "privkey.pem"), []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old_ := time.Now().Add(-StaleWorkDirAge - time.Hour)
+	for _, dir := range []string{stale_, otherConf_} {
+		if err = os.Chtimes(dir, old_, old_); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err = newWorkDir(conf_, slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+	if PathExists(stale_) {
+		t.Error("stale working dir not removed")
+	}
+	if !PathExists(dir2_) || !PathExists(otherConf_) {
+		t.Error("working dirs removed")
+	}
+}
+
+func Test_issueCertImpl_workDir(t *testing.T) {
+	conf_, _ := setupIssueTest(t)
+	api_ := newFakeZeroSSL(t, testApiKey)
+	tempDir_ := filepath.Join(usingConfig.DataDir, "temp")
+	assertEmpty_ := func() {
+		t.Helper()
+		entries_, err := os.ReadDir(tempDir_)
+		if err != nil || len(entries_) != 0 {
+			t.Errorf("temp dir not empty: %v, error %v", entries_, err)
+		}
+	}
+	// Failed before the cert is created, nothing to resume.
+	api_.failApi[zerosslIPCert.ApiName.CreateCertificate] = errors.New("connection reset")
+	if _, err := issueCertImpl(conf_); err == nil {
+		t.Fatal("expected error")
+	}
+	assertEmpty_()
+	delete(api_.failApi, zerosslIPCert.ApiName.CreateCertificate)
+	if _, err := issueCertImpl(conf_); err != nil {
+		t.Fatal(err)
+	}
+	assertEmpty_()
+	if info_, err := os.Stat(conf_.KeyFile); err != nil {
+		t.Error(err)
+	} else if runtime.GOOS != "windows" && info_.Mode().Perm() != 0600 {
+		t.Errorf("key file mode %v", info_.Mode().Perm())
+	}
+}
+
+func Test_runCli_daemon(t *testing.T) {
+	configPath_ := setupCliTest(t)
+	newFakeZeroSSL(t, testApiKey)
+	listener_, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listen_ := listener_.Addr().String()
+	_ = listener_.Close()
+	config_, err := os.ReadFile(configPath_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config_ = append(config_, "daemonInterval: 5\nmetrics:\n  listen: "+listen_+"\n"...)
+	if err = os.WriteFile(configPath_, config_, 0600); err != nil {
+		t.Fatal(err)
+	}
+	origWait_ := daemonWait
+	t.Cleanup(func() { daemonWait = origWait_ })
+	// The default client is faking ZeroSSL.
+	scraper_ := &http.Client{Transport: &http.Transport{}}
+	var waits_ []time.Duration
+	var scraped_ string
+	daemonWait = func(ctx context.Context, d time.Duration) error {
+		if waits_ = append(waits_, d); len(waits_) < 2 {
+			return nil
+		}
+		// Metrics are served while the daemon runs.
+		for i := 0; i < 50 && scraped_ == ""; i++ {
+			if resp_, err := scraper_.Get("http://" + listen_ + "/metrics"); err == nil {
+				body_, _ := io.ReadAll(resp_.Body)
+				_ = resp_.Body.Close()
+				scraped_ = string(body_)
+			} else {
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+		return context.Canceled
+	}
+
+	if code, _ := runCliOutput(t, "issue", "-daemon", "-config", configPath_); code != ExitCode.OK {
+		t.Fatalf("daemon exit code %d", code)
+	}
+	if len(waits_) != 2 || waits_[0] != 5*time.Minute || waits_[1] != 5*time.Minute {
+		t.Errorf("waits %v", waits_)
+	}
+	if len(currentData.Certs) != 2 {
+		t.Errorf("current data %+v", currentData.Certs)
+	}
+	if !strings.Contains(scraped_, `zerossl_cert_expiry_timestamp_seconds{conf_id="c1",common_name="192.0.2.1"}`) {
+		t.Errorf("scraped metrics:\n%s", scraped_)
+	}
+	// The lock is released and metrics server closed once stopped.
+	if code, _ := runCliOutput(t, "renew", "-config", configPath_); code != ExitCode.OK {
+		t.Errorf("renew exit code %d", code)
+	}
+	if _, err = scraper_.Get("http://" + listen_ + "/metrics"); err == nil {
+		t.Error("metrics still served after stopping")
+	}
+}
+
+func Test_daemonWait(t *testing.T) {
+	if err := daemonWait(context.Background(), time.Millisecond); err != nil {
+		t.Error(err)
+	}
+	ctx_, cancel_ := context.WithCancel(context.Background())
+	cancel_()
+	if err := daemonWait(ctx_, time.Hour); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got %v", err)
+	}
+}
+
+func Test_notifyRenewFailed_expires(t *testing.T) {
+	conf_, _ := setupIssueTest(t)
+	var events_ []NotifyEvent
+	srv_ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event_ NotifyEvent
+		_ = json.NewDecoder(r.Body).Decode(&event_)
+		events_ = append(events_, event_)
+	}))
+	defer srv_.Close()
+	usingConfig.Notifiers = []NotifierConf{{Type: NotifierType.Webhook, Url: srv_.URL}}
+	in_ := func(days int) time.Time { return time.Now().Add(time.Duration(days)*24*time.Hour + time.Hour) }
+	for _, c := range []struct {
+		name                                string
+		expires, fileExpires, recordExpires time.Time
+		wantDaysLeft                        int // -1 without expiring event
+	}{
+		{name: "cert info", expires: in_(3), fileExpires: in_(60), wantDaysLeft: 3},
+		{name: "cert file", fileExpires: in_(5), recordExpires: in_(60), wantDaysLeft: 5},
+		{name: "current data", recordExpires: in_(7), wantDaysLeft: 7},
+		{name: "not expiring", fileExpires: in_(60), wantDaysLeft: -1},
+		{name: "unknown", wantDaysLeft: -1},
+	} {
+		events_ = nil
+		_ = os.Remove(conf_.CertFile)
+		if !c.fileExpires.IsZero() {
+			writeTestCert(t, conf_.CertFile, conf_.CommonName, time.Now(), c.fileExpires)
+		}
+		currentData.Certs = []CurrentCertData{{ConfID: conf_.ConfID, CertID: "abc", Expires: c.recordExpires}}
+		notifyRenewFailed(conf_, "abc", c.expires, errors.New("boom"))
+		if len(events_) == 0 || events_[0].Type != NotifyEventType.Failed ||
+			events_[0].Operation != NotifyOperation.Renew {
+			t.Fatalf("%v: events %+v", c.name, events_)
+		}
+		if c.wantDaysLeft < 0 {
+			if len(events_) != 1 {
+				t.Errorf("%v: unexpected events %+v", c.name, events_[1:])
+			}
+			continue
+		}
+		if len(events_) != 2 || events_[1].Type != NotifyEventType.Expiring || events_[1].DaysLeft != c.wantDaysLeft {
+			t.Errorf("%v: events %+v", c.name, events_)
+		}
 	}
 }
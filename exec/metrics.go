@@ -0,0 +1,257 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type MetricsConf struct {
+	// Listen address to serve /metrics in daemon mode, e.g. 127.0.0.1:9810.
+	Listen string `yaml:"listen"`
+	// Textfile for node_exporter textfile collector, written after each run.
+	Textfile string `yaml:"textfile"`
+}
+
+// Metrics collects certificate and api call metrics, exposed in prometheus text format.
+type Metrics struct {
+	mu        sync.Mutex
+	certs     map[string]*certMetrics
+	apiCalls  map[apiCallKey]int
+	apiErrors map[apiCallKey]int
+}
+
+type certMetrics struct {
+	commonName    string
+	expiry        time.Time
+	lastSuccess   time.Time
+	lastAttempt   time.Time
+	lastSucceeded bool
+	issueDuration time.Duration
+}
+
+type apiCallKey struct {
+	api  string
+	code int
+}
+
+// metrics is the metrics of this process.
+var metrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		certs:     make(map[string]*certMetrics),
+		apiCalls:  make(map[apiCallKey]int),
+		apiErrors: make(map[apiCallKey]int),
+	}
+}
+
+// ObserveApiCall counts an api call, it's used as zerosslIPCert.Client.OnApiCall.
+func (m *Metrics) ObserveApiCall(api string, statusCode int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key_ := apiCallKey{api: api, code: statusCode}
+	m.apiCalls[key_]++
+	if err != nil {
+		m.apiErrors[key_]++
+	}
+}
+
+func (m *Metrics) cert(confID, commonName string) *certMetrics {
+	c, ok := m.certs[confID]
+	if !ok {
+		c = &certMetrics{}
+		m.certs[confID] = c
+	}
+	c.commonName = commonName
+	return c
+}
+
+// ObserveAttempt records result and duration of an issuance attempt.
+func (m *Metrics) ObserveAttempt(conf *CertConf, start time.Time, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.cert(conf.ConfID, conf.CommonName)
+	c.lastAttempt = start
+	c.lastSucceeded = err == nil
+	if err == nil {
+		c.lastSuccess = time.Now()
+		c.issueDuration = c.lastSuccess.Sub(start)
+	}
+}
+
+// ObserveCertFile records expiry of the certificate file, and its issuing time as last success if unknown.
+func (m *Metrics) ObserveCertFile(confID, commonName, certFile string) (err error) {
+	cert_, err := readCertFile(certFile)
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.cert(confID, commonName)
+	c.expiry = cert_.NotAfter
+	if c.lastSuccess.IsZero() {
+		c.lastSuccess = cert_.NotBefore
+	}
+	return
+}
+
+// WriteTo writes metrics in prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (n int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	buf_ := &bytes.Buffer{}
+	confIDs_ := make([]string, 0, len(m.certs))
+	for k := range m.certs {
+		confIDs_ = append(confIDs_, k)
+	}
+	sort.Strings(confIDs_)
+	certGauge_ := func(name, help string, value func(c *certMetrics) (float64, bool)) {
+		_, _ = fmt.Fprintf(buf_, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+		for _, id := range confIDs_ {
+			c := m.certs[id]
+			if v, ok := value(c); ok {
+				_, _ = fmt.Fprintf(buf_, "%s{conf_id=\"%s\",common_name=\"%s\"} %s\n", name, escapeLabel(id),
+					escapeLabel(c.commonName), strconv.FormatFloat(v, 'f', -1, 64))
+			}
+		}
+	}
+	timestamp_ := func(t time.Time) (float64, bool) {
+		return float64(t.Unix()), !t.IsZero()
+	}
+	certGauge_("zerossl_cert_expiry_timestamp_seconds", "Expiry time of the installed certificate.",
+		func(c *certMetrics) (float64, bool) { return timestamp_(c.expiry) })
+	certGauge_("zerossl_cert_last_success_timestamp_seconds", "Time of the last successful issuance or renewal.",
+		func(c *certMetrics) (float64, bool) { return timestamp_(c.lastSuccess) })
+	certGauge_("zerossl_cert_last_attempt_timestamp_seconds", "Time of the last issuance or renewal attempt.",
+		func(c *certMetrics) (float64, bool) { return timestamp_(c.lastAttempt) })
+	certGauge_("zerossl_cert_last_attempt_success", "Whether the last issuance or renewal attempt succeeded.",
+		func(c *certMetrics) (float64, bool) {
+			if c.lastSucceeded {
+				return 1, !c.lastAttempt.IsZero()
+			}
+			return 0, !c.lastAttempt.IsZero()
+		})
+	certGauge_("zerossl_cert_issue_duration_seconds", "Duration of the last successful issuance or renewal.",
+		func(c *certMetrics) (float64, bool) { return c.issueDuration.Seconds(), c.issueDuration > 0 })
+	apiCounter_ := func(name, help string, counts map[apiCallKey]int) {
+		_, _ = fmt.Fprintf(buf_, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+		keys_ := make([]apiCallKey, 0, len(counts))
+		for k := range counts {
+			keys_ = append(keys_, k)
+		}
+		sort.Slice(keys_, func(i, j int) bool {
+			if keys_[i].api != keys_[j].api {
+				return keys_[i].api < keys_[j].api
+			}
+			return keys_[i].code < keys_[j].code
+		})
+		for _, k := range keys_ {
+			_, _ = fmt.Fprintf(buf_, "%s{api=\"%s\",code=\"%d\"} %d\n", name, escapeLabel(k.api), k.code, counts[k])
+		}
+	}
+	apiCounter_("zerossl_api_calls_total", "ZeroSSL API calls by api and status code, code 0 means no response.",
+		m.apiCalls)
+	apiCounter_("zerossl_api_errors_total", "Failed ZeroSSL API calls by api and status code.", m.apiErrors)
+	return buf_.WriteTo(w)
+}
+
+// ServeHTTP serves metrics.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if _, err := m.WriteTo(w); err != nil {
+		slog.Warn("Failed to write metrics", "error", err)
+	}
+}
+
+// WriteTextfile writes metrics to the file atomically, as textfile collector may read it anytime.
+func (m *Metrics) WriteTextfile(path string) (err error) {
+	tmp_, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmp_.Name())
+		}
+	}()
+	if _, err = m.WriteTo(tmp_); err != nil {
+		_ = tmp_.Close()
+		return
+	}
+	if err = tmp_.Close(); err != nil {
+		return
+	}
+	if err = os.Chmod(tmp_.Name(), 0644); err != nil {
+		return
+	}
+	return os.Rename(tmp_.Name(), path)
+}
+
+// serveMetrics serves /metrics on the listen address in background until the returned server is closed.
+func serveMetrics(listen string) *http.Server {
+	mux_ := http.NewServeMux()
+	mux_.Handle("/metrics", metrics)
+	server_ := &http.Server{Addr: listen, Handler: mux_}
+	go func() {
+		slog.Info("Serving metrics", "address", listen, "path", "/metrics")
+		if err := server_.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Failed to serve metrics", "error", err)
+		}
+	}()
+	return server_
+}
+
+// observeCurrentCerts records expiry of certificate files in current data.
+func observeCurrentCerts() {
+	for _, c := range currentData.Certs {
+		if err := metrics.ObserveCertFile(c.ConfID, c.CommonName, c.CertFile); err != nil {
+			slog.Warn("Failed to read cert file", "confId", c.ConfID, "path", c.CertFile, "error", err)
+		}
+	}
+}
+
+// readCertFile returns the first certificate in the pem file.
+func readCertFile(certFile string) (cert *x509.Certificate, err error) {
+	content_, err := os.ReadFile(certFile)
+	if err != nil {
+		return
+	}
+	block_, _ := pem.Decode(content_)
+	if block_ == nil || block_.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in %v", certFile)
+	}
+	return x509.ParseCertificate(block_.Bytes)
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
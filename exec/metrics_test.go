@@ -0,0 +1,80 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self-signed certificate valid in [notBefore, notAfter] to the file.
+func writeTestCert(t *testing.T, path, commonName string, notBefore, notAfter time.Time) {
+	if err := os.WriteFile(path, genTestCertPEM(t, commonName, notBefore, notAfter), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	m.ObserveApiCall("get_certificate", 200, nil)
+	m.ObserveApiCall("get_certificate", 200, nil)
+	m.ObserveApiCall("create_certificate", 0, errors.New("dial tcp"))
+	conf_ := &CertConf{ConfID: "xx1", CommonName: "1.2.3.4"}
+	m.ObserveAttempt(conf_, time.Now().Add(-time.Minute), nil)
+	m.ObserveAttempt(&CertConf{ConfID: "xx2", CommonName: "4.3.2.1"}, time.Now(), errors.New("boom"))
+	notAfter_ := time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second)
+	certFile_ := filepath.Join(t.TempDir(), "cert.pem")
+	writeTestCert(t, certFile_, "1.2.3.4", time.Now(), notAfter_)
+	if err := m.ObserveCertFile("xx1", "1.2.3.4", certFile_); err != nil {
+		t.Fatal(err)
+	}
+	rec_ := httptest.NewRecorder()
+	m.ServeHTTP(rec_, httptest.NewRequest("GET", "/metrics", nil))
+	out_ := rec_.Body.String()
+	for _, want := range []string{
+		`zerossl_cert_expiry_timestamp_seconds{conf_id="xx1",common_name="1.2.3.4"} ` +
+			strconv.FormatInt(notAfter_.Unix(), 10),
+		`zerossl_cert_last_attempt_success{conf_id="xx1",common_name="1.2.3.4"} 1`,
+		`zerossl_cert_last_attempt_success{conf_id="xx2",common_name="4.3.2.1"} 0`,
+		`zerossl_api_calls_total{api="get_certificate",code="200"} 2`,
+		`zerossl_api_errors_total{api="create_certificate",code="0"} 1`,
+	} {
+		if !strings.Contains(out_, want) {
+			t.Errorf("missing %q in:\n%s", want, out_)
+		}
+	}
+	if strings.Contains(out_, `zerossl_cert_issue_duration_seconds{conf_id="xx2"`) {
+		t.Error("failed attempt should not have issue duration")
+	}
+	textfile_ := filepath.Join(t.TempDir(), "zerossl.prom")
+	if err := m.WriteTextfile(textfile_); err != nil {
+		t.Fatal(err)
+	}
+	written_, err := os.ReadFile(textfile_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written_) != out_ {
+		t.Error("textfile differs from served metrics")
+	}
+}
@@ -0,0 +1,335 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NotifyEventType represents events sent to notifiers.
+var NotifyEventType = struct {
+	Issued   string // new certificate issued
+	Renewed  string // certificate renewed
+	Failed   string // issuance or renewal failed
+	Expiring string // certificate expires soon and renewal keeps failing
+}{
+	Issued:   "issued",
+	Renewed:  "renewed",
+	Failed:   "failed",
+	Expiring: "expiring",
+}
+
+// NotifyOperation represents operations of failed and expiring events.
+var NotifyOperation = struct {
+	Issue string // issuing a new certificate
+	Renew string // renewing the current certificate
+}{
+	Issue: "issue",
+	Renew: "renew",
+}
+
+// NotifierType represents notifier backends.
+var NotifierType = struct {
+	Smtp    string // email via smtp
+	Webhook string // generic json webhook
+	Slack   string // slack/matrix/mattermost compatible incoming webhook
+}{
+	Smtp:    "smtp",
+	Webhook: "webhook",
+	Slack:   "slack",
+}
+
+// DefaultNotifyTimeout is the default timeout of sending a notification.
+const DefaultNotifyTimeout = 30 * time.Second
+
+// DefaultNotifyExpiringDays is the default days before expiry to send expiring events when renewal fails.
+const DefaultNotifyExpiringDays = 14
+
+type NotifierConf struct {
+	Type    string   `yaml:"type"`
+	Events  []string `yaml:"events"`  // all events by default
+	Timeout int      `yaml:"timeout"` // seconds
+	// smtp
+	SmtpHost     string   `yaml:"smtpHost"`
+	SmtpPort     int      `yaml:"smtpPort"`
+	SmtpTLS      bool     `yaml:"smtpTLS"` // implicit tls, STARTTLS is used when supported otherwise
+	SmtpUsername string   `yaml:"smtpUsername"`
+	SmtpPassword Secret   `yaml:"smtpPassword"`
+	From         string   `yaml:"from"`
+	To           []string `yaml:"to"`
+	// webhook, slack
+	Url     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// NotifyEvent is an event sent to notifiers.
+type NotifyEvent struct {
+	Type       string    `json:"type"`
+	ConfID     string    `json:"confId"`
+	CommonName string    `json:"commonName"`
+	CertID     string    `json:"certId,omitempty"`
+	Operation  string    `json:"operation,omitempty"` // of failed and expiring events
+	Expires    string    `json:"expires,omitempty"`
+	DaysLeft   int       `json:"daysLeft,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	ErrorChain []string  `json:"errorChain,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// Notifier sends notification of an event.
+type Notifier interface {
+	Notify(ctx context.Context, event *NotifyEvent) error
+}
+
+// newNotifyEvent returns an event of the cert config, err is recorded with its chain.
+func newNotifyEvent(eventType string, conf *CertConf, certID string, err error) *NotifyEvent {
+	event_ := &NotifyEvent{
+		Type:       eventType,
+		ConfID:     conf.ConfID,
+		CommonName: conf.CommonName,
+		CertID:     certID,
+		Time:       time.Now(),
+	}
+	if err != nil {
+		event_.Error = err.Error()
+		for e := err; e != nil; e = errors.Unwrap(e) {
+			event_.ErrorChain = append(event_.ErrorChain, e.Error())
+		}
+	}
+	return event_
+}
+
+// Subject returns a one line summary of the event.
+func (e *NotifyEvent) Subject() string {
+	switch e.Type {
+	case NotifyEventType.Issued:
+		return fmt.Sprintf("[zerossl-ip-cert] certificate for %v issued", e.CommonName)
+	case NotifyEventType.Renewed:
+		return fmt.Sprintf("[zerossl-ip-cert] certificate for %v renewed", e.CommonName)
+	case NotifyEventType.Failed:
+		return fmt.Sprintf("[zerossl-ip-cert] %v certificate for %v failed", e.operationGerund(), e.CommonName)
+	case NotifyEventType.Expiring:
+		return fmt.Sprintf("[zerossl-ip-cert] certificate for %v expires in %d days and renewal keeps failing",
+			e.CommonName, e.DaysLeft)
+	}
+	return fmt.Sprintf("[zerossl-ip-cert] %v: %v", e.Type, e.CommonName)
+}
+
+// operationGerund returns the operation of the event as in "renewing certificate".
+func (e *NotifyEvent) operationGerund() string {
+	switch e.Operation {
+	case NotifyOperation.Issue:
+		return "issuing"
+	case NotifyOperation.Renew:
+		return "renewing"
+	}
+	return "issuing or renewing"
+}
+
+// Text returns the event as readable text.
+func (e *NotifyEvent) Text() string {
+	buf_ := &strings.Builder{}
+	buf_.WriteString(e.Subject() + "\n\n")
+	_, _ = fmt.Fprintf(buf_, "confId: %v\ncommonName: %v\n", e.ConfID, e.CommonName)
+	if e.CertID != "" {
+		_, _ = fmt.Fprintf(buf_, "certId: %v\n", e.CertID)
+	}
+	if e.Operation != "" {
+		_, _ = fmt.Fprintf(buf_, "operation: %v\n", e.Operation)
+	}
+	if e.Expires != "" {
+		_, _ = fmt.Fprintf(buf_, "expires: %v\n", e.Expires)
+	}
+	if e.Error != "" {
+		_, _ = fmt.Fprintf(buf_, "error: %v\n", e.Error)
+		for i, c := range e.ErrorChain[1:] {
+			_, _ = fmt.Fprintf(buf_, "  caused by (%d): %v\n", i+1, c)
+		}
+	}
+	_, _ = fmt.Fprintf(buf_, "time: %v\n", e.Time.Format(time.RFC3339))
+	return buf_.String()
+}
+
+// newNotifier returns the notifier of the config.
+func newNotifier(conf *NotifierConf) (notifier Notifier, err error) {
+	switch conf.Type {
+	case NotifierType.Smtp:
+		notifier = &SmtpNotifier{conf: conf}
+	case NotifierType.Webhook:
+		notifier = &WebhookNotifier{conf: conf}
+	case NotifierType.Slack:
+		notifier = &SlackNotifier{conf: conf}
+	default:
+		err = fmt.Errorf("unknown notifier type %q", conf.Type)
+	}
+	return
+}
+
+// notify sends the event to all notifiers interested in it, failures are only logged.
+func notify(notifiers []NotifierConf, event *NotifyEvent) {
+	for i := range notifiers {
+		conf_ := &notifiers[i]
+		if !conf_.wants(event.Type) {
+			continue
+		}
+		notifier_, err := newNotifier(conf_)
+		if err != nil {
+			slog.Error("Invalid notifier", "error", err)
+			continue
+		}
+		timeout_ := DefaultNotifyTimeout
+		if conf_.Timeout > 0 {
+			timeout_ = time.Duration(conf_.Timeout) * time.Second
+		}
+		ctx_, cancel_ := context.WithTimeout(context.Background(), timeout_)
+		if err = notifier_.Notify(ctx_, event); err != nil {
+			slog.Warn("Failed to send notification", "notifier", conf_.Type, "event", event.Type,
+				"confId", event.ConfID, "error", err)
+		}
+		cancel_()
+	}
+}
+
+func (c *NotifierConf) wants(eventType string) bool {
+	if len(c.Events) == 0 {
+		return true
+	}
+	for _, e := range c.Events {
+		if e == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookNotifier posts the event as json.
+type WebhookNotifier struct {
+	conf *NotifierConf
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, event *NotifyEvent) (err error) {
+	return postNotifyJson(ctx, n.conf, event)
+}
+
+// SlackNotifier posts the event text to an incoming webhook in {"text": "..."} form,
+// which is accepted by slack, mattermost and matrix hookshot.
+type SlackNotifier struct {
+	conf *NotifierConf
+}
+
+func (n *SlackNotifier) Notify(ctx context.Context, event *NotifyEvent) (err error) {
+	return postNotifyJson(ctx, n.conf, map[string]string{"text": event.Text()})
+}
+
+func postNotifyJson(ctx context.Context, conf *NotifierConf, payload interface{}) (err error) {
+	body_, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	req_, err := http.NewRequestWithContext(ctx, http.MethodPost, conf.Url, bytes.NewReader(body_))
+	if err != nil {
+		return
+	}
+	req_.Header.Set("Content-Type", "application/json")
+	for k, v := range conf.Headers {
+		req_.Header.Set(k, v)
+	}
+	return doPostActionRequest(req_)
+}
+
+// SmtpNotifier sends the event as email.
+type SmtpNotifier struct {
+	conf *NotifierConf
+}
+
+func (n *SmtpNotifier) Notify(ctx context.Context, event *NotifyEvent) (err error) {
+	port_ := n.conf.SmtpPort
+	if port_ == 0 {
+		port_ = 25
+		if n.conf.SmtpTLS {
+			port_ = 465
+		}
+	}
+	addr_ := net.JoinHostPort(n.conf.SmtpHost, strconv.Itoa(port_))
+	dialer_ := &net.Dialer{}
+	var conn_ net.Conn
+	if n.conf.SmtpTLS {
+		conn_, err = (&tls.Dialer{NetDialer: dialer_, Config: &tls.Config{ServerName: n.conf.SmtpHost}}).
+			DialContext(ctx, "tcp", addr_)
+	} else {
+		conn_, err = dialer_.DialContext(ctx, "tcp", addr_)
+	}
+	if err != nil {
+		return
+	}
+	if deadline_, ok := ctx.Deadline(); ok {
+		_ = conn_.SetDeadline(deadline_)
+	}
+	client_, err := smtp.NewClient(conn_, n.conf.SmtpHost)
+	if err != nil {
+		_ = conn_.Close()
+		return
+	}
+	defer func(client *smtp.Client) {
+		_ = client.Close()
+	}(client_)
+	if ok, _ := client_.Extension("STARTTLS"); ok && !n.conf.SmtpTLS {
+		if err = client_.StartTLS(&tls.Config{ServerName: n.conf.SmtpHost}); err != nil {
+			return
+		}
+	}
+	if n.conf.SmtpUsername != "" {
+		if err = client_.Auth(smtp.PlainAuth("", n.conf.SmtpUsername, n.conf.SmtpPassword.Value(), n.conf.SmtpHost)); err != nil {
+			return
+		}
+	}
+	if err = client_.Mail(n.conf.From); err != nil {
+		return
+	}
+	for _, to := range n.conf.To {
+		if err = client_.Rcpt(to); err != nil {
+			return
+		}
+	}
+	wr_, err := client_.Data()
+	if err != nil {
+		return
+	}
+	msg_ := fmt.Sprintf("From: %v\r\nTo: %v\r\nSubject: %v\r\nDate: %v\r\n"+
+		"MIME-Version: 1.0\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%v",
+		n.conf.From, strings.Join(n.conf.To, ", "), event.Subject(), event.Time.Format(time.RFC1123Z),
+		strings.ReplaceAll(event.Text(), "\n", "\r\n"))
+	if _, err = wr_.Write([]byte(msg_)); err != nil {
+		return
+	}
+	if err = wr_.Close(); err != nil {
+		return
+	}
+	return client_.Quit()
+}
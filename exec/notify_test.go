@@ -0,0 +1,163 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func Test_newNotifyEvent(t *testing.T) {
+	conf_ := &CertConf{ConfID: "xx1", CommonName: "1.2.3.4"}
+	err_ := fmt.Errorf("issuing: %w", fmt.Errorf("verifying: %w", errors.New("timeout")))
+	event_ := newNotifyEvent(NotifyEventType.Failed, conf_, "abc", err_)
+	want_ := []string{"issuing: verifying: timeout", "verifying: timeout", "timeout"}
+	if strings.Join(event_.ErrorChain, "|") != strings.Join(want_, "|") {
+		t.Errorf("error chain: %#v", event_.ErrorChain)
+	}
+	if !strings.Contains(event_.Text(), "caused by (2): timeout") {
+		t.Errorf("text: %v", event_.Text())
+	}
+	for op, want := range map[string]string{
+		"":                    "issuing or renewing certificate for 1.2.3.4 failed",
+		NotifyOperation.Issue: "issuing certificate for 1.2.3.4 failed",
+		NotifyOperation.Renew: "renewing certificate for 1.2.3.4 failed",
+	} {
+		event_.Operation = op
+		if !strings.HasSuffix(event_.Subject(), want) {
+			t.Errorf("subject of operation %q: %v", op, event_.Subject())
+		}
+	}
+}
+
+func Test_notifyWebhookAndSlack(t *testing.T) {
+	var webhookEvent_ NotifyEvent
+	var slackMsg_ map[string]string
+	var calls_ int
+	srv_ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls_++
+		switch r.URL.Path {
+		case "/webhook":
+			_ = json.NewDecoder(r.Body).Decode(&webhookEvent_)
+		case "/slack":
+			_ = json.NewDecoder(r.Body).Decode(&slackMsg_)
+		}
+	}))
+	defer srv_.Close()
+	notifiers_ := []NotifierConf{
+		{Type: NotifierType.Webhook, Url: srv_.URL + "/webhook"},
+		{Type: NotifierType.Slack, Url: srv_.URL + "/slack", Events: []string{NotifyEventType.Failed}},
+	}
+	conf_ := &CertConf{ConfID: "xx1", CommonName: "1.2.3.4"}
+	notify(notifiers_, newNotifyEvent(NotifyEventType.Renewed, conf_, "abc", nil))
+	if calls_ != 1 || webhookEvent_.Type != NotifyEventType.Renewed || webhookEvent_.CertID != "abc" {
+		t.Errorf("calls: %d, webhook event: %+v", calls_, webhookEvent_)
+	}
+	event_ := newNotifyEvent(NotifyEventType.Failed, conf_, "abc", errors.New("boom"))
+	event_.Operation = NotifyOperation.Renew
+	notify(notifiers_, event_)
+	if calls_ != 3 || !strings.Contains(slackMsg_["text"], "renewing certificate for 1.2.3.4 failed") ||
+		!strings.Contains(slackMsg_["text"], "operation: renew") {
+		t.Errorf("calls: %d, slack message: %#v", calls_, slackMsg_)
+	}
+	if webhookEvent_.Operation != NotifyOperation.Renew {
+		t.Errorf("webhook event: %+v", webhookEvent_)
+	}
+}
+
+// fakeSmtpServer accepts one mail and sends the received DATA to the channel.
+func fakeSmtpServer(t *testing.T) (addr string, data chan string) {
+	ln_, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln_.Close() })
+	data = make(chan string, 1)
+	go func() {
+		conn_, err := ln_.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { _ = conn_.Close() }()
+		rd_ := bufio.NewReader(conn_)
+		reply_ := func(s string) { _, _ = fmt.Fprintf(conn_, "%s\r\n", s) }
+		reply_("220 localhost ESMTP")
+		for {
+			line_, err := rd_.ReadString('\n')
+			if err != nil {
+				return
+			}
+			cmd_ := strings.ToUpper(strings.TrimSpace(line_))
+			switch {
+			case strings.HasPrefix(cmd_, "EHLO"), strings.HasPrefix(cmd_, "HELO"):
+				reply_("250 localhost")
+			case strings.HasPrefix(cmd_, "DATA"):
+				reply_("354 go ahead")
+				buf_ := &strings.Builder{}
+				for {
+					l, err := rd_.ReadString('\n')
+					if err != nil || l == ".\r\n" {
+						break
+					}
+					buf_.WriteString(l)
+				}
+				data <- buf_.String()
+				reply_("250 ok")
+			case strings.HasPrefix(cmd_, "QUIT"):
+				reply_("221 bye")
+				return
+			default:
+				reply_("250 ok")
+			}
+		}
+	}()
+	return ln_.Addr().String(), data
+}
+
+func TestSmtpNotifier(t *testing.T) {
+	addr_, data_ := fakeSmtpServer(t)
+	host_, port_, _ := net.SplitHostPort(addr_)
+	portNum_, _ := strconv.Atoi(port_)
+	notifiers_ := []NotifierConf{{
+		Type:     NotifierType.Smtp,
+		SmtpHost: host_,
+		SmtpPort: portNum_,
+		From:     "zerossl@example.com",
+		To:       []string{"ops@example.com"},
+	}}
+	event_ := newNotifyEvent(NotifyEventType.Expiring, &CertConf{ConfID: "xx1", CommonName: "1.2.3.4"}, "abc",
+		errors.New("boom"))
+	event_.DaysLeft = 3
+	notify(notifiers_, event_)
+	select {
+	case msg_ := <-data_:
+		if !strings.Contains(msg_, "Subject: [zerossl-ip-cert] certificate for 1.2.3.4 expires in 3 days") ||
+			!strings.Contains(msg_, "To: ops@example.com") || !strings.Contains(msg_, "error: boom") {
+			t.Errorf("mail: %q", msg_)
+		}
+	default:
+		t.Error("no mail received")
+	}
+}
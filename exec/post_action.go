@@ -0,0 +1,199 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PostActionType represents built-in actions after certificate arrival.
+var PostActionType = struct {
+	Signal  string // send a signal to process in pid file
+	Nginx   string // nginx -t && nginx -s reload
+	Caddy   string // load config via caddy admin api
+	Webhook string // send http request to webhook url
+}{
+	Signal:  "signal",
+	Nginx:   "nginx",
+	Caddy:   "caddy",
+	Webhook: "webhook",
+}
+
+// DefaultPostActionTimeout is the default timeout of a post action.
+const DefaultPostActionTimeout = 30 * time.Second
+
+type PostActionConf struct {
+	Type    string `yaml:"type"`
+	Timeout int    `yaml:"timeout"` // seconds
+	// signal
+	PidFile string `yaml:"pidFile"`
+	Signal  string `yaml:"signal"`
+	// nginx
+	NginxBin string `yaml:"nginxBin"`
+	// caddy
+	CaddyAdmin   string `yaml:"caddyAdmin"`
+	CaddyConfig  string `yaml:"caddyConfig"`
+	CaddyAdapter string `yaml:"caddyAdapter"`
+	// webhook
+	Url     string            `yaml:"url"`
+	Method  string            `yaml:"method"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// PostActionEvent is the payload of webhook post action.
+type PostActionEvent struct {
+	ConfID     string `json:"confId"`
+	CommonName string `json:"commonName"`
+	CertID     string `json:"certId"`
+	CertFile   string `json:"certFile"`
+	KeyFile    string `json:"keyFile"`
+}
+
+// runPostActions runs post actions of the cert config one by one, stops at the first failure.
+func runPostActions(conf *CertConf, certID string, logger *slog.Logger) (err error) {
+	for i := range conf.PostActions {
+		action_ := &conf.PostActions[i]
+		logger.Info("Running post action", "action", action_.Type)
+		if err = runPostAction(action_, conf, certID); err != nil {
+			return fmt.Errorf("%v post action failed: %w", action_.Type, err)
+		}
+	}
+	return
+}
+
+func runPostAction(action *PostActionConf, conf *CertConf, certID string) (err error) {
+	timeout_ := DefaultPostActionTimeout
+	if action.Timeout > 0 {
+		timeout_ = time.Duration(action.Timeout) * time.Second
+	}
+	ctx_, cancel_ := context.WithTimeout(context.Background(), timeout_)
+	defer cancel_()
+	switch action.Type {
+	case PostActionType.Signal:
+		err = signalPidFile(action.PidFile, action.Signal)
+	case PostActionType.Nginx:
+		err = reloadNginx(ctx_, action.NginxBin)
+	case PostActionType.Caddy:
+		err = loadCaddyConfig(ctx_, action.CaddyAdmin, action.CaddyConfig, action.CaddyAdapter)
+	case PostActionType.Webhook:
+		err = callWebhook(ctx_, action, &PostActionEvent{
+			ConfID:     conf.ConfID,
+			CommonName: conf.CommonName,
+			CertID:     certID,
+			CertFile:   conf.CertFile,
+			KeyFile:    conf.KeyFile,
+		})
+	default:
+		err = fmt.Errorf("unknown post action type %q", action.Type)
+	}
+	return
+}
+
+// signalPidFile sends signal to the process whose pid is in pid file, SIGHUP by default.
+func signalPidFile(pidFile, signal string) (err error) {
+	if signal == "" {
+		signal = "HUP"
+	}
+	sig_, err := signalByName(signal)
+	if err != nil {
+		return
+	}
+	content_, err := os.ReadFile(pidFile)
+	if err != nil {
+		return
+	}
+	pid_, err := strconv.Atoi(strings.TrimSpace(string(content_)))
+	if err != nil {
+		return fmt.Errorf("invalid pid in %v: %w", pidFile, err)
+	}
+	proc_, err := os.FindProcess(pid_)
+	if err != nil {
+		return
+	}
+	return proc_.Signal(sig_)
+}
+
+// reloadNginx tests nginx config and reloads nginx.
+func reloadNginx(ctx context.Context, nginxBin string) (err error) {
+	if nginxBin == "" {
+		nginxBin = "nginx"
+	}
+	for _, args_ := range [][]string{{"-t"}, {"-s", "reload"}} {
+		cmd_ := exec.CommandContext(ctx, nginxBin, args_...)
+		cmd_.Stdout = os.Stdout
+		cmd_.Stderr = os.Stdout
+		if err = cmd_.Run(); err != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			return fmt.Errorf("%v %v: %w", nginxBin, strings.Join(args_, " "), err)
+		}
+	}
+	return
+}
+
+// callWebhook sends the event to webhook url as json.
+func callWebhook(ctx context.Context, action *PostActionConf, event *PostActionEvent) (err error) {
+	method_ := action.Method
+	if method_ == "" {
+		method_ = http.MethodPost
+	}
+	body_, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	req_, err := http.NewRequestWithContext(ctx, method_, action.Url, bytes.NewReader(body_))
+	if err != nil {
+		return
+	}
+	req_.Header.Set("Content-Type", "application/json")
+	for k, v := range action.Headers {
+		req_.Header.Set(k, v)
+	}
+	return doPostActionRequest(req_)
+}
+
+// doPostActionRequest does the request and checks the response status.
+func doPostActionRequest(req *http.Request) (err error) {
+	resp_, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer func(Body io.ReadCloser) {
+		err := Body.Close()
+		if err != nil {
+			slog.Warn("Failed to close response body", "error", err)
+		}
+	}(resp_.Body)
+	if resp_.StatusCode < 200 || resp_.StatusCode > 299 {
+		msg_, _ := io.ReadAll(io.LimitReader(resp_.Body, 1024))
+		return fmt.Errorf("%v %v returned status code %d: %s", req.Method, req.URL.Redacted(), resp_.StatusCode,
+			strings.TrimSpace(string(msg_)))
+	}
+	return
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_callWebhook(t *testing.T) {
+	var got_ PostActionEvent
+	srv_ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "t0k3n" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewDecoder(r.Body).Decode(&got_)
+	}))
+	defer srv_.Close()
+	conf_ := &CertConf{
+		ConfID:     "xx1",
+		CommonName: "1.2.3.4",
+		CertFile:   "/tmp/cert.pem",
+		KeyFile:    "/tmp/key.pem",
+		PostActions: []PostActionConf{
+			{Type: PostActionType.Webhook, Url: srv_.URL, Headers: map[string]string{"X-Token": "t0k3n"}},
+		},
+	}
+	if err := runPostActions(conf_, "abc", slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+	if got_.ConfID != "xx1" || got_.CertID != "abc" || got_.CertFile != "/tmp/cert.pem" {
+		t.Errorf("webhook payload: %+v", got_)
+	}
+	conf_.PostActions[0].Headers = nil
+	if err := runPostActions(conf_, "abc", slog.Default()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("expect status code error, got %v", err)
+	}
+}
+
+func Test_callWebhookTimeout(t *testing.T) {
+	srv_ := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(2 * time.Second):
+		}
+	}))
+	defer srv_.Close()
+	conf_ := &CertConf{PostActions: []PostActionConf{{Type: PostActionType.Webhook, Url: srv_.URL, Timeout: 1}}}
+	start_ := time.Now()
+	if err := runPostActions(conf_, "abc", slog.Default()); err == nil {
+		t.Error("expect timeout error")
+	}
+	if time.Since(start_) >= 2*time.Second {
+		t.Error("timeout not respected")
+	}
+}
+
+func Test_reloadNginx(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("shell script")
+	}
+	dir_ := t.TempDir()
+	out_ := filepath.Join(dir_, "out.txt")
+	nginx_ := filepath.Join(dir_, "nginx")
+	script_ := "#!/bin/sh\necho \"$@\" >> " + out_ + "\n"
+	if err := os.WriteFile(nginx_, []byte(script_), 0755); err != nil {
+		t.Fatal(err)
+	}
+	action_ := PostActionConf{Type: PostActionType.Nginx, NginxBin: nginx_}
+	if err := runPostActions(&CertConf{PostActions: []PostActionConf{action_}}, "abc", slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+	got_, _ := os.ReadFile(out_)
+	if string(got_) != "-t\n-s reload\n" {
+		t.Errorf("nginx calls: %q", got_)
+	}
+	// Failed config test stops reloading.
+	if err := os.WriteFile(nginx_, []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := runPostActions(&CertConf{PostActions: []PostActionConf{action_}}, "abc", slog.Default()); err == nil {
+		t.Error("expect nginx -t failure")
+	}
+}
+
+func Test_signalPidFile(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals")
+	}
+	cmd_ := exec.Command("sleep", "30")
+	if err := cmd_.Start(); err != nil {
+		t.Skip(err)
+	}
+	pidFile_ := filepath.Join(t.TempDir(), "sleep.pid")
+	if err := os.WriteFile(pidFile_, []byte(strconv.Itoa(cmd_.Process.Pid)+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := signalPidFile(pidFile_, "SIGTERM"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd_.Wait(); err == nil {
+		t.Error("expect process terminated by signal")
+	}
+	if err := signalPidFile(pidFile_, "NOPE"); err == nil {
+		t.Error("expect unsupported signal error")
+	}
+}
@@ -0,0 +1,33 @@
+//go:build windows
+
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// signalByName returns signal of the name, only KILL is supported on windows.
+func signalByName(name string) (sig os.Signal, err error) {
+	if strings.TrimPrefix(strings.ToUpper(name), "SIG") != "KILL" {
+		return nil, fmt.Errorf("unsupported signal %q on windows", name)
+	}
+	return os.Kill, nil
+}
@@ -0,0 +1,13 @@
+@echo off
+
+echo "ZEROSSL_HTTP_FV_PATH: %ZEROSSL_HTTP_FV_PATH%"
+
+set VF_FILE="C:\Programs\caddy\caddy-zerossl-http-verify.conf"
+
+REM Remove the site block written by verify hook.
+if exist %VF_FILE% del /f %VF_FILE%
+
+CD /d C:\Programs\caddy\
+@echo on
+caddy.exe validate
+caddy.exe reload
\ No newline at end of file
@@ -0,0 +1,16 @@
+#!/usr/bin/env bash
+
+echo "nginx cleanup hook running"
+
+echo "ZEROSSL_HTTP_FV_HOST: $ZEROSSL_HTTP_FV_HOST"
+echo "ZEROSSL_HTTP_FV_PATH: $ZEROSSL_HTTP_FV_PATH"
+echo "ZEROSSL_HTTP_FV_PORT: $ZEROSSL_HTTP_FV_PORT"
+
+nginx_bin=$(which nginx)
+echo "nginx_bin: $nginx_bin"
+
+# Remove the server block written by verify hook.
+rm -f verify.conf
+
+"$nginx_bin" -t
+"$nginx_bin" -s reload
\ No newline at end of file
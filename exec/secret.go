@@ -0,0 +1,124 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	zerosslIPCert "github.com/tinkernels/zerossl-ip-cert"
+)
+
+// Secret is a sensitive config value, which is redacted when printed, logged or marshalled.
+// It can be a reference to the real value, see SecretRef.
+type Secret string
+
+// SecretRef represents prefixes of secret references:
+// "env:NAME" reads environment variable NAME, "file:PATH" reads file PATH,
+// "exec:COMMAND ARGS..." runs the command (without shell) and reads its output.
+var SecretRef = struct {
+	Env  string
+	File string
+	Exec string
+}{
+	Env:  "env:",
+	File: "file:",
+	Exec: "exec:",
+}
+
+// DefaultSecretExecTimeout is the timeout of commands of exec references.
+const DefaultSecretExecTimeout = 30 * time.Second
+
+// String returns redacted value.
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return zerosslIPCert.Redacted
+}
+
+// GoString returns redacted value for %#v.
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+// LogValue returns redacted value for log/slog.
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(s.String())
+}
+
+// MarshalJSON marshals redacted value.
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// MarshalYAML marshals redacted value.
+func (s Secret) MarshalYAML() (interface{}, error) {
+	return s.String(), nil
+}
+
+// Value returns the real value.
+func (s Secret) Value() string {
+	return string(s)
+}
+
+// Resolve returns the value referenced by the secret, trailing newlines of file contents and command outputs are
+// trimmed. Secrets that are not references are returned as is.
+func (s Secret) Resolve() (resolved Secret, err error) {
+	ref_ := string(s)
+	var value_ string
+	switch {
+	case strings.HasPrefix(ref_, SecretRef.Env):
+		name_ := strings.TrimPrefix(ref_, SecretRef.Env)
+		var ok bool
+		if value_, ok = os.LookupEnv(name_); !ok {
+			return "", fmt.Errorf("environment variable %v not set", name_)
+		}
+	case strings.HasPrefix(ref_, SecretRef.File):
+		path_ := strings.TrimPrefix(ref_, SecretRef.File)
+		content_, err := os.ReadFile(path_)
+		if err != nil {
+			return "", fmt.Errorf("reading secret file: %w", err)
+		}
+		value_ = strings.TrimRight(string(content_), "\r\n")
+	case strings.HasPrefix(ref_, SecretRef.Exec):
+		args_ := strings.Fields(strings.TrimPrefix(ref_, SecretRef.Exec))
+		if len(args_) == 0 {
+			return "", fmt.Errorf("empty secret command")
+		}
+		ctx_, cancel_ := context.WithTimeout(context.Background(), DefaultSecretExecTimeout)
+		defer cancel_()
+		out_, err := exec.CommandContext(ctx_, args_[0], args_[1:]...).Output()
+		if err != nil {
+			// Output of the command is not included, which may contain the secret.
+			return "", fmt.Errorf("running secret command %v: %w", args_[0], err)
+		}
+		value_ = strings.TrimRight(string(out_), "\r\n")
+	default:
+		return s, nil
+	}
+	if value_ == "" {
+		return "", fmt.Errorf("secret reference %v resolved to empty value", strings.SplitN(ref_, ":", 2)[0])
+	}
+	return Secret(value_), nil
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	zerosslIPCert "github.com/tinkernels/zerossl-ip-cert"
+	"gopkg.in/yaml.v3"
+)
+
+const testApiKey = "test+secret/api=key"
+
+func TestSecret(t *testing.T) {
+	s := Secret(testApiKey)
+	buf_ := new(bytes.Buffer)
+	slog.New(slog.NewTextHandler(buf_, nil)).Info("secret", "apiKey", s)
+	json_, _ := json.Marshal(struct{ ApiKey Secret }{s})
+	yaml_, _ := yaml.Marshal(struct{ ApiKey Secret }{s})
+	for _, out := range []string{s.String(), fmt.Sprintf("%v %+v %#v %s", s, s, s, s), buf_.String(),
+		string(json_), string(yaml_)} {
+		if strings.Contains(out, testApiKey) || !strings.Contains(out, zerosslIPCert.Redacted) {
+			t.Errorf("secret not redacted: %q", out)
+		}
+	}
+	if s.Value() != testApiKey {
+		t.Errorf("Value() = %q", s.Value())
+	}
+	if Secret("").String() != "" {
+		t.Errorf("empty secret should print empty")
+	}
+}
+
+// setupIssueTest sets up config and empty current data for issuing a cert against the fake api, logging to the
+// returned buffer at debug level.
+func setupIssueTest(t *testing.T) (conf *CertConf, logs *bytes.Buffer) {
+	dir_ := t.TempDir()
+	conf = &CertConf{
+		ConfID:     "test",
+		ApiKey:     testApiKey,
+		CommonName: "192.0.2.1",
+		Days:       90,
+		KeyType:    "ECDSA",
+		KeyCurve:   "P-256",
+		SigAlg:     "ECDSA-SHA256",
+		CertFile:   filepath.Join(dir_, "cert.pem"),
+		KeyFile:    filepath.Join(dir_, "key.pem"),
+	}
+	origConfig_, origLogger_ := usingConfig, slog.Default()
+	origCurrentData_, origStateStore_ := currentData, stateStore
+	usingConfig = &Config{DataDir: filepath.Join(dir_, "data"), CertConfigs: []CertConf{*conf}}
+	if err := os.MkdirAll(usingConfig.DataDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	currentData = &CurrentData{}
+	stateStore = &FileStateStore{Path: filepath.Join(usingConfig.DataDir, "current.yaml")}
+	logs = new(bytes.Buffer)
+	logger_, err := NewLogger("debug", LogFormat.Json, logs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slog.SetDefault(logger_)
+	t.Cleanup(func() {
+		usingConfig, currentData, stateStore = origConfig_, origCurrentData_, origStateStore_
+		slog.SetDefault(origLogger_)
+	})
+	return
+}
+
+func assertNoSecrets(t *testing.T, conf *CertConf, outputs ...string) {
+	t.Helper()
+	key_, _ := os.ReadFile(conf.KeyFile)
+	outputs = append(outputs, fmt.Sprintf("%v %+v %#v", *conf, *conf, *conf))
+	for _, out := range outputs {
+		for _, secret := range []string{testApiKey, url.QueryEscape(testApiKey), "PRIVATE KEY"} {
+			if strings.Contains(out, secret) {
+				t.Errorf("output contains %q: %s", secret, out)
+			}
+		}
+		if len(key_) > 0 && strings.Contains(out, strings.TrimSpace(string(key_))) {
+			t.Errorf("output contains private key: %s", out)
+		}
+	}
+}
+
+func Test_issueCertImpl_noSecrets(t *testing.T) {
+	conf, logs := setupIssueTest(t)
+	newFakeZeroSSL(t, testApiKey)
+	certID_, err := issueCertImpl(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if certID_ == "" {
+		t.Fatal("empty cert id")
+	}
+	if !strings.Contains(logs.String(), "CSR generated") {
+		t.Fatalf("debug logs missing: %s", logs)
+	}
+	assertNoSecrets(t, conf, logs.String())
+}
+
+func Test_issueCertImpl_transportErrorNoSecrets(t *testing.T) {
+	conf, logs := setupIssueTest(t)
+	api_ := newFakeZeroSSL(t, testApiKey)
+	api_.failApi[zerosslIPCert.ApiName.CreateCertificate] = errors.New("connection reset")
+	_, err := issueCertImpl(conf)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if !strings.Contains(err.Error(), "connection reset") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	slog.Error("Issuing cert failed", "error", err)
+	assertNoSecrets(t, conf, err.Error(), fmt.Sprintf("%+v", err), logs.String())
+}
+
+func TestSecret_Resolve(t *testing.T) {
+	dir_ := t.TempDir()
+	path_ := filepath.Join(dir_, "secret")
+	if err := os.WriteFile(path_, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_ZEROSSL_API_KEY", "from-env")
+	for _, c := range []struct {
+		secret  Secret
+		want    Secret
+		wantErr bool
+	}{
+		{secret: "literal", want: "literal"},
+		{secret: "", want: ""},
+		{secret: "env:TEST_ZEROSSL_API_KEY", want: "from-env"},
+		{secret: "env:TEST_ZEROSSL_API_KEY_NOT_SET", wantErr: true},
+		{secret: Secret("file:" + path_), want: "from-file"},
+		{secret: Secret("file:" + filepath.Join(dir_, "none")), wantErr: true},
+		{secret: "exec:echo from-exec", want: "from-exec"},
+		{secret: "exec:", wantErr: true},
+		{secret: "exec:false", wantErr: true},
+	} {
+		got_, err := c.secret.Resolve()
+		if (err != nil) != c.wantErr {
+			t.Errorf("Resolve(%q) error = %v, wantErr %v", c.secret.Value(), err, c.wantErr)
+			continue
+		}
+		if got_ != c.want {
+			t.Errorf("Resolve(%q) = %q, want %q", c.secret.Value(), got_.Value(), c.want.Value())
+		}
+	}
+}
@@ -0,0 +1,412 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// leaderLockKey is the key of the leader lock in the storage.
+const leaderLockKey = "leader.json"
+
+// certStorage is the storage certs are shared through by the running command, nil if sharing is disabled.
+var certStorage Storage
+
+// leaderLease is the value of the leader lock, held by the holder until expires unless renewed.
+type leaderLease struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// sharedCert is the metadata of a cert published to the storage, written after the cert and key, so it's
+// published once the metadata is written.
+type sharedCert struct {
+	ConfID      string    `json:"confId"`
+	CommonName  string    `json:"commonName"`
+	CertID      string    `json:"certId"`
+	Fingerprint string    `json:"fingerprint"`
+	Expires     time.Time `json:"expires"`
+	Published   time.Time `json:"published"`
+	Publisher   string    `json:"publisher"`
+}
+
+func storageKey(name string) string {
+	return usingConfig.Storage.Prefix + name
+}
+
+// sharedCertKey returns the key of the file of the cert config in the storage.
+func sharedCertKey(confID, name string) string {
+	return storageKey("certs/" + safeFileName(confID) + "/" + name)
+}
+
+// instanceID returns ID of this instance in the leader lock.
+func instanceID() (id string, err error) {
+	if usingConfig.Storage.InstanceID != "" {
+		return usingConfig.Storage.InstanceID, nil
+	}
+	if id, err = os.Hostname(); err != nil {
+		return "", fmt.Errorf("getting hostname as instance ID: %w", err)
+	}
+	return
+}
+
+// leaderTtl returns the time the leader lock is held without being renewed.
+func leaderTtl() time.Duration {
+	if usingConfig.Storage.LeaderTtl > 0 {
+		return time.Duration(usingConfig.Storage.LeaderTtl) * time.Minute
+	}
+	return 3 * daemonInterval()
+}
+
+// acquireLeader takes the leader lock if it's not held or expired, or renews it if held by this instance. The holder
+// is returned if held by another instance.
+func acquireLeader(storage Storage, id string, ttl time.Duration) (leader bool, holder string, err error) {
+	key_ := storageKey(leaderLockKey)
+	value_, etag_, err := storage.Get(key_)
+	cond_ := PutCondition{IfNoneMatch: true}
+	if err == nil {
+		var lease_ leaderLease
+		if err = json.Unmarshal(value_, &lease_); err != nil {
+			return false, "", fmt.Errorf("decoding leader lock: %w", err)
+		}
+		if lease_.Holder != id && time.Now().Before(lease_.Expires) {
+			return false, lease_.Holder, nil
+		}
+		cond_ = PutCondition{IfMatch: etag_}
+	} else if !errors.Is(err, ErrStorageNotFound) {
+		return
+	}
+	if value_, err = json.Marshal(leaderLease{Holder: id, Expires: time.Now().Add(ttl).UTC()}); err != nil {
+		return
+	}
+	if err = storage.Put(key_, value_, cond_); errors.Is(err, ErrStoragePrecondition) {
+		// Taken by another instance in the meantime.
+		return false, "", nil
+	} else if err != nil {
+		return
+	}
+	return true, id, nil
+}
+
+// releaseLeader expires the leader lock if held by the instance, so another instance can take it without waiting for
+// the ttl.
+func releaseLeader(storage Storage, id string) (err error) {
+	key_ := storageKey(leaderLockKey)
+	value_, etag_, err := storage.Get(key_)
+	if errors.Is(err, ErrStorageNotFound) {
+		return nil
+	} else if err != nil {
+		return
+	}
+	var lease_ leaderLease
+	if err = json.Unmarshal(value_, &lease_); err != nil {
+		return fmt.Errorf("decoding leader lock: %w", err)
+	}
+	if lease_.Holder != id {
+		return nil
+	}
+	if value_, err = json.Marshal(leaderLease{Holder: id, Expires: time.Now().UTC()}); err != nil {
+		return
+	}
+	if err = storage.Put(key_, value_, PutCondition{IfMatch: etag_}); errors.Is(err, ErrStoragePrecondition) {
+		// Taken by another instance in the meantime.
+		return nil
+	}
+	return
+}
+
+// releaseLeading releases the leader lock if held by this instance when sharing certs, failures are logged.
+func releaseLeading() {
+	if certStorage == nil {
+		return
+	}
+	id_, err := instanceID()
+	if err == nil {
+		err = releaseLeader(certStorage, id_)
+	}
+	if err != nil {
+		slog.Warn("Failed to release leader lock", "storage", certStorage, "error", err)
+	}
+}
+
+// leading is the leader lock held by this instance in the running command, nil if not leading.
+var leading *leaderState
+
+type leaderState struct {
+	// mu serializes renewals of certs issued in parallel, which would fail with etags of each other.
+	mu  sync.Mutex
+	id  string
+	ttl time.Duration
+}
+
+// keepLeading renews the leader lock before a cert is issued or renewed when leading, fails if the lock is lost, so
+// runs longer than the ttl don't issue certs issued by a new leader too.
+func keepLeading() error {
+	if leading == nil {
+		return nil
+	}
+	leading.mu.Lock()
+	defer leading.mu.Unlock()
+	leader_, holder_, err := acquireLeader(certStorage, leading.id, leading.ttl)
+	if err != nil {
+		return fmt.Errorf("renewing leader lock: %w", err)
+	}
+	if !leader_ {
+		return fmt.Errorf("leader lock is taken by %v", holder_)
+	}
+	return nil
+}
+
+// renewLeadingPeriodically renews the leader lock in a third of the ttl while certs are being issued, returns the
+// function stopping it.
+func renewLeadingPeriodically() (stop func()) {
+	done_ := make(chan struct{})
+	stopped_ := make(chan struct{})
+	go func() {
+		defer close(stopped_)
+		ticker_ := time.NewTicker(leading.ttl / 3)
+		defer ticker_.Stop()
+		for {
+			select {
+			case <-done_:
+				return
+			case <-ticker_.C:
+				if err := keepLeading(); err != nil {
+					slog.Error("Failed to keep leading", "error", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(done_)
+		<-stopped_
+	}
+}
+
+// runShared issues or renews certs and publishes them if this instance is the leader, or pulls and installs certs
+// published by the leader. The leader pulls certs published by other instances first, which led before it, and
+// releases the leader lock when done unless keepLeader.
+func runShared(renewOnly, keepLeader bool) (err error) {
+	id_, err := instanceID()
+	if err != nil {
+		return
+	}
+	leader_, holder_, err := acquireLeader(certStorage, id_, leaderTtl())
+	if err != nil {
+		return fmt.Errorf("acquiring leader lock of %v: %w", certStorage, err)
+	}
+	if !leader_ {
+		slog.Info("Pulling certs published by the leader", "leader", holder_, "storage", certStorage)
+		return pullCerts("")
+	}
+	slog.Info("Leading issuance of certs", "instanceId", id_, "storage", certStorage)
+	if !keepLeader {
+		defer releaseLeading()
+	}
+	leading = &leaderState{id: id_, ttl: leaderTtl()}
+	stop_ := renewLeadingPeriodically()
+	defer func() {
+		stop_()
+		leading = nil
+	}()
+	// Certs of the previous leader are renewed instead of issuing new ones.
+	pullErr_ := pullCerts(id_)
+	if renewOnly {
+		err = renew()
+	} else {
+		err = issueCerts()
+	}
+	return errors.Join(pullErr_, err, publishCerts(id_))
+}
+
+// publishCerts publishes current certs of cert configs which are not published yet.
+func publishCerts(publisher string) error {
+	var confs_ []*CertConf
+	for i := range usingConfig.CertConfigs {
+		confs_ = append(confs_, &usingConfig.CertConfigs[i])
+	}
+	return forEachCert(confs_, func(conf *CertConf) error {
+		certID_, err := currentCertID(conf.ConfID)
+		if err != nil {
+			// Not issued yet.
+			return nil
+		}
+		if err = publishCert(conf, certID_, publisher); err != nil {
+			certLogger(conf).Error("Failed to publish cert", "storage", certStorage, "error", err)
+			return fmt.Errorf("%v: publishing cert: %w", conf.ConfID, err)
+		}
+		return nil
+	})
+}
+
+// publishCert publishes the cert and key files of the cert config, skipped if the same cert is published.
+func publishCert(conf *CertConf, certID, publisher string) (err error) {
+	logger_ := certLogger(conf).With("certId", certID)
+	cert_, err := readCertFile(conf.CertFile)
+	if err != nil {
+		return
+	}
+	fingerprint_ := certFingerprint(cert_)
+	if shared_, err := getSharedCert(conf.ConfID); err == nil && shared_.Fingerprint == fingerprint_ {
+		return nil
+	} else if err != nil && !errors.Is(err, ErrStorageNotFound) {
+		return err
+	}
+	for _, f := range []struct{ name, path string }{{"cert.pem", conf.CertFile}, {"key.pem", conf.KeyFile}} {
+		content_, err := os.ReadFile(f.path)
+		if err != nil {
+			return err
+		}
+		if err = certStorage.Put(sharedCertKey(conf.ConfID, f.name), content_, PutCondition{}); err != nil {
+			return err
+		}
+	}
+	meta_, err := json.Marshal(sharedCert{ConfID: conf.ConfID, CommonName: conf.CommonName, CertID: certID,
+		Fingerprint: fingerprint_, Expires: cert_.NotAfter.UTC(), Published: time.Now().UTC(), Publisher: publisher})
+	if err != nil {
+		return
+	}
+	if err = certStorage.Put(sharedCertKey(conf.ConfID, "meta.json"), meta_, PutCondition{}); err != nil {
+		return
+	}
+	logger_.Info("Cert published", "storage", certStorage, "fingerprint", fingerprint_)
+	return
+}
+
+func getSharedCert(confID string) (shared *sharedCert, err error) {
+	value_, _, err := certStorage.Get(sharedCertKey(confID, "meta.json"))
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(value_, &shared); err != nil {
+		return nil, fmt.Errorf("decoding metadata of shared cert: %w", err)
+	}
+	return
+}
+
+// pullCerts pulls and installs certs published by the leader, except certs published by skipPublisher.
+func pullCerts(skipPublisher string) error {
+	var confs_ []*CertConf
+	for i := range usingConfig.CertConfigs {
+		confs_ = append(confs_, &usingConfig.CertConfigs[i])
+	}
+	return forEachCert(confs_, func(conf *CertConf) error {
+		if err := pullCert(conf, skipPublisher); err != nil {
+			certLogger(conf).Error("Failed to pull cert", "storage", certStorage, "error", err)
+			return fmt.Errorf("%v: pulling cert: %w", conf.ConfID, err)
+		}
+		return nil
+	})
+}
+
+// installPair installs the cert and key files of the cert config. Both are staged before being renamed, the key
+// first, so the new cert is never installed with the old key.
+func installPair(conf *CertConf, certPem, keyPem []byte) (err error) {
+	var staged_ []string
+	defer func() {
+		for _, temp := range staged_ {
+			_ = os.Remove(temp)
+		}
+	}()
+	for _, f := range []struct {
+		path    string
+		content []byte
+		perm    os.FileMode
+	}{{conf.KeyFile, keyPem, 0600}, {conf.CertFile, certPem, 0644}} {
+		if err = CreateDirIfNotExists(filepath.Dir(f.path), os.ModePerm); err != nil {
+			return
+		}
+		temp_, err := stageFile(f.path, f.content, f.perm)
+		if err != nil {
+			return fmt.Errorf("staging %v: %w", f.path, err)
+		}
+		staged_ = append(staged_, temp_)
+	}
+	for i, path := range []string{conf.KeyFile, conf.CertFile} {
+		if err = os.Rename(staged_[i], path); err != nil {
+			return fmt.Errorf("installing %v: %w", path, err)
+		}
+	}
+	staged_ = nil
+	return
+}
+
+// pullCert installs the cert published for the cert config if it differs from the cert file and is not published by
+// skipPublisher, records it in current data once both cert and key are installed, then runs post hook and post
+// actions.
+func pullCert(conf *CertConf, skipPublisher string) (err error) {
+	logger_ := certLogger(conf)
+	shared_, err := getSharedCert(conf.ConfID)
+	if errors.Is(err, ErrStorageNotFound) {
+		logger_.Info("No cert published yet")
+		return nil
+	} else if err != nil {
+		return
+	}
+	if skipPublisher != "" && shared_.Publisher == skipPublisher {
+		return nil
+	}
+	logger_ = logger_.With("certId", shared_.CertID)
+	if local_, err := readCertFile(conf.CertFile); err == nil && certFingerprint(local_) == shared_.Fingerprint {
+		logger_.Debug("Cert file is up to date")
+		return nil
+	}
+	certPem_, _, err := certStorage.Get(sharedCertKey(conf.ConfID, "cert.pem"))
+	if err != nil {
+		return
+	}
+	keyPem_, _, err := certStorage.Get(sharedCertKey(conf.ConfID, "key.pem"))
+	if err != nil {
+		return
+	}
+	// Checking files of the metadata are published, not being replaced.
+	block_, _ := pem.Decode(certPem_)
+	if block_ == nil {
+		return fmt.Errorf("no certificate found in published cert")
+	}
+	cert_, err := x509.ParseCertificate(block_.Bytes)
+	if err != nil {
+		return
+	}
+	if certFingerprint(cert_) != shared_.Fingerprint {
+		return fmt.Errorf("published cert doesn't match its metadata, it may be being published")
+	}
+	if _, err = tls.X509KeyPair(certPem_, keyPem_); err != nil {
+		return fmt.Errorf("published key doesn't match cert: %w", err)
+	}
+	logger_.Info("Installing published cert", "certFile", conf.CertFile, "keyFile", conf.KeyFile,
+		"publisher", shared_.Publisher)
+	if err = installPair(conf, certPem_, keyPem_); err != nil {
+		return
+	}
+	prevID_, _ := currentCertID(conf.ConfID)
+	saveCertRecord(conf, prevID_, shared_.CertID, logger_)
+	if err = runPostHook(conf, logger_); err != nil {
+		return
+	}
+	return runPostActions(conf, shared_.CertID, logger_)
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	zerosslIPCert "github.com/tinkernels/zerossl-ip-cert"
+)
+
+func TestAcquireLeader(t *testing.T) {
+	origConfig_ := usingConfig
+	t.Cleanup(func() { usingConfig = origConfig_ })
+	usingConfig = &Config{Storage: StorageConf{Prefix: "shared/"}}
+	storage_ := &LocalStorage{Dir: t.TempDir()}
+	for _, c := range []struct {
+		id         string
+		ttl        time.Duration
+		wantLeader bool
+		wantHolder string
+	}{
+		{"a", time.Hour, true, "a"},
+		{"b", time.Hour, false, "a"},
+		// Renewed by the holder, expiring already.
+		{"a", -time.Second, true, "a"},
+		{"b", time.Hour, true, "b"},
+		{"a", time.Hour, false, "b"},
+	} {
+		leader_, holder_, err := acquireLeader(storage_, c.id, c.ttl)
+		if err != nil || leader_ != c.wantLeader || holder_ != c.wantHolder {
+			t.Errorf("%v: leader %v, holder %v, error %v", c.id, leader_, holder_, err)
+		}
+	}
+	if !PathExists(filepath.Join(storage_.Dir, "shared", leaderLockKey)) {
+		t.Error("leader lock not prefixed")
+	}
+	// Released only by the holder.
+	if err := releaseLeader(storage_, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if leader_, _, err := acquireLeader(storage_, "a", time.Hour); err != nil || leader_ {
+		t.Errorf("lock of b released by a, error %v", err)
+	}
+	if err := releaseLeader(storage_, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if leader_, _, err := acquireLeader(storage_, "a", time.Hour); err != nil || !leader_ {
+		t.Errorf("lock of b not released, error %v", err)
+	}
+}
+
+func Test_runCli_sharedCerts(t *testing.T) {
+	api_ := newFakeZeroSSL(t, testApiKey)
+	s3_, storageConf_ := newFakeS3(t)
+	storageConfig_ := "storage:\n  type: s3\n  endpoint: " + storageConf_.Endpoint + "\n  bucket: " +
+		storageConf_.Bucket + "\n  pathStyle: true\n  accessKey: " + testS3AccessKey + "\n  secretKey: " +
+		testS3SecretKey + "\n  serverSideEncryption: AES256\n  prefix: prod/\n"
+	var configPaths_ []string
+	for _, id := range []string{"leader", "follower"} {
+		path_ := setupCliTest(t)
+		config_, err := os.ReadFile(path_)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config_ = append(config_, storageConfig_+"  instanceId: "+id+"\n"...)
+		if err = os.WriteFile(path_, config_, 0600); err != nil {
+			t.Fatal(err)
+		}
+		configPaths_ = append(configPaths_, path_)
+	}
+	leaderCert_ := filepath.Join(filepath.Dir(configPaths_[0]), "cert1.pem")
+	followerCert_ := filepath.Join(filepath.Dir(configPaths_[1]), "cert1.pem")
+
+	if code, _ := runCliOutput(t, "issue", "-conf-id", "c1", "-config", configPaths_[0]); code != ExitCode.OK {
+		t.Fatalf("leader issue exit code %d", code)
+	}
+	if meta_, _ := s3_.object("prod/certs/c1/meta.json"); len(meta_) == 0 {
+		t.Fatal("cert not published")
+	}
+	// Released by the one-shot run.
+	var lease_ leaderLease
+	if value_, _ := s3_.object("prod/" + leaderLockKey); json.Unmarshal(value_, &lease_) != nil ||
+		lease_.Holder != "leader" || lease_.Expires.After(time.Now()) {
+		t.Fatalf("leader lock not released: %+v", lease_)
+	}
+	certID_ := currentData.Certs[0].CertID
+	calls_ := countCalls(api_.apiCalls(), zerosslIPCert.ApiName.CreateCertificate)
+
+	// The follower takes the released lock, and installs the cert published by the leader instead of issuing one.
+	for i := 0; i < 2; i++ {
+		if code, _ := runCliOutput(t, "issue", "-conf-id", "c1", "-config", configPaths_[1]); code != ExitCode.OK {
+			t.Fatalf("follower issue exit code %d", code)
+		}
+		leaderPem_, _ := os.ReadFile(leaderCert_)
+		followerPem_, _ := os.ReadFile(followerCert_)
+		if len(followerPem_) == 0 || !bytes.Equal(leaderPem_, followerPem_) {
+			t.Fatal("follower cert differs from leader cert")
+		}
+		if len(currentData.Certs) != 1 || currentData.Certs[0].CertID != certID_ {
+			t.Errorf("follower current data %+v", currentData.Certs)
+		}
+	}
+	if countCalls(api_.apiCalls(), zerosslIPCert.ApiName.CreateCertificate) != calls_ {
+		t.Error("follower issued a cert")
+	}
+	if value_, _ := s3_.object("prod/" + leaderLockKey); json.Unmarshal(value_, &lease_) != nil ||
+		lease_.Holder != "follower" {
+		t.Errorf("follower didn't lead: %+v", lease_)
+	}
+	info_, err := os.Stat(filepath.Join(filepath.Dir(configPaths_[1]), "key1.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info_.Mode().Perm() != 0600 {
+		t.Errorf("key mode %v", info_.Mode().Perm())
+	}
+}
+
+func Test_keepLeading(t *testing.T) {
+	conf_, _ := setupIssueTest(t)
+	api_ := newFakeZeroSSL(t, testApiKey)
+	origStorage_ := certStorage
+	t.Cleanup(func() { certStorage, leading = origStorage_, nil })
+	certStorage = &LocalStorage{Dir: t.TempDir()}
+	leading = &leaderState{id: "a", ttl: time.Hour}
+	if err := keepLeading(); err != nil {
+		t.Fatal(err)
+	}
+	// Taken over by b after the lock of a expired.
+	leading.ttl = -time.Second
+	if err := keepLeading(); err != nil {
+		t.Fatal(err)
+	}
+	if leader_, _, err := acquireLeader(certStorage, "b", time.Hour); err != nil || !leader_ {
+		t.Fatalf("b is not leader, error %v", err)
+	}
+	if err := issueCerts(); err == nil || !strings.Contains(err.Error(), "taken by b") {
+		t.Errorf("expected error of lost leader lock, got %v", err)
+	}
+	if countCalls(api_.apiCalls(), zerosslIPCert.ApiName.CreateCertificate) != 0 || PathExists(conf_.CertFile) {
+		t.Error("cert issued without leader lock")
+	}
+}
+
+func Test_installPair(t *testing.T) {
+	dir_ := t.TempDir()
+	conf_ := &CertConf{CertFile: filepath.Join(dir_, "cert.pem"), KeyFile: filepath.Join(dir_, "key", "key.pem")}
+	if err := os.WriteFile(conf_.CertFile, []byte("old cert"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := installPair(conf_, []byte("cert"), []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{conf_.CertFile: "cert", conf_.KeyFile: "key"} {
+		if got_, _ := os.ReadFile(path); string(got_) != want {
+			t.Errorf("%v is %q, want %q", path, got_, want)
+		}
+	}
+	// No staged file is left.
+	if entries_, _ := os.ReadDir(dir_); len(entries_) != 2 {
+		t.Errorf("files %v", entries_)
+	}
+}
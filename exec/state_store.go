@@ -0,0 +1,312 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/yaml.v3"
+)
+
+// StateType represents backends of current data.
+var StateType = struct {
+	File string
+	KV   string
+}{
+	File: "file",
+	KV:   "kv",
+}
+
+// StateConf configures where current data is stored.
+type StateConf struct {
+	// Type is file (default), a yaml file, or kv, an embedded key-value store (bbolt) in a single file.
+	Type string `yaml:"type"`
+	// Path of the file, current.yaml (file) or state.db (kv) in dataDir by default.
+	Path string `yaml:"path"`
+}
+
+// StateStore loads and saves current data.
+type StateStore interface {
+	// Load returns current data, nil if nothing is stored yet.
+	Load() (*CurrentData, error)
+	// Save stores current data, entirely or not at all.
+	Save(data *CurrentData) error
+	Close() error
+	// String returns location of the store for logging.
+	String() string
+}
+
+// stateStore is the store of current data of the running command.
+var stateStore StateStore
+
+// OpenStateStore opens the store of current data configured, read only stores can't save.
+func OpenStateStore(conf StateConf, dataDir string, readOnly bool) (store StateStore, err error) {
+	switch conf.Type {
+	case "", StateType.File:
+		path_ := conf.Path
+		if path_ == "" {
+			path_ = filepath.Join(dataDir, "current.yaml")
+		}
+		return &FileStateStore{Path: path_}, nil
+	case StateType.KV:
+		path_ := conf.Path
+		if path_ == "" {
+			path_ = filepath.Join(dataDir, "state.db")
+		}
+		return &KVStateStore{Path: path_, ReadOnly: readOnly}, nil
+	default:
+		return nil, fmt.Errorf("unknown state type %q", conf.Type)
+	}
+}
+
+// closeStateStore closes the store of the running command.
+func closeStateStore() {
+	if stateStore == nil {
+		return
+	}
+	if err := stateStore.Close(); err != nil {
+		slog.Warn("Failed to close state store", "store", stateStore, "error", err)
+	}
+	stateStore = nil
+}
+
+// FileStateStore stores current data in a yaml file.
+type FileStateStore struct {
+	Path string
+}
+
+func (s *FileStateStore) Load() (*CurrentData, error) {
+	return ReadCurrentData(s.Path)
+}
+
+func (s *FileStateStore) Save(data *CurrentData) error {
+	return WriteCurrentData(s.Path, data)
+}
+
+func (s *FileStateStore) Close() error {
+	return nil
+}
+
+func (s *FileStateStore) String() string {
+	return s.Path
+}
+
+// Buckets of current data in kv stores, certs are keyed by confId and cert ID, pending issuances by confId.
+var (
+	kvBucketMeta    = []byte("meta")
+	kvBucketCerts   = []byte("certs")
+	kvBucketPending = []byte("pending")
+	kvBucketCreated = []byte("created")
+	kvKeyVersion    = []byte("version")
+)
+
+// kvOpenTimeout is the timeout of waiting for the lock of the kv file held by another process.
+var kvOpenTimeout = 10 * time.Second
+
+// KVStateStore stores current data in a bbolt file, each cert and pending issuance as a yaml value in a bucket, so a
+// change of current data writes only the changed records in a transaction. The file is only opened during loads and
+// saves, as bbolt locks it while opened, so read only commands can load it while a daemon is running.
+type KVStateStore struct {
+	Path     string
+	ReadOnly bool
+}
+
+func kvCertKey(cert *CurrentCertData) []byte {
+	return []byte(cert.ConfID + "/" + cert.CertID)
+}
+
+// withDB opens the file, calls fn and closes the file. Read only stores of a file not exists call fn with nil.
+func (s *KVStateStore) withDB(fn func(db *bolt.DB) error) (err error) {
+	if s.ReadOnly && !PathExists(s.Path) {
+		return fn(nil)
+	}
+	db_, err := bolt.Open(s.Path, 0600, &bolt.Options{Timeout: kvOpenTimeout, ReadOnly: s.ReadOnly})
+	if err != nil {
+		return fmt.Errorf("opening %v: %w", s, err)
+	}
+	defer func() {
+		if closeErr := db_.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	return fn(db_)
+}
+
+func (s *KVStateStore) Load() (data *CurrentData, err error) {
+	err = s.withDB(func(db *bolt.DB) error {
+		if db == nil {
+			return nil
+		}
+		return db.View(func(tx *bolt.Tx) (err error) {
+			data, err = kvLoad(tx)
+			return
+		})
+	})
+	return
+}
+
+// kvLoad reads current data in the transaction, nil if nothing is stored.
+func kvLoad(tx *bolt.Tx) (data *CurrentData, err error) {
+	meta_ := tx.Bucket(kvBucketMeta)
+	if meta_ == nil {
+		return nil, nil
+	}
+	version_ := meta_.Get(kvKeyVersion)
+	if v, err := strconv.Atoi(string(version_)); err != nil || v != CurrentDataVersion {
+		return nil, fmt.Errorf("unsupported current data version %s, %d is supported", version_, CurrentDataVersion)
+	}
+	data = &CurrentData{Version: CurrentDataVersion}
+	if err = kvForEach(tx.Bucket(kvBucketCerts), func(k, v []byte) error {
+		var cert_ CurrentCertData
+		if err := yaml.Unmarshal(v, &cert_); err != nil {
+			return fmt.Errorf("decoding cert %s: %w", k, err)
+		}
+		data.Certs = append(data.Certs, cert_)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err = kvForEach(tx.Bucket(kvBucketPending), func(k, v []byte) error {
+		var pending_ PendingIssuance
+		if err := yaml.Unmarshal(v, &pending_); err != nil {
+			return fmt.Errorf("decoding pending issuance %s: %w", k, err)
+		}
+		data.Pending = append(data.Pending, pending_)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if err = kvForEach(tx.Bucket(kvBucketCreated), func(k, v []byte) error {
+		var created_ CreatedCert
+		if err := yaml.Unmarshal(v, &created_); err != nil {
+			return fmt.Errorf("decoding created cert %s: %w", k, err)
+		}
+		data.Created = append(data.Created, created_)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func kvForEach(bucket *bolt.Bucket, fn func(k, v []byte) error) error {
+	if bucket == nil {
+		return nil
+	}
+	return bucket.ForEach(fn)
+}
+
+// Save writes changed certs, pending issuances and created certs, and deletes removed ones in a transaction.
+func (s *KVStateStore) Save(data *CurrentData) (err error) {
+	data.Version = CurrentDataVersion
+	certs_ := make(map[string][]byte)
+	for i := range data.Certs {
+		if certs_[string(kvCertKey(&data.Certs[i]))], err = yaml.Marshal(data.Certs[i]); err != nil {
+			return fmt.Errorf("marshalling cert %v: %w", data.Certs[i].CertID, err)
+		}
+	}
+	pending_ := make(map[string][]byte)
+	for _, p := range data.Pending {
+		if pending_[p.ConfID], err = yaml.Marshal(p); err != nil {
+			return fmt.Errorf("marshalling pending issuance of %v: %w", p.ConfID, err)
+		}
+	}
+	created_ := make(map[string][]byte)
+	for _, c := range data.Created {
+		if created_[c.ConfID+"/"+c.CertID], err = yaml.Marshal(c); err != nil {
+			return fmt.Errorf("marshalling created cert %v: %w", c.CertID, err)
+		}
+	}
+	return s.withDB(func(db *bolt.DB) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			meta_, err := tx.CreateBucketIfNotExists(kvBucketMeta)
+			if err != nil {
+				return err
+			}
+			if err = meta_.Put(kvKeyVersion, []byte(strconv.Itoa(CurrentDataVersion))); err != nil {
+				return err
+			}
+			if err = kvSync(tx, kvBucketCerts, certs_); err != nil {
+				return err
+			}
+			if err = kvSync(tx, kvBucketPending, pending_); err != nil {
+				return err
+			}
+			return kvSync(tx, kvBucketCreated, created_)
+		})
+	})
+}
+
+// kvSync makes the bucket have the values, writing only changed ones.
+func kvSync(tx *bolt.Tx, name []byte, values map[string][]byte) error {
+	bucket_, err := tx.CreateBucketIfNotExists(name)
+	if err != nil {
+		return err
+	}
+	var removed_ [][]byte
+	if err = bucket_.ForEach(func(k, _ []byte) error {
+		if _, ok := values[string(k)]; !ok {
+			removed_ = append(removed_, append([]byte(nil), k...))
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	for _, k := range removed_ {
+		if err = bucket_.Delete(k); err != nil {
+			return err
+		}
+	}
+	for k, v := range values {
+		if !bytes.Equal(bucket_.Get([]byte(k)), v) {
+			if err = bucket_.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *KVStateStore) Close() error {
+	return nil
+}
+
+func (s *KVStateStore) String() string {
+	return "kv:" + s.Path
+}
+
+// importStateFile imports current data of the yaml file into an empty kv store, for switching to kv stores.
+func importStateFile(store StateStore, path string) (imported bool, err error) {
+	kv_, ok := store.(*KVStateStore)
+	if !ok || kv_.ReadOnly {
+		return
+	}
+	if stored_, err := kv_.Load(); err != nil || stored_ != nil {
+		return false, err
+	}
+	data_, err := ReadCurrentData(path)
+	if err != nil || data_ == nil {
+		return
+	}
+	return true, store.Save(data_)
+}
@@ -0,0 +1,117 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKVStateStore(t *testing.T) {
+	dir_ := t.TempDir()
+	store_, err := OpenStateStore(StateConf{Type: StateType.KV}, dir_, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = store_.Close() }()
+	if data_, err := store_.Load(); err != nil || data_ != nil {
+		t.Fatalf("empty store loaded %+v, error %v", data_, err)
+	}
+	data_ := &CurrentData{
+		Certs: []CurrentCertData{
+			{ConfID: "c1", CertID: "id1", History: []string{"id0"}, Expires: time.Now().UTC().Truncate(time.Second)},
+			{ConfID: "c2", CertID: "id2"},
+		},
+		Pending: []PendingIssuance{{ConfID: "c2", CertID: "id3", Phase: Phase.Verify}},
+	}
+	if err = store_.Save(data_); err != nil {
+		t.Fatal(err)
+	}
+	data_.Certs, data_.Pending = data_.Certs[:1], nil
+	if err = store_.Save(data_); err != nil {
+		t.Fatal(err)
+	}
+	loaded_, err := store_.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded_.Certs) != 1 || len(loaded_.Pending) != 0 || loaded_.Certs[0].History[0] != "id0" ||
+		!loaded_.Certs[0].Expires.Equal(data_.Certs[0].Expires) {
+		t.Errorf("loaded %+v", loaded_)
+	}
+	if !PathExists(filepath.Join(dir_, "state.db")) {
+		t.Error("state.db not created in data dir")
+	}
+	readOnly_, err := OpenStateStore(StateConf{Type: StateType.KV}, dir_, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded_, err = readOnly_.Load(); err != nil || len(loaded_.Certs) != 1 {
+		t.Errorf("read only store loaded %+v, error %v", loaded_, err)
+	}
+	if err = readOnly_.Save(data_); err == nil {
+		t.Error("expected error of saving read only store")
+	}
+	missing_ := &KVStateStore{Path: filepath.Join(dir_, "none.db"), ReadOnly: true}
+	if loaded_, err = missing_.Load(); err != nil || loaded_ != nil || PathExists(missing_.Path) {
+		t.Errorf("missing store loaded %+v, error %v", loaded_, err)
+	}
+	if _, err = OpenStateStore(StateConf{Type: "sqlite"}, dir_, false); err == nil {
+		t.Error("expected error of unknown state type")
+	}
+}
+
+func Test_runCli_kvState(t *testing.T) {
+	configPath_ := setupCliTest(t)
+	newFakeZeroSSL(t, testApiKey)
+	config_, err := os.ReadFile(configPath_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(configPath_, append(config_, "state:\n  type: kv\n"...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Current data of the yaml file is imported.
+	dataDir_ := filepath.Join(filepath.Dir(configPath_), "data")
+	if err = os.MkdirAll(dataDir_, 0700); err != nil {
+		t.Fatal(err)
+	}
+	fileData_ := filepath.Join(dataDir_, "current.yaml")
+	fileCerts_ := []CurrentCertData{{ConfID: "old", CertID: "id0"}}
+	if err = WriteCurrentData(fileData_, &CurrentData{Certs: fileCerts_}); err != nil {
+		t.Fatal(err)
+	}
+
+	if code, _ := runCliOutput(t, "issue", "-conf-id", "c1", "-config", configPath_); code != ExitCode.OK {
+		t.Fatalf("issue exit code %d", code)
+	}
+	code_, out_ := runCliOutput(t, "status", "-json", "-offline", "-config", configPath_)
+	var status_ []CertStatusItem
+	if err = json.Unmarshal([]byte(out_), &status_); code_ != ExitCode.Failure || err != nil {
+		t.Fatalf("status exit code %d, error %v, output %v", code_, err, out_)
+	}
+	if len(status_) != 3 || status_[0].CertID == "" || status_[0].LastAttempt == nil || status_[2].CertID != "id0" {
+		t.Errorf("status %+v", status_)
+	}
+	// The yaml file is kept as is.
+	if data_, err := ReadCurrentData(fileData_); err != nil || len(data_.Certs) != 1 {
+		t.Errorf("yaml current data %+v, error %v", data_, err)
+	}
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	zerosslIPCert "github.com/tinkernels/zerossl-ip-cert"
+)
+
+// CertStatusItem is status of a configured or issued cert, unknown values are omitted.
+type CertStatusItem struct {
+	ConfID       string `json:"confId"`
+	CommonName   string `json:"commonName"`
+	CertID       string `json:"certId,omitempty"`
+	CertFile     string `json:"certFile,omitempty"`
+	KeyFile      string `json:"keyFile,omitempty"`
+	Configured   bool   `json:"configured"`
+	RemoteStatus string `json:"remoteStatus,omitempty"`
+	// Expiry of the cert in ZeroSSL.
+	RemoteExpires *time.Time `json:"remoteExpires,omitempty"`
+	// Expiry of the cert file.
+	LocalExpires  *time.Time `json:"localExpires,omitempty"`
+	DaysRemaining *int       `json:"daysRemaining,omitempty"`
+	// Whether the key file matches the cert file.
+	KeyMatch *bool `json:"keyMatch,omitempty"`
+	// Last renewal attempt recorded in current data, and its error if failed.
+	LastAttempt *time.Time `json:"lastAttempt,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	Warnings    []string   `json:"warnings,omitempty"`
+}
+
+func (item *CertStatusItem) warnf(format string, args ...interface{}) {
+	item.Warnings = append(item.Warnings, fmt.Sprintf(format, args...))
+}
+
+// certsStatus returns status of configured certs followed by issued certs without config (orphans),
+// status in ZeroSSL is not requested if offline.
+func certsStatus(offline bool) (items []CertStatusItem) {
+	current_ := make(map[string]CurrentCertData)
+	for _, cert := range currentData.Certs {
+		current_[cert.ConfID] = cert
+	}
+	configured_ := make(map[string]bool)
+	for i := range usingConfig.CertConfigs {
+		conf_ := &usingConfig.CertConfigs[i]
+		configured_[conf_.ConfID] = true
+		item_ := CertStatusItem{ConfID: conf_.ConfID, CommonName: conf_.CommonName, CertFile: conf_.CertFile,
+			KeyFile: conf_.KeyFile, Configured: true}
+		cert_, ok := current_[conf_.ConfID]
+		if !ok {
+			item_.warnf("not issued yet")
+		} else {
+			item_.CertID = cert_.CertID
+			recordStatus(&item_, &cert_)
+			if cert_.CommonName != conf_.CommonName {
+				item_.warnf("current cert is issued for %v", cert_.CommonName)
+			}
+			if !offline {
+				remoteStatus(&item_, newClient(conf_))
+			}
+		}
+		localStatus(&item_)
+		items = append(items, item_)
+	}
+	var client_ *zerosslIPCert.Client
+	if clients_ := apiKeyClients(); len(clients_) > 0 {
+		client_ = clients_[0]
+	}
+	for _, cert := range currentData.Certs {
+		if configured_[cert.ConfID] {
+			continue
+		}
+		item_ := CertStatusItem{ConfID: cert.ConfID, CommonName: cert.CommonName, CertID: cert.CertID,
+			CertFile: cert.CertFile, KeyFile: cert.KeyFile}
+		item_.warnf("orphan, no config for current cert")
+		recordStatus(&item_, &cert)
+		if !offline && client_ != nil {
+			remoteStatus(&item_, client_)
+		}
+		localStatus(&item_)
+		items = append(items, item_)
+	}
+	return
+}
+
+// recordStatus fills status of the cert recorded in current data.
+func recordStatus(item *CertStatusItem, cert *CurrentCertData) {
+	if !cert.LastAttempt.IsZero() {
+		lastAttempt_ := cert.LastAttempt
+		item.LastAttempt = &lastAttempt_
+	}
+	item.LastError = cert.LastError
+	if cert.LastError != "" {
+		item.warnf("last renewal attempt failed: %v", cert.LastError)
+	}
+}
+
+// remoteStatus fills status of the cert in ZeroSSL.
+func remoteStatus(item *CertStatusItem, client *zerosslIPCert.Client) {
+	certInfo_, err := client.GetCert(item.CertID)
+	if err != nil {
+		item.warnf("getting cert from ZeroSSL: %v", err)
+		return
+	}
+	item.RemoteStatus = certInfo_.Status
+	if !certInfo_.Expires.IsZero() {
+		item.RemoteExpires = &certInfo_.Expires
+	}
+	if certInfo_.Status != zerosslIPCert.CertStatus.Issued {
+		item.warnf("status in ZeroSSL is %v", certInfo_.Status)
+	}
+}
+
+// localStatus fills status of the cert and key files.
+func localStatus(item *CertStatusItem) {
+	if item.CertFile == "" {
+		return
+	}
+	cert_, err := readCertFile(item.CertFile)
+	if err != nil {
+		if !os.IsNotExist(err) || item.CertID != "" {
+			item.warnf("reading cert file: %v", err)
+		}
+		return
+	}
+	expires_ := cert_.NotAfter
+	daysRemaining_ := int(time.Until(expires_).Hours() / 24)
+	item.LocalExpires, item.DaysRemaining = &expires_, &daysRemaining_
+	if time.Now().After(expires_) {
+		item.warnf("cert file expired")
+	}
+	if cert_.Subject.CommonName != item.CommonName {
+		item.warnf("cert file is issued for %v", cert_.Subject.CommonName)
+	}
+	if item.KeyFile == "" {
+		return
+	}
+	_, err = tls.LoadX509KeyPair(item.CertFile, item.KeyFile)
+	keyMatch_ := err == nil
+	item.KeyMatch = &keyMatch_
+	if err != nil {
+		item.warnf("key file does not match cert file: %v", err)
+	}
+}
+
+// writeStatusTable writes status as a table.
+func writeStatusTable(w io.Writer, items []CertStatusItem) error {
+	tw_ := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw_, "CONF ID\tCOMMON NAME\tCERT ID\tREMOTE STATUS\tLOCAL EXPIRES\tDAYS LEFT\tKEY MATCH\tWARNINGS")
+	for _, item := range items {
+		expires_, days_, keyMatch_ := "-", "-", "-"
+		if item.LocalExpires != nil {
+			expires_ = item.LocalExpires.UTC().Format("2006-01-02 15:04:05")
+			days_ = fmt.Sprint(*item.DaysRemaining)
+		}
+		if item.KeyMatch != nil {
+			keyMatch_ = map[bool]string{true: "yes", false: "no"}[*item.KeyMatch]
+		}
+		_, _ = fmt.Fprintf(tw_, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", item.ConfID, item.CommonName,
+			orDash(item.CertID), orDash(item.RemoteStatus), expires_, days_, keyMatch_,
+			strings.Join(item.Warnings, "; "))
+	}
+	return tw_.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func cmdStatus(name string, args []string) (code int) {
+	var config_ string
+	fs_ := newFlagSet(name, "status [ -offline ] [ -json ] -config CONFIG_FILE", &config_)
+	offline_ := fs_.Bool("offline", false, "Don't request status from ZeroSSL")
+	json_ := fs_.Bool("json", false, "Output in json")
+	if code, done := parseFlags(fs_, args); done {
+		return code
+	}
+	if code = setup(config_, false, os.Stderr); code != ExitCode.OK {
+		return
+	}
+	items_ := certsStatus(*offline_)
+	if *json_ {
+		code = writeJsonOutput(os.Stdout, items_)
+	} else if err := writeStatusTable(os.Stdout, items_); err != nil {
+		slog.Error("Failed to write output", "error", err)
+		code = ExitCode.Failure
+	}
+	if code != ExitCode.OK {
+		return
+	}
+	// Failing when anything needs attention, for using in monitoring.
+	for _, item := range items_ {
+		if len(item.Warnings) > 0 {
+			return ExitCode.Failure
+		}
+	}
+	return ExitCode.OK
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	zerosslIPCert "github.com/tinkernels/zerossl-ip-cert"
+)
+
+func Test_certsStatus(t *testing.T) {
+	conf_, _ := setupIssueTest(t)
+	api_ := newFakeZeroSSL(t, testApiKey)
+	origCurrentData_ := currentData
+	t.Cleanup(func() { currentData = origCurrentData_ })
+	currentData = &CurrentData{}
+
+	certID_, err := issueCertImpl(conf_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newConf_ := func(confID, commonName string) CertConf {
+		c := *conf_
+		c.ConfID, c.CommonName = confID, commonName
+		c.CertFile, c.KeyFile = conf_.CertFile+"."+confID, conf_.KeyFile+"."+confID
+		return c
+	}
+	revoked_ := api_.addCert("192.0.2.2", zerosslIPCert.CertStatus.Revoked, time.Now(), time.Now().AddDate(0, 0, 90))
+	mismatch_ := newConf_("mismatch", "192.0.2.2")
+	writeTestCert(t, mismatch_.CertFile, "192.0.2.2", time.Now(), time.Now().AddDate(0, 0, 90))
+	if err = os.WriteFile(mismatch_.KeyFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	usingConfig.CertConfigs = []CertConf{*conf_, mismatch_, newConf_("new", "192.0.2.3")}
+	currentData.Certs = []CurrentCertData{
+		{ConfID: conf_.ConfID, CommonName: conf_.CommonName, CertID: certID_},
+		{ConfID: "mismatch", CommonName: "192.0.2.2", CertID: revoked_.ID},
+		{ConfID: "orphan", CommonName: "192.0.2.9", CertID: "unknown"},
+	}
+
+	items_ := certsStatus(false)
+	if len(items_) != 4 {
+		t.Fatalf("items %+v", items_)
+	}
+	ok_ := items_[0]
+	if ok_.RemoteStatus != zerosslIPCert.CertStatus.Issued || ok_.KeyMatch == nil || !*ok_.KeyMatch ||
+		ok_.DaysRemaining == nil || *ok_.DaysRemaining != 89 || len(ok_.Warnings) != 0 {
+		t.Errorf("issued cert status %+v", ok_)
+	}
+	mismatchStatus_ := items_[1]
+	if mismatchStatus_.RemoteStatus != zerosslIPCert.CertStatus.Revoked || mismatchStatus_.KeyMatch == nil ||
+		*mismatchStatus_.KeyMatch || len(mismatchStatus_.Warnings) != 2 {
+		t.Errorf("mismatch cert status %+v", mismatchStatus_)
+	}
+	if new_ := items_[2]; new_.CertID != "" || len(new_.Warnings) != 1 || new_.Warnings[0] != "not issued yet" {
+		t.Errorf("new cert status %+v", new_)
+	}
+	orphan_ := items_[3]
+	if orphan_.Configured || len(orphan_.Warnings) != 2 || !strings.HasPrefix(orphan_.Warnings[0], "orphan") {
+		t.Errorf("orphan cert status %+v", orphan_)
+	}
+
+	currentData.Certs[2].LastError = "boom"
+	calls_ := len(api_.apiCalls())
+	items_ = certsStatus(true)
+	if items_[3].LastError != "boom" || len(items_[3].Warnings) != 2 {
+		t.Errorf("status of failed renewal %+v", items_[3])
+	}
+	if len(api_.apiCalls()) != calls_ || items_[0].RemoteStatus != "" || !*items_[0].KeyMatch {
+		t.Errorf("offline status %+v", items_[0])
+	}
+
+	out_ := new(bytes.Buffer)
+	if err = writeStatusTable(out_, items_); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out_.String(), "KEY MATCH") || !strings.Contains(out_.String(), "orphan") {
+		t.Errorf("table:\n%v", out_)
+	}
+}
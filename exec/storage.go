@@ -0,0 +1,203 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// StorageType represents backends of storage sharing certs between instances.
+var StorageType = struct {
+	Local string
+	S3    string
+}{
+	Local: "local",
+	S3:    "s3",
+}
+
+// StorageConf configures the storage certs and keys are shared through. The instance holding the leader lock in
+// the storage issues and renews certs and publishes them, others pull and install them.
+type StorageConf struct {
+	// Type is local, a directory shared by instances, or s3, an S3-compatible bucket. Empty disables sharing.
+	Type string `yaml:"type"`
+	// Directory of local storages.
+	Path string `yaml:"path"`
+	// Endpoint, e.g. https://s3.us-east-1.amazonaws.com or http://minio:9000, region (us-east-1 by default) and
+	// bucket of s3 storages.
+	Endpoint string `yaml:"endpoint"`
+	Region   string `yaml:"region"`
+	Bucket   string `yaml:"bucket"`
+	// Credentials of s3 storages.
+	AccessKey Secret `yaml:"accessKey"`
+	SecretKey Secret `yaml:"secretKey"`
+	// PathStyle uses endpoint/bucket/key urls instead of bucket.endpoint/key, which MinIO needs by default.
+	PathStyle bool `yaml:"pathStyle"`
+	// ServerSideEncryption is sent as x-amz-server-side-encryption of objects put, e.g. AES256. Required for s3 as
+	// objects include private keys, none stores them unencrypted.
+	ServerSideEncryption string `yaml:"serverSideEncryption"`
+	// Prefix of keys in the storage.
+	Prefix string `yaml:"prefix"`
+	// InstanceID identifies the instance holding the leader lock, hostname by default.
+	InstanceID string `yaml:"instanceId"`
+	// LeaderTtl in minutes the leader lock is held without being renewed, 3 times daemonInterval by default.
+	LeaderTtl int `yaml:"leaderTtl"`
+}
+
+// ErrStorageNotFound is returned when the key doesn't exist in the storage.
+var ErrStorageNotFound = errors.New("not found in storage")
+
+// ErrStoragePrecondition is returned when the condition of a put is not met.
+var ErrStoragePrecondition = errors.New("precondition of storage failed")
+
+// PutCondition is the condition of a put, which is unconditional if empty.
+type PutCondition struct {
+	// IfNoneMatch puts only if the key doesn't exist.
+	IfNoneMatch bool
+	// IfMatch puts only if the etag of the current value is IfMatch.
+	IfMatch string
+}
+
+// Storage is a key-value storage shared by instances, keys are slash separated paths.
+type Storage interface {
+	// Get returns the value and its etag, ErrStorageNotFound if the key doesn't exist.
+	Get(key string) (value []byte, etag string, err error)
+	// Put writes the value if cond is met, ErrStoragePrecondition if not.
+	Put(key string, value []byte, cond PutCondition) error
+	// String returns location of the storage for logging.
+	String() string
+}
+
+// OpenStorage returns the storage configured, nil if sharing is disabled.
+func OpenStorage(conf StorageConf) (storage Storage, err error) {
+	switch conf.Type {
+	case "":
+		return nil, nil
+	case StorageType.Local:
+		return &LocalStorage{Dir: conf.Path}, nil
+	case StorageType.S3:
+		return NewS3Storage(conf)
+	default:
+		return nil, fmt.Errorf("unknown storage type %q", conf.Type)
+	}
+}
+
+// storageLockTimeout is the timeout of waiting for the lock of conditional puts of local storages.
+var storageLockTimeout = 30 * time.Second
+
+// LocalStorage stores values as files in a directory, which may be on a shared file system.
+type LocalStorage struct {
+	Dir string
+}
+
+func (s *LocalStorage) path(key string) (string, error) {
+	clean_ := path.Clean("/" + key)
+	if clean_ == "/" || clean_ != "/"+key || key == storageLockFile {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(strings.TrimPrefix(clean_, "/"))), nil
+}
+
+// localETag returns sha256 of the value in hex as etag.
+func localETag(value []byte) string {
+	sum_ := sha256.Sum256(value)
+	return hex.EncodeToString(sum_[:])
+}
+
+func (s *LocalStorage) Get(key string) (value []byte, etag string, err error) {
+	path_, err := s.path(key)
+	if err != nil {
+		return
+	}
+	if value, err = os.ReadFile(path_); errors.Is(err, fs.ErrNotExist) {
+		return nil, "", ErrStorageNotFound
+	} else if err != nil {
+		return
+	}
+	return value, localETag(value), nil
+}
+
+// Put writes the file atomically, conditional puts are serialized by an advisory lock of the directory.
+func (s *LocalStorage) Put(key string, value []byte, cond PutCondition) (err error) {
+	path_, err := s.path(key)
+	if err != nil {
+		return
+	}
+	if err = CreateDirIfNotExists(filepath.Dir(path_), 0700); err != nil {
+		return
+	}
+	if cond == (PutCondition{}) {
+		return writeFileAtomic(path_, value, 0600)
+	}
+	unlock_, err := s.lock()
+	if err != nil {
+		return fmt.Errorf("locking storage: %w", err)
+	}
+	defer unlock_()
+	_, etag_, err := s.Get(key)
+	switch {
+	case errors.Is(err, ErrStorageNotFound):
+		if cond.IfMatch != "" {
+			return ErrStoragePrecondition
+		}
+	case err != nil:
+		return
+	case cond.IfNoneMatch || etag_ != cond.IfMatch:
+		return ErrStoragePrecondition
+	}
+	return writeFileAtomic(path_, value, 0600)
+}
+
+// storageLockFile is the lock file of conditional puts of local storages, which is not a valid key.
+const storageLockFile = ".storage.lock"
+
+// lock locks the directory for conditional puts, waiting up to storageLockTimeout. The lock file is separate from
+// the lock of the data dir, so a storage in a data dir locked by this process can be locked.
+func (s *LocalStorage) lock() (unlock func(), err error) {
+	path_ := filepath.Join(s.Dir, storageLockFile)
+	file_, err := os.OpenFile(path_, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	deadline_ := time.Now().Add(storageLockTimeout)
+	for {
+		if err = tryLockFile(file_); err == nil {
+			break
+		}
+		if !errors.Is(err, errLocked) || time.Now().After(deadline_) {
+			_ = file_.Close()
+			return nil, fmt.Errorf("locking %v: %w", path_, err)
+		}
+		time.Sleep(lockPollInterval)
+	}
+	return func() {
+		_ = unlockFile(file_)
+		_ = file_.Close()
+	}, nil
+}
+
+func (s *LocalStorage) String() string {
+	return "local:" + s.Dir
+}
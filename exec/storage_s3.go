@@ -0,0 +1,240 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultS3Region is the region of s3 storages without region.
+const DefaultS3Region = "us-east-1"
+
+// S3NoEncryption is the serverSideEncryption storing objects without server-side encryption.
+const S3NoEncryption = "none"
+
+// S3Storage stores values as objects of an S3-compatible bucket, requests are signed with AWS signature version 4.
+type S3Storage struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	sse       string
+	client    *http.Client
+	// now returns time of signing, replaced in tests.
+	now func() time.Time
+}
+
+// NewS3Storage returns the s3 storage of conf.
+func NewS3Storage(conf StorageConf) (storage *S3Storage, err error) {
+	endpoint_, err := url.Parse(conf.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("parsing endpoint: %w", err)
+	}
+	if endpoint_.Scheme != "http" && endpoint_.Scheme != "https" || endpoint_.Host == "" {
+		return nil, fmt.Errorf("endpoint %q is not a http or https url", conf.Endpoint)
+	}
+	region_ := conf.Region
+	if region_ == "" {
+		region_ = DefaultS3Region
+	}
+	sse_ := conf.ServerSideEncryption
+	if sse_ == S3NoEncryption {
+		sse_ = ""
+	}
+	return &S3Storage{
+		endpoint:  endpoint_,
+		region:    region_,
+		bucket:    conf.Bucket,
+		accessKey: conf.AccessKey.Value(),
+		secretKey: conf.SecretKey.Value(),
+		pathStyle: conf.PathStyle,
+		sse:       sse_,
+		client:    &http.Client{Timeout: time.Minute},
+		now:       time.Now,
+	}, nil
+}
+
+// objectUrl returns url of the object of the key.
+func (s *S3Storage) objectUrl(key string) *url.URL {
+	url_ := *s.endpoint
+	path_ := strings.TrimSuffix(url_.Path, "/")
+	if s.pathStyle {
+		path_ += "/" + s.bucket
+	} else {
+		url_.Host = s.bucket + "." + url_.Host
+	}
+	url_.Path = path_ + "/" + key
+	// Sending the path as it's signed.
+	url_.RawPath = s3CanonicalURI(url_.Path)
+	return &url_
+}
+
+func (s *S3Storage) Get(key string) (value []byte, etag string, err error) {
+	req_, err := http.NewRequest(http.MethodGet, s.objectUrl(key).String(), nil)
+	if err != nil {
+		return
+	}
+	resp_, err := s.do(req_, nil)
+	if err != nil {
+		return
+	}
+	defer func() { _ = resp_.Body.Close() }()
+	if value, err = io.ReadAll(resp_.Body); err != nil {
+		return nil, "", fmt.Errorf("reading %v: %w", key, err)
+	}
+	return value, resp_.Header.Get("ETag"), nil
+}
+
+func (s *S3Storage) Put(key string, value []byte, cond PutCondition) (err error) {
+	req_, err := http.NewRequest(http.MethodPut, s.objectUrl(key).String(), bytes.NewReader(value))
+	if err != nil {
+		return
+	}
+	if cond.IfNoneMatch {
+		req_.Header.Set("If-None-Match", "*")
+	}
+	if cond.IfMatch != "" {
+		req_.Header.Set("If-Match", cond.IfMatch)
+	}
+	if s.sse != "" {
+		req_.Header.Set("X-Amz-Server-Side-Encryption", s.sse)
+	}
+	resp_, err := s.do(req_, value)
+	if err != nil {
+		return
+	}
+	_ = resp_.Body.Close()
+	return
+}
+
+// do signs and sends the request, errors of responses not 2xx are mapped to ErrStorageNotFound and
+// ErrStoragePrecondition.
+func (s *S3Storage) do(req *http.Request, body []byte) (resp *http.Response, err error) {
+	s.sign(req, body)
+	if resp, err = s.client.Do(req); err != nil {
+		return
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return
+	}
+	message_, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	_ = resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, ErrStorageNotFound
+	// Conflicts are returned for conditional puts of the same key in parallel.
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		return nil, ErrStoragePrecondition
+	default:
+		return nil, fmt.Errorf("%v %v: %v %s", req.Method, req.URL.Path, resp.Status, message_)
+	}
+}
+
+// sign signs the request with AWS signature version 4, all headers of the request are signed.
+func (s *S3Storage) sign(req *http.Request, body []byte) {
+	now_ := s.now().UTC()
+	payloadHash_ := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", now_.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash_)
+	headers_ := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers_[strings.ToLower(k)] = strings.Join(v, ",")
+	}
+	names_ := make([]string, 0, len(headers_))
+	for k := range headers_ {
+		names_ = append(names_, k)
+	}
+	sort.Strings(names_)
+	signature_ := s.signature(req.Method, s3CanonicalURI(req.URL.Path), req.URL.Query().Encode(), headers_, names_,
+		payloadHash_, now_)
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.accessKey+"/"+s.scope(now_)+
+		", SignedHeaders="+strings.Join(names_, ";")+", Signature="+signature_)
+}
+
+func (s *S3Storage) scope(t time.Time) string {
+	return t.Format("20060102") + "/" + s.region + "/s3/aws4_request"
+}
+
+// signature returns the signature of the canonical request of the signed headers names, which are sorted.
+func (s *S3Storage) signature(method, uri, query string, headers map[string]string, names []string,
+	payloadHash string, t time.Time) string {
+	var canonicalHeaders_ strings.Builder
+	for _, k := range names {
+		canonicalHeaders_.WriteString(k + ":" + strings.TrimSpace(headers[k]) + "\n")
+	}
+	canonicalRequest_ := strings.Join([]string{
+		method,
+		uri,
+		query,
+		canonicalHeaders_.String(),
+		strings.Join(names, ";"),
+		payloadHash,
+	}, "\n")
+	stringToSign_ := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + s.scope(t) + "\n" +
+		sha256Hex([]byte(canonicalRequest_))
+	key_ := hmacSha256([]byte("AWS4"+s.secretKey), t.Format("20060102"))
+	for _, v := range []string{s.region, "s3", "aws4_request"} {
+		key_ = hmacSha256(key_, v)
+	}
+	return hex.EncodeToString(hmacSha256(key_, stringToSign_))
+}
+
+// s3CanonicalURI returns the path with each segment URI-encoded as signature version 4 requires, characters other
+// than A-Z, a-z, 0-9, '-', '.', '_' and '~' are percent-encoded.
+func s3CanonicalURI(path string) string {
+	segments_ := strings.Split(path, "/")
+	for i, segment := range segments_ {
+		var b_ strings.Builder
+		for _, c := range []byte(segment) {
+			if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+				c == '-' || c == '.' || c == '_' || c == '~' {
+				b_.WriteByte(c)
+			} else {
+				fmt.Fprintf(&b_, "%%%02X", c)
+			}
+		}
+		segments_[i] = b_.String()
+	}
+	return strings.Join(segments_, "/")
+}
+
+func sha256Hex(data []byte) string {
+	sum_ := sha256.Sum256(data)
+	return hex.EncodeToString(sum_[:])
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac_ := hmac.New(sha256.New, key)
+	mac_.Write([]byte(data))
+	return mac_.Sum(nil)
+}
+
+func (s *S3Storage) String() string {
+	return "s3:" + s.objectUrl("").String()
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// testStorage tests gets and conditional puts of the storage.
+func testStorage(t *testing.T, storage Storage) {
+	t.Helper()
+	if _, _, err := storage.Get("a/b"); !errors.Is(err, ErrStorageNotFound) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if err := storage.Put("a/b", []byte("one"), PutCondition{IfMatch: `"none"`}); !errors.Is(err, ErrStoragePrecondition) {
+		t.Errorf("expected precondition failed of if-match of missing key, got %v", err)
+	}
+	if err := storage.Put("a/b", []byte("one"), PutCondition{IfNoneMatch: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put("a/b", []byte("two"), PutCondition{IfNoneMatch: true}); !errors.Is(err, ErrStoragePrecondition) {
+		t.Errorf("expected precondition failed of if-none-match, got %v", err)
+	}
+	value_, etag_, err := storage.Get("a/b")
+	if err != nil || string(value_) != "one" || etag_ == "" {
+		t.Fatalf("got %q, etag %q, error %v", value_, etag_, err)
+	}
+	if err = storage.Put("a/b", []byte("two"), PutCondition{IfMatch: etag_}); err != nil {
+		t.Fatal(err)
+	}
+	if err = storage.Put("a/b", []byte("three"), PutCondition{IfMatch: etag_}); !errors.Is(err, ErrStoragePrecondition) {
+		t.Errorf("expected precondition failed of stale if-match, got %v", err)
+	}
+	if err = storage.Put("a/b", []byte("four"), PutCondition{}); err != nil {
+		t.Fatal(err)
+	}
+	if value_, _, err = storage.Get("a/b"); err != nil || string(value_) != "four" {
+		t.Errorf("got %q, error %v", value_, err)
+	}
+}
+
+func TestLocalStorage(t *testing.T) {
+	dir_ := t.TempDir()
+	// Not blocked by the lock of the data dir held by this process.
+	lock_, err := LockDataDir(dir_, LockConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = lock_.Unlock() }()
+	origTimeout_ := storageLockTimeout
+	t.Cleanup(func() { storageLockTimeout = origTimeout_ })
+	storageLockTimeout = 0
+	storage_, err := OpenStorage(StorageConf{Type: StorageType.Local, Path: dir_})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, storage_)
+	for _, key := range []string{"", "../x", "a/../../x", "/x", storageLockFile} {
+		if err = storage_.Put(key, nil, PutCondition{}); err == nil {
+			t.Errorf("expected error of invalid key %q", key)
+		}
+	}
+}
@@ -20,9 +20,8 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"runtime"
+	"strings"
 )
 
 // CreateDirIfNotExists creates a directory if it does not exist.
@@ -44,43 +43,85 @@ func PathExists(filePath string) bool {
 	return true
 }
 
-// CopyFile copies content of a file from src to dst.
-func CopyFile(srcFile, dstFile string, perm os.FileMode) error {
-	dstDir_ := filepath.Dir(dstFile)
-	err := CreateDirIfNotExists(dstDir_, perm)
-	if err != nil {
-		return err
+// CopyFile copies content of a file from src to dst with perm, parent directories of dst are created as well.
+// Content is written to a temporary file renamed to dst, so dst is replaced as a whole and gets perm even if it
+// exists with other permissions.
+func CopyFile(srcFile, dstFile string, perm os.FileMode) (err error) {
+	if err = CreateDirIfNotExists(filepath.Dir(dstFile), os.ModePerm); err != nil {
+		return
 	}
-	out, err := os.Create(dstFile)
+	in, err := os.Open(srcFile)
 	if err != nil {
-		return err
+		return
 	}
-	defer func(out *os.File) {
-		err := out.Close()
-		if err != nil {
-			fmt.Printf("failed to close file: '%s', error: '%s'\n", dstFile, err.Error())
-		}
-	}(out)
-	in, err := os.Open(srcFile)
 	defer func(in *os.File) {
-		err := in.Close()
-		if err != nil {
+		if err := in.Close(); err != nil {
 			fmt.Printf("failed to close file: '%s', error: '%s'\n", srcFile, err.Error())
 		}
 	}(in)
+	out, err := os.CreateTemp(filepath.Dir(dstFile), "."+filepath.Base(dstFile)+".*")
 	if err != nil {
-		return err
+		return
 	}
-	_, err = io.Copy(out, in)
-	if err != nil {
-		return err
+	defer func() {
+		if err != nil {
+			_ = out.Close()
+			_ = os.Remove(out.Name())
+		}
+	}()
+	if err = out.Chmod(perm); err != nil {
+		return
 	}
-	return nil
+	if _, err = io.Copy(out, in); err != nil {
+		return
+	}
+	if err = out.Sync(); err != nil {
+		return
+	}
+	if err = out.Close(); err != nil {
+		return
+	}
+	return os.Rename(out.Name(), dstFile)
 }
 
-func ChmodPlusX(file string) (err error) {
-	if runtime.GOOS != "windows" {
-		err = exec.Command("/usr/bin/env", "chmod", "+x", file).Run()
+// shredFile overwrites content of the file with zeros before removing it.
+func shredFile(path string) (err error) {
+	info_, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+	file_, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return
+	}
+	_, err = io.CopyN(file_, zeroReader{}, info_.Size())
+	if err == nil {
+		err = file_.Sync()
+	}
+	if closeErr := file_.Close(); err == nil {
+		err = closeErr
+	}
+	if removeErr := os.Remove(path); err == nil {
+		err = removeErr
 	}
 	return
 }
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// safeFileName replaces characters other than letters, digits, '.', '-' and '_' in name with '_'.
+func safeFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCopyFile(t *testing.T) {
+	dir_ := t.TempDir()
+	src_ := filepath.Join(dir_, "src.pem")
+	if err := os.WriteFile(src_, []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// A file left with loose permissions gets perm.
+	dst_ := filepath.Join(dir_, "sub", "key.pem")
+	if err := os.MkdirAll(filepath.Dir(dst_), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dst_, []byte("old content"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := CopyFile(src_, dst_, 0600); err != nil {
+		t.Fatal(err)
+	}
+	got_, err := os.ReadFile(dst_)
+	if err != nil || string(got_) != "key" {
+		t.Errorf("content %q, error %v", got_, err)
+	}
+	info_, err := os.Stat(dst_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info_.Mode().Perm() != 0600 {
+		t.Errorf("mode %v", info_.Mode().Perm())
+	}
+	entries_, _ := os.ReadDir(filepath.Dir(dst_))
+	if len(entries_) != 1 {
+		t.Errorf("temporary files left: %v", entries_)
+	}
+	if err = CopyFile(filepath.Join(dir_, "missing"), dst_, 0600); err == nil {
+		t.Error("expected error of missing source")
+	}
+}
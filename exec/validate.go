@@ -0,0 +1,417 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+
+	zerosslIPCert "github.com/tinkernels/zerossl-ip-cert"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigError is a problem of the config, Line is 0 when the position in config file is unknown.
+type ConfigError struct {
+	Line    int
+	Path    string
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	if e.Line > 0 {
+		return fmt.Sprintf("line %d: %v: %v", e.Line, e.Path, e.Message)
+	}
+	return fmt.Sprintf("%v: %v", e.Path, e.Message)
+}
+
+// ConfigErrors are all problems found in the config.
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	msgs_ := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs_ = append(msgs_, err.Error())
+	}
+	return fmt.Sprintf("invalid config, %d problem(s):\n  %v", len(e), strings.Join(msgs_, "\n  "))
+}
+
+// allowedRsaKeyBits are rsa key sizes allowed.
+var allowedRsaKeyBits = []int{2048, 3072, 4096}
+
+// hostnameRegexp matches hostnames in RFC 1123.
+var hostnameRegexp = regexp.MustCompile(
+	`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)(\.[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*\.?$`)
+
+// extensionKeyPrefix is the prefix of top-level keys which are ignored, for defining yaml anchors.
+const extensionKeyPrefix = "x-"
+
+// configValidator collects problems of a config with their lines.
+type configValidator struct {
+	config *Config
+	errs   ConfigErrors
+}
+
+// addf adds a problem of the value at path, which is a list of keys (string) and indexes (int).
+func (v *configValidator) addf(path []interface{}, format string, args ...interface{}) {
+	v.errs = append(v.errs, ConfigError{
+		Line:    nodeLine(v.config.node, path),
+		Path:    pathString(path),
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// nodeLine returns the line of the value at path, or of its nearest parent when the value is absent.
+func nodeLine(node *yaml.Node, path []interface{}) (line int) {
+	if node == nil {
+		return 0
+	}
+	line = node.Line
+	for _, p := range path {
+		var next_ *yaml.Node
+		switch p := p.(type) {
+		case string:
+			next_ = mappingValue(node, p)
+		case int:
+			if node.Kind == yaml.SequenceNode && p < len(node.Content) {
+				next_ = node.Content[p]
+			}
+		}
+		if next_ == nil {
+			return
+		}
+		node, line = next_, next_.Line
+	}
+	return
+}
+
+func pathString(path []interface{}) string {
+	b_ := new(strings.Builder)
+	for _, p := range path {
+		switch p := p.(type) {
+		case string:
+			if b_.Len() > 0 {
+				b_.WriteString(".")
+			}
+			b_.WriteString(p)
+		case int:
+			_, _ = fmt.Fprintf(b_, "[%d]", p)
+		}
+	}
+	return b_.String()
+}
+
+// child returns a copy of path with elems appended.
+func child(path []interface{}, elems ...interface{}) []interface{} {
+	return append(append([]interface{}(nil), path...), elems...)
+}
+
+// checkKeys reports keys in the mapping node which are not yaml fields of type t, recursively.
+func checkKeys(node *yaml.Node, t reflect.Type, path []interface{}) (errs ConfigErrors) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case node.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		fields_ := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			name_ := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+			if name_ != "" && name_ != "-" {
+				fields_[name_] = t.Field(i).Type
+			}
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key_ := node.Content[i]
+			fieldType_, ok := fields_[key_.Value]
+			if !ok {
+				if len(path) == 0 && strings.HasPrefix(key_.Value, extensionKeyPrefix) {
+					continue
+				}
+				errs = append(errs, ConfigError{Line: key_.Line, Path: pathString(child(path, key_.Value)),
+					Message: "unknown key"})
+				continue
+			}
+			errs = append(errs, checkKeys(node.Content[i+1], fieldType_, child(path, key_.Value))...)
+		}
+	case node.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice:
+		for i, n := range node.Content {
+			errs = append(errs, checkKeys(n, t.Elem(), child(path, i))...)
+		}
+	}
+	return
+}
+
+// Validate checks the config, returns ConfigErrors of all problems found.
+func (c *Config) Validate() error {
+	v_ := &configValidator{config: c, errs: append(ConfigErrors(nil), c.unknownKeys...)}
+	if c.DataDir == "" {
+		v_.addf([]interface{}{"dataDir"}, "required")
+	}
+	if c.LogFile == "" {
+		v_.addf([]interface{}{"logFile"}, "required")
+	}
+	if _, err := NewLogger(c.LogLevel, "", io.Discard); err != nil {
+		v_.addf([]interface{}{"logLevel"}, "%v", err)
+	}
+	if _, err := NewLogger("", c.LogFormat, io.Discard); err != nil {
+		v_.addf([]interface{}{"logFormat"}, "%v", err)
+	}
+	if c.NotifyExpiringDays < 0 {
+		v_.addf([]interface{}{"notifyExpiringDays"}, "must not be negative")
+	}
+	if c.CleanUnfinishedMinAge < 0 {
+		v_.addf([]interface{}{"cleanUnfinishedMinAge"}, "must not be negative")
+	}
+	if c.DaemonInterval < 0 {
+		v_.addf([]interface{}{"daemonInterval"}, "must not be negative")
+	}
+	if c.Concurrency < 0 {
+		v_.addf([]interface{}{"concurrency"}, "must not be negative")
+	}
+	if c.ApiRateLimit < 0 {
+		v_.addf([]interface{}{"apiRateLimit"}, "must not be negative")
+	}
+	if c.Lock.Mode != "" && c.Lock.Mode != LockMode.Fail && c.Lock.Mode != LockMode.Wait {
+		v_.addf([]interface{}{"lock", "mode"}, "must be %v or %v", LockMode.Fail, LockMode.Wait)
+	}
+	if c.Lock.Timeout < 0 {
+		v_.addf([]interface{}{"lock", "timeout"}, "must not be negative")
+	}
+	if c.State.Type != "" && c.State.Type != StateType.File && c.State.Type != StateType.KV {
+		v_.addf([]interface{}{"state", "type"}, "must be %v or %v", StateType.File, StateType.KV)
+	}
+	if len(c.CertConfigs) == 0 {
+		v_.addf([]interface{}{"certConfigs"}, "no cert configs")
+	}
+	confIDs_ := make(map[string]int)
+	outputs_ := make(map[string]string)
+	for i := range c.CertConfigs {
+		conf_ := &c.CertConfigs[i]
+		path_ := []interface{}{"certConfigs", i}
+		v_.validateCertConf(conf_, path_)
+		if conf_.ConfID != "" {
+			if j, ok := confIDs_[conf_.ConfID]; ok {
+				v_.addf(child(path_, "confId"), "duplicate confId %q of certConfigs[%d]", conf_.ConfID, j)
+			} else {
+				confIDs_[conf_.ConfID] = i
+			}
+		}
+		for _, o := range []struct{ key, path string }{{"certFile", conf_.CertFile}, {"keyFile", conf_.KeyFile}} {
+			if o.path == "" {
+				continue
+			}
+			abs_, err := filepath.Abs(o.path)
+			if err != nil {
+				abs_ = filepath.Clean(o.path)
+			}
+			owner_ := pathString(child(path_, o.key))
+			if other_, ok := outputs_[abs_]; ok {
+				v_.addf(child(path_, o.key), "duplicate output path %v of %v", o.path, other_)
+			} else {
+				outputs_[abs_] = owner_
+			}
+		}
+	}
+	for i := range c.Notifiers {
+		v_.validateNotifier(&c.Notifiers[i], []interface{}{"notifiers", i})
+	}
+	v_.validateStorage(&c.Storage, c.DataDir, []interface{}{"storage"})
+	if len(v_.errs) > 0 {
+		return v_.errs
+	}
+	return nil
+}
+
+func (v *configValidator) validateCertConf(conf *CertConf, path []interface{}) {
+	required_ := map[string]string{
+		"confId":     conf.ConfID,
+		"apiKey":     conf.ApiKey.Value(),
+		"commonName": conf.CommonName,
+		"certFile":   conf.CertFile,
+		"keyFile":    conf.KeyFile,
+	}
+	for _, key := range []string{"confId", "apiKey", "commonName", "certFile", "keyFile"} {
+		if required_[key] == "" {
+			v.addf(child(path, key), "required")
+		}
+	}
+	if conf.CommonName != "" && net.ParseIP(conf.CommonName) == nil && !hostnameRegexp.MatchString(conf.CommonName) {
+		v.addf(child(path, "commonName"), "invalid ip or hostname %q", conf.CommonName)
+	}
+	if !containsInt(zerosslIPCert.AllowedValidityDays, conf.Days) {
+		v.addf(child(path, "days"), "days must be one of %v", zerosslIPCert.AllowedValidityDays)
+	}
+	sigAlg_ := strings.ToUpper(conf.SigAlg)
+	if _, ok := zerosslIPCert.SignatureAlgorithms[sigAlg_]; !ok {
+		v.addf(child(path, "sigAlg"), "invalid signature algorithm %q", conf.SigAlg)
+		sigAlg_ = ""
+	}
+	switch strings.ToUpper(conf.KeyType) {
+	case "RSA":
+		if !containsInt(allowedRsaKeyBits, conf.KeyBits) {
+			v.addf(child(path, "keyBits"), "rsa key bits must be one of %v", allowedRsaKeyBits)
+		}
+		if sigAlg_ != "" && !strings.HasSuffix(sigAlg_, "-RSA") {
+			v.addf(child(path, "sigAlg"), "signature algorithm %v does not match key type %v", conf.SigAlg,
+				conf.KeyType)
+		}
+	case "ECDSA":
+		if _, ok := zerosslIPCert.EcdsaCurves[strings.ToUpper(conf.KeyCurve)]; !ok {
+			v.addf(child(path, "keyCurve"), "invalid ecdsa curve %q", conf.KeyCurve)
+		}
+		if sigAlg_ != "" && !strings.HasPrefix(sigAlg_, "ECDSA-") {
+			v.addf(child(path, "sigAlg"), "signature algorithm %v does not match key type %v", conf.SigAlg,
+				conf.KeyType)
+		}
+	default:
+		v.addf(child(path, "keyType"), "key type must be rsa or ecdsa")
+	}
+	if conf.StrictDomains != 0 && conf.StrictDomains != 1 {
+		v.addf(child(path, "strictDomains"), "must be 0 or 1")
+	}
+	if conf.VerifyMethod != "" && conf.VerifyMethod != zerosslIPCert.VerifyDomainsMethod.HttpCsrHash {
+		v.addf(child(path, "verifyMethod"), "only %v is supported", zerosslIPCert.VerifyDomainsMethod.HttpCsrHash)
+	}
+	if t_ := conf.VerifyResponder.Type; t_ != "" && t_ != VerifyResponderType.Caddy {
+		v.addf(child(path, "verifyResponder", "type"), "unknown verify responder type %q", t_)
+	}
+	for _, h := range []struct {
+		key  string
+		hook HookCmd
+	}{{"verifyHook", conf.VerifyHook}, {"cleanupHook", conf.CleanupHook}, {"postHook", conf.PostHook}} {
+		if !h.hook.IsSet() {
+			continue
+		}
+		if _, err := exec.LookPath(h.hook[0]); err != nil {
+			v.addf(child(path, h.key), "%v", err)
+		}
+	}
+	for i := range conf.PostActions {
+		v.validatePostAction(&conf.PostActions[i], child(path, "postActions", i))
+	}
+}
+
+func (v *configValidator) validatePostAction(action *PostActionConf, path []interface{}) {
+	switch action.Type {
+	case PostActionType.Signal:
+		if action.PidFile == "" {
+			v.addf(child(path, "pidFile"), "required")
+		}
+		if action.Signal != "" {
+			if _, err := signalByName(action.Signal); err != nil {
+				v.addf(child(path, "signal"), "%v", err)
+			}
+		}
+	case PostActionType.Nginx:
+	case PostActionType.Caddy:
+		if action.CaddyConfig == "" {
+			v.addf(child(path, "caddyConfig"), "required")
+		}
+	case PostActionType.Webhook:
+		if action.Url == "" {
+			v.addf(child(path, "url"), "required")
+		}
+	default:
+		v.addf(child(path, "type"), "unknown post action type %q", action.Type)
+	}
+}
+
+func (v *configValidator) validateNotifier(conf *NotifierConf, path []interface{}) {
+	switch conf.Type {
+	case NotifierType.Smtp:
+		if conf.SmtpHost == "" {
+			v.addf(child(path, "smtpHost"), "required")
+		}
+		if conf.From == "" {
+			v.addf(child(path, "from"), "required")
+		}
+		if len(conf.To) == 0 {
+			v.addf(child(path, "to"), "required")
+		}
+	case NotifierType.Webhook, NotifierType.Slack:
+		if conf.Url == "" {
+			v.addf(child(path, "url"), "required")
+		}
+	default:
+		v.addf(child(path, "type"), "unknown notifier type %q", conf.Type)
+	}
+	for i, e := range conf.Events {
+		switch e {
+		case NotifyEventType.Issued, NotifyEventType.Renewed, NotifyEventType.Failed, NotifyEventType.Expiring:
+		default:
+			v.addf(child(path, "events", i), "unknown event type %q", e)
+		}
+	}
+}
+
+func containsInt(ints []int, i int) bool {
+	for _, v := range ints {
+		if v == i {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *configValidator) validateStorage(conf *StorageConf, dataDir string, path []interface{}) {
+	switch conf.Type {
+	case "":
+		return
+	case StorageType.Local:
+		if conf.Path == "" {
+			v.addf(child(path, "path"), "required")
+		} else if samePath(conf.Path, dataDir) {
+			// Keys of the storage would mix with files of the data dir.
+			v.addf(child(path, "path"), "must not be dataDir")
+		}
+	case StorageType.S3:
+		for _, f := range []struct {
+			key   string
+			value string
+		}{{"endpoint", conf.Endpoint}, {"bucket", conf.Bucket}, {"accessKey", string(conf.AccessKey)},
+			{"secretKey", string(conf.SecretKey)}} {
+			if f.value == "" {
+				v.addf(child(path, f.key), "required")
+			}
+		}
+		if conf.ServerSideEncryption == "" {
+			// Private keys are published.
+			v.addf(child(path, "serverSideEncryption"), "required, or %v to store private keys unencrypted",
+				S3NoEncryption)
+		}
+		if _, err := NewS3Storage(*conf); conf.Endpoint != "" && err != nil {
+			v.addf(child(path, "endpoint"), "%v", err)
+		}
+	default:
+		v.addf(child(path, "type"), "unknown storage type %q", conf.Type)
+	}
+	if conf.LeaderTtl < 0 {
+		v.addf(child(path, "leaderTtl"), "must not be negative")
+	}
+}
+
+// samePath returns whether the paths are the same after cleaning and making absolute.
+func samePath(a, b string) bool {
+	absA_, errA := filepath.Abs(a)
+	absB_, errB := filepath.Abs(b)
+	return errA == nil && errB == nil && absA_ == absB_
+}
@@ -0,0 +1,208 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, content string) (path string) {
+	path = filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestReadConfig_unknownKeys(t *testing.T) {
+	path_ := writeTestConfig(t, `dataDir: /tmp
+x-anchor: &a
+  days: 90
+certConfigs:
+  - confId: c1
+    keyCurv: P-256
+    postActions:
+      - type: nginx
+        nginxbin: /usr/sbin/nginx
+typo: 1
+logFormat: xml
+`)
+	conf_, err := ReadConfig(path_)
+	var errs_ ConfigErrors
+	if !errors.As(err, &errs_) {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+	want_ := []ConfigError{
+		{Line: 6, Path: "certConfigs[0].keyCurv", Message: "unknown key"},
+		{Line: 9, Path: "certConfigs[0].postActions[0].nginxbin", Message: "unknown key"},
+		{Line: 10, Path: "typo", Message: "unknown key"},
+	}
+	if len(errs_) != len(want_) {
+		t.Fatalf("got %v", err)
+	}
+	for i := range want_ {
+		if errs_[i] != want_[i] {
+			t.Errorf("got %v, want %v", errs_[i], want_[i])
+		}
+	}
+	// Reported with other problems.
+	if err = conf_.Validate(); !errors.As(err, &errs_) {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+	for _, want := range append(want_, ConfigError{Line: 11, Path: "logFormat", Message: "invalid log format \"xml\""}) {
+		found_ := false
+		for _, e := range errs_ {
+			found_ = found_ || e == want
+		}
+		if !found_ {
+			t.Errorf("missing %v in %v", want, errs_)
+		}
+	}
+	for _, e := range errs_ {
+		if e.Path == "logLevel" {
+			t.Errorf("unexpected %v", e)
+		}
+	}
+}
+
+func TestReadConfig_missingFile(t *testing.T) {
+	if _, err := ReadConfig(filepath.Join(t.TempDir(), "none.yaml")); err == nil {
+		t.Errorf("expected error of missing file")
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	exe_, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid_ := `dataDir: /tmp/zerossl
+logFile: /tmp/zerossl/log.txt
+apiKey: key
+defaults:
+  days: 90
+  keyType: ecdsa
+  keyCurve: P-256
+  sigAlg: ECDSA-SHA256
+  postHook: [ "` + filepath.ToSlash(exe_) + `", "-h" ]
+certConfigs:
+  - confId: c1
+    commonName: 192.0.2.1
+    certFile: /tmp/zerossl/cert1.pem
+    keyFile: /tmp/zerossl/key1.pem
+  - confId: c2
+    commonName: www.example.com
+    keyType: rsa
+    keyBits: 2048
+    sigAlg: SHA256-RSA
+    certFile: /tmp/zerossl/cert2.pem
+    keyFile: /tmp/zerossl/key2.pem
+`
+	conf_, err := ReadConfig(writeTestConfig(t, valid_))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = conf_.Validate(); err != nil {
+		t.Errorf("valid config: %v", err)
+	}
+
+	invalid_ := `dataDir: /tmp/zerossl
+logFile: /tmp/zerossl/log.txt
+logLevel: verbose
+defaults:
+  days: 30
+  keyType: ecdsa
+  keyCurve: P-521
+  sigAlg: SHA256-RSA
+certConfigs:
+  - confId: c1
+    apiKey: key
+    commonName: 192.0.2.1/24
+    certFile: /tmp/zerossl/cert.pem
+    keyFile: /tmp/zerossl/key.pem
+    verifyHook: /nonexistent/verify-hook.sh
+  - confId: c1
+    apiKey: key
+    commonName: -bad-.example.com
+    days: 90
+    keyType: rsa
+    keyBits: 1024
+    sigAlg: SHA256-RSA
+    certFile: /tmp/zerossl/cert.pem
+    postActions:
+      - type: signal
+notifiers:
+  - type: smtp
+    events: [ issued, sent ]
+storage:
+  type: s3
+  endpoint: minio:9000
+  accessKey: key
+`
+	conf_, err = ReadConfig(writeTestConfig(t, invalid_))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conf_.Validate()
+	var errs_ ConfigErrors
+	if !errors.As(err, &errs_) {
+		t.Fatalf("expected ConfigErrors, got %v", err)
+	}
+	for _, want := range []string{
+		"line 3: logLevel: invalid log level",
+		"line 12: certConfigs[0].commonName: invalid ip or hostname",
+		"line 5: certConfigs[0].days: days must be one of [90 365]",
+		"line 8: certConfigs[0].sigAlg: signature algorithm SHA256-RSA does not match key type ecdsa",
+		"line 7: certConfigs[0].keyCurve: invalid ecdsa curve",
+		"line 15: certConfigs[0].verifyHook:",
+		"line 18: certConfigs[1].commonName: invalid ip or hostname",
+		"line 21: certConfigs[1].keyBits: rsa key bits must be one of",
+		"line 16: certConfigs[1].keyFile: required",
+		"line 25: certConfigs[1].postActions[0].pidFile: required",
+		"line 16: certConfigs[1].confId: duplicate confId \"c1\" of certConfigs[0]",
+		"line 23: certConfigs[1].certFile: duplicate output path /tmp/zerossl/cert.pem of certConfigs[0].certFile",
+		"line 27: notifiers[0].smtpHost: required",
+		"line 28: notifiers[0].events[1]: unknown event type \"sent\"",
+		"storage.bucket: required",
+		"storage.secretKey: required",
+		"storage.serverSideEncryption: required, or none to store private keys unencrypted",
+		"line 31: storage.endpoint: endpoint \"minio:9000\" is not a http or https url",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("missing %q in:\n%v", want, err)
+		}
+	}
+}
+
+func TestConfig_Validate_storagePath(t *testing.T) {
+	conf_, err := ReadConfig(writeTestConfig(t, `dataDir: /tmp/zerossl
+logFile: /tmp/zerossl/log.txt
+storage:
+  type: local
+  path: /tmp/zerossl/
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = conf_.Validate(); err == nil || !strings.Contains(err.Error(), "storage.path: must not be dataDir") {
+		t.Errorf("expected error of storage path of data dir, got %v", err)
+	}
+}
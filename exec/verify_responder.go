@@ -0,0 +1,85 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	zerosslIPCert "github.com/tinkernels/zerossl-ip-cert"
+)
+
+// VerifyResponderType represents built-in responders serving http file validation content.
+var VerifyResponderType = struct {
+	Caddy string // temporary route via caddy admin api
+}{
+	Caddy: "caddy",
+}
+
+// DefaultVerifyResponderTimeout is the default timeout of a verify responder api call.
+const DefaultVerifyResponderTimeout = 30 * time.Second
+
+type VerifyResponderConf struct {
+	Type    string `yaml:"type"`
+	Timeout int    `yaml:"timeout"` // seconds
+	// caddy
+	CaddyAdmin  string `yaml:"caddyAdmin"`
+	CaddyServer string `yaml:"caddyServer"`
+}
+
+// VerifyResponder serves http file validation content during validation.
+type VerifyResponder interface {
+	Start(ctx context.Context, certInfo *zerosslIPCert.CertificateInfoModel) error
+	Stop(ctx context.Context) error
+}
+
+// startVerifyResponder starts the configured verify responder, stop is nil when no responder configured.
+func startVerifyResponder(conf *VerifyResponderConf, certInfo *zerosslIPCert.CertificateInfoModel, logger *slog.Logger) (
+	stop func(), err error) {
+	var responder_ VerifyResponder
+	switch conf.Type {
+	case "":
+		return
+	case VerifyResponderType.Caddy:
+		responder_ = &CaddyValidationResponder{Admin: conf.CaddyAdmin, Server: conf.CaddyServer, Logger: logger}
+	default:
+		return nil, fmt.Errorf("unknown verify responder type %q", conf.Type)
+	}
+	timeout_ := DefaultVerifyResponderTimeout
+	if conf.Timeout > 0 {
+		timeout_ = time.Duration(conf.Timeout) * time.Second
+	}
+	ctx_, cancel_ := context.WithTimeout(context.Background(), timeout_)
+	defer cancel_()
+	logger.Info("Starting verify responder", "responder", conf.Type)
+	if err = responder_.Start(ctx_, certInfo); err != nil {
+		// Remove what may have been partially added.
+		_ = responder_.Stop(ctx_)
+		return nil, fmt.Errorf("%v verify responder: %w", conf.Type, err)
+	}
+	stop = func() {
+		ctx_, cancel_ := context.WithTimeout(context.Background(), timeout_)
+		defer cancel_()
+		logger.Info("Stopping verify responder", "responder", conf.Type)
+		if err := responder_.Stop(ctx_); err != nil {
+			logger.Warn("Failed to stop verify responder", "responder", conf.Type, "error", err)
+		}
+	}
+	return
+}
@@ -1,5 +1,10 @@
 module github.com/tinkernels/zerossl-ip-cert
 
-go 1.18
+go 1.21
 
-require gopkg.in/yaml.v3 v3.0.1
+require (
+	go.etcd.io/bbolt v1.3.10
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.4.0 // indirect
@@ -17,65 +17,159 @@
 package zerosslIPCert
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// ApiName represents names of ZeroSSL API endpoints, used for reporting api calls.
+var ApiName = struct {
+	CreateCertificate         string
+	ListCertificates          string
+	GetCertificate            string
+	VerifyDomains             string
+	VerificationStatus        string
+	CancelCertificate         string
+	DownloadCertificateInline string
+	RevokeCertificate         string
+}{
+	CreateCertificate:         "create_certificate",
+	ListCertificates:          "list_certificates",
+	GetCertificate:            "get_certificate",
+	VerifyDomains:             "verify_domains",
+	VerificationStatus:        "verification_status",
+	CancelCertificate:         "cancel_certificate",
+	DownloadCertificateInline: "download_certificate_inline",
+	RevokeCertificate:         "revoke_certificate",
+}
+
 // Client is a client for ZeroSSL.
 // Refer: https://zerossl.com/documentation/api
 type Client struct {
 	ApiKey string // API key
+	// OnApiCall is called after each api call if set, statusCode is 0 when no response received.
+	OnApiCall func(api string, statusCode int, err error)
+	// Logger is used for logging if set, otherwise the default logger of log/slog is used.
+	Logger *slog.Logger
+	// RateLimiter is waited before each api call if set, it can be shared by clients of the same api key.
+	RateLimiter RateLimiter
+}
+
+// RateLimiter limits rate of api calls, Wait blocks until a call is allowed or ctx is done.
+type RateLimiter interface {
+	Wait(ctx context.Context) error
+}
+
+// do sends the request, reports the call and checks the response status,
+// caller should close the response body when err is nil.
+func (c *Client) do(api string, req *http.Request) (resp *http.Response, err error) {
+	if c.RateLimiter != nil {
+		if err = c.RateLimiter.Wait(req.Context()); err != nil {
+			return nil, fmt.Errorf("waiting for rate limiter: %w", err)
+		}
+	}
+	resp, err = http.DefaultClient.Do(req)
+	// Error of sending request contains the url, in which the api key is.
+	err = c.redactError(err)
+	statusCode_ := 0
+	if err == nil {
+		statusCode_ = resp.StatusCode
+		if resp.StatusCode >= 400 {
+			c.closeBody(resp.Body)
+			resp = nil
+			err = fmt.Errorf("ZeroSSL API returned status code %d", statusCode_)
+		}
+	}
+	if c.OnApiCall != nil {
+		c.OnApiCall(api, statusCode_, err)
+	}
+	return
+}
+
+func (c *Client) closeBody(body io.ReadCloser) {
+	err := body.Close()
+	if err != nil {
+		c.logger().Warn("Failed to close response body", "error", err)
+	}
+}
+
+// logger returns the logger of the client, or the default logger if not set.
+func (c *Client) logger() *slog.Logger {
+	if c.Logger == nil {
+		return slog.Default()
+	}
+	return c.Logger
+}
+
+// Redacted replaces secrets in errors and logs.
+const Redacted = "REDACTED"
+
+// redactError returns the error with api key removed.
+func (c *Client) redactError(err error) error {
+	if err == nil || c.ApiKey == "" {
+		return err
+	}
+	var urlErr_ *url.Error
+	if errors.As(err, &urlErr_) {
+		if redacted_ := RedactApiKey(urlErr_.URL, c.ApiKey); redacted_ != urlErr_.URL {
+			err = &url.Error{Op: urlErr_.Op, URL: redacted_, Err: c.redactError(urlErr_.Err)}
+		}
+	}
+	if msg_ := err.Error(); RedactApiKey(msg_, c.ApiKey) != msg_ {
+		return errors.New(RedactApiKey(msg_, c.ApiKey))
+	}
+	return err
+}
+
+// RedactApiKey replaces the api key in s, including its url encoded form.
+func RedactApiKey(s, apiKey string) string {
+	if apiKey == "" {
+		return s
+	}
+	s = strings.ReplaceAll(s, apiKey, Redacted)
+	return strings.ReplaceAll(s, url.QueryEscape(apiKey), Redacted)
 }
 
 // GetCert returns a certificate.
 func (c *Client) GetCert(id string) (cert CertificateInfoModel, err error) {
 	req_ := ApiReqFactory.GetCertificate(c.ApiKey, id)
-	resp, err := http.DefaultClient.Do(req_)
+	resp, err := c.do(ApiName.GetCertificate, req_)
 	if err != nil {
 		return CertificateInfoModel{}, err
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			log.Println(err)
-		}
-	}(resp.Body)
-	if resp.StatusCode >= 400 {
-		return CertificateInfoModel{}, fmt.Errorf("ZeroSSL API returned status code %d", resp.StatusCode)
-	}
+	defer c.closeBody(resp.Body)
 	err = json.NewDecoder(resp.Body).Decode(&cert)
 	if err != nil {
 		if &cert == nil {
 			return
 		}
-		log.Println(err)
+		c.logger().Debug("Using partially decoded response", "error", err)
 		// The validation field in api response can an empty array, using the partially unmarshalled value.
 		return cert, nil
 	}
 	return
 }
 
-// CreateCert creates a certificate with the given parameters.
-func (c *Client) CreateCert(domains, csr, days, isStrictDomains string) (cert CertificateInfoModel, err error) {
-	req_ := ApiReqFactory.CreateCertificate(c.ApiKey, domains, csr, days, isStrictDomains)
-	resp, err := http.DefaultClient.Do(req_)
+// CreateCert creates a certificate, the request is validated before sending.
+func (c *Client) CreateCert(req CreateCertRequest) (cert CertificateInfoModel, err error) {
+	if err = req.Validate(); err != nil {
+		return CertificateInfoModel{}, fmt.Errorf("invalid request: %w", err)
+	}
+	domains_, csr_, days_, strictDomains_ := req.params()
+	req_ := ApiReqFactory.CreateCertificate(c.ApiKey, domains_, csr_, days_, strictDomains_)
+	resp, err := c.do(ApiName.CreateCertificate, req_)
 	if err != nil {
-		log.Println(err)
 		return CertificateInfoModel{}, err
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			log.Println(err)
-		}
-	}(resp.Body)
-	if resp.StatusCode >= 400 {
-		return CertificateInfoModel{}, fmt.Errorf("ZeroSSL API returned status code %d", resp.StatusCode)
-	}
+	defer c.closeBody(resp.Body)
 	err = json.NewDecoder(resp.Body).Decode(&cert)
 	if err != nil {
 		return CertificateInfoModel{}, err
@@ -86,39 +180,33 @@ func (c *Client) CreateCert(domains, csr, days, isStrictDomains string) (cert Ce
 // Cancel a certificate.
 func (c *Client) CancelCert(id string) (err error) {
 	req_ := ApiReqFactory.CancelCertificate(c.ApiKey, id)
-	resp, err := http.DefaultClient.Do(req_)
+	resp, err := c.do(ApiName.CancelCertificate, req_)
 	if err != nil {
 		return err
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			log.Println(err)
-		}
-	}(resp.Body)
-	if resp.StatusCode >= 400 {
-		return fmt.Errorf("ZeroSSL API returned status code %d", resp.StatusCode)
+	defer c.closeBody(resp.Body)
+	return
+}
+
+// RevokeCert revokes an issued certificate, reason is optional, see RevokeReason.
+func (c *Client) RevokeCert(id, reason string) (err error) {
+	req_ := ApiReqFactory.RevokeCertificate(c.ApiKey, id, reason)
+	resp, err := c.do(ApiName.RevokeCertificate, req_)
+	if err != nil {
+		return err
 	}
+	defer c.closeBody(resp.Body)
 	return
 }
 
 // VerifyDomains verifies domains of specified certificate with given validation info.
 func (c *Client) VerifyDomains(certID, validationMethod, validationEmail string) (verifyDomainsRsp VerifyDomainsModel, err error) {
 	req_ := ApiReqFactory.VerifyDomains(c.ApiKey, certID, validationMethod, validationEmail)
-	resp, err := http.DefaultClient.Do(req_)
+	resp, err := c.do(ApiName.VerifyDomains, req_)
 	if err != nil {
-		log.Println(err)
 		return
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			log.Println(err)
-		}
-	}(resp.Body)
-	if resp.StatusCode >= 400 {
-		return VerifyDomainsModel{}, fmt.Errorf("ZeroSSL API returned status code %d", resp.StatusCode)
-	}
+	defer c.closeBody(resp.Body)
 	err = json.NewDecoder(resp.Body).Decode(&verifyDomainsRsp)
 	if err != nil {
 		return VerifyDomainsModel{}, err
@@ -129,20 +217,11 @@ func (c *Client) VerifyDomains(certID, validationMethod, validationEmail string)
 // VerificationStatus returns the verification status of a certificate.
 func (c *Client) VerificationStatus(certID string) (verificationStatusRsp VerificationStatusModel, err error) {
 	req_ := ApiReqFactory.VerificationStatus(c.ApiKey, certID)
-	resp, err := http.DefaultClient.Do(req_)
+	resp, err := c.do(ApiName.VerificationStatus, req_)
 	if err != nil {
-		log.Println(err)
 		return
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			log.Println(err)
-		}
-	}(resp.Body)
-	if resp.StatusCode >= 400 {
-		return VerificationStatusModel{}, fmt.Errorf("ZeroSSL API returned status code %d", resp.StatusCode)
-	}
+	defer c.closeBody(resp.Body)
 	err = json.NewDecoder(resp.Body).Decode(&verificationStatusRsp)
 	if err != nil {
 		return VerificationStatusModel{}, err
@@ -151,22 +230,17 @@ func (c *Client) VerificationStatus(certID string) (verificationStatusRsp Verifi
 }
 
 // DownloadCertInline returns the certificate in PEM format.
-func (c *Client) DownloadCertInline(certID, includeCrossSigned string) (cert CertificateContentModel, err error) {
-	req_ := ApiReqFactory.DownloadCertificateInline(c.ApiKey, certID, includeCrossSigned)
-	resp, err := http.DefaultClient.Do(req_)
+func (c *Client) DownloadCertInline(certID string, includeCrossSigned bool) (cert CertificateContentModel, err error) {
+	includeCrossSigned_ := ""
+	if includeCrossSigned {
+		includeCrossSigned_ = "1"
+	}
+	req_ := ApiReqFactory.DownloadCertificateInline(c.ApiKey, certID, includeCrossSigned_)
+	resp, err := c.do(ApiName.DownloadCertificateInline, req_)
 	if err != nil {
-		log.Println(err)
 		return
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			log.Println(err)
-		}
-	}(resp.Body)
-	if resp.StatusCode >= 400 {
-		return CertificateContentModel{}, fmt.Errorf("ZeroSSL API returned status code %d", resp.StatusCode)
-	}
+	defer c.closeBody(resp.Body)
 	err = json.NewDecoder(resp.Body).Decode(&cert)
 	if err != nil {
 		return CertificateContentModel{}, err
@@ -174,58 +248,200 @@ func (c *Client) DownloadCertInline(certID, includeCrossSigned string) (cert Cer
 	return
 }
 
-// ListCerts returns a list of certificates with optional filters.
-func (c *Client) ListCerts(status, search, limit, page string) (listCertsRsp ListCertsModel, err error) {
-	req_ := ApiReqFactory.ListCertificates(c.ApiKey, status, search, limit, page)
-	resp, err := http.DefaultClient.Do(req_)
+// ListCerts returns the page (starting from 1) of certificates matching the filter,
+// see AllCerts for walking all pages.
+func (c *Client) ListCerts(filter CertsFilter, page int) (listCertsRsp ListCertsModel, err error) {
+	return c.listCerts(filter.request(c.ApiKey, page))
+}
+
+func (c *Client) listCerts(req *http.Request) (listCertsRsp ListCertsModel, err error) {
+	resp, err := c.do(ApiName.ListCertificates, req)
 	if err != nil {
-		log.Println(err)
 		return
 	}
-	defer func(Body io.ReadCloser) {
-		err := Body.Close()
-		if err != nil {
-			log.Println(err)
-		}
-	}(resp.Body)
-	if resp.StatusCode >= 400 {
-		return ListCertsModel{}, fmt.Errorf("ZeroSSL API returned status code %d", resp.StatusCode)
-	}
+	defer c.closeBody(resp.Body)
 	err = json.NewDecoder(resp.Body).Decode(&listCertsRsp)
 	if err != nil {
 		if &listCertsRsp == nil {
 			return
 		}
-		log.Println(err)
+		c.logger().Debug("Using partially decoded response", "error", err)
 		// The validation field in api response can an empty array, using the partially unmarshalled value.
 		return listCertsRsp, nil
 	}
 	return
 }
 
-func (c *Client) CleanUnfinished() (err error) {
-	log.Println("Cleaning unfinished certificates")
-	perPage_ := 100
-	max := 1
-	for page_ := 1; page_-1 <= max; page_++ {
-		certs, err := c.ListCerts("", "draft,pending_validation", strconv.Itoa(perPage_), strconv.Itoa(page_))
-		max = certs.TotalCount / perPage_
-		log.Printf("page_: %d max: %d ResultCount: %d", page_, max, certs.ResultCount)
+// CertsFilter filters certificates to list, zero values don't filter.
+type CertsFilter struct {
+	Statuses []string // see CertStatus
+	Search   string
+	PageSize int // DefaultPageSize if not set
+}
+
+// request returns the request of listing the page.
+func (f *CertsFilter) request(apiKey string, page int) *http.Request {
+	limit_, page_ := "", ""
+	if f.PageSize > 0 {
+		limit_ = strconv.Itoa(f.PageSize)
+	}
+	if page > 0 {
+		page_ = strconv.Itoa(page)
+	}
+	return ApiReqFactory.ListCertificates(apiKey, strings.Join(f.Statuses, ","), f.Search, limit_, page_)
+}
+
+// DefaultPageSize is the default number of certificates requested per page.
+const DefaultPageSize = 100
+
+// StopIteration can be returned by callbacks of AllCerts to stop iterating without error.
+var StopIteration = errors.New("stop iteration")
+
+// MaxListPages is the max number of pages walked by AllCerts, in case the api keeps returning full pages.
+const MaxListPages = 1000
+
+// AllCerts calls fn with each certificate matching the filter, walking all pages until fn returns an error
+// (StopIteration stops without error) or ctx is done.
+// Certificates changed by fn may shift pages, collect them first if they are changed to not match the filter.
+func (c *Client) AllCerts(ctx context.Context, filter CertsFilter, fn func(cert CertificateInfoModel) error) (
+	err error) {
+	pageSize_ := filter.PageSize
+	if pageSize_ <= 0 {
+		pageSize_ = DefaultPageSize
+	}
+	listed_ := 0
+	for page_ := 1; ; page_++ {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+		filter.PageSize = pageSize_
+		certs_, err := c.listCerts(filter.request(c.ApiKey, page_).WithContext(ctx))
 		if err != nil {
-			log.Println(err)
-			break
+			return fmt.Errorf("listing certificates page %d: %w", page_, err)
 		}
-
-		for _, cert := range certs.Results {
-			// Cleaning up certificates that are not finished (including cancelled, expired).
-			if cert.Status == CertStatus.Draft || cert.Status == CertStatus.PendingValidation {
-				log.Printf("Cleaning %s in %s status, id %s", cert.CommonName, cert.Status, cert.ID)
-				err = c.CancelCert(cert.ID)
-				if err != nil {
-					log.Println(err)
+		c.logger().Debug("Listed certificates", "page", page_, "resultCount", len(certs_.Results),
+			"totalCount", certs_.TotalCount)
+		for _, cert := range certs_.Results {
+			if err = fn(cert); err != nil {
+				if errors.Is(err, StopIteration) {
+					return nil
 				}
+				return err
 			}
 		}
+		listed_ += len(certs_.Results)
+		// Pages may be smaller than the page size requested, as the api caps the limit.
+		limit_ := certs_.Limit
+		if limit_ <= 0 {
+			limit_ = pageSize_
+		}
+		// The last page is not full, or all are listed.
+		if len(certs_.Results) < limit_ || (certs_.TotalCount > 0 && listed_ >= certs_.TotalCount) {
+			return nil
+		}
+		if page_ >= MaxListPages {
+			return fmt.Errorf("listing certificates: more than %d pages", MaxListPages)
+		}
 	}
-	return
+}
+
+// CleanOptions scopes cancelling of unfinished certificates.
+type CleanOptions struct {
+	// Only certificates of the common names or the IDs are in scope, all unfinished certificates of the account
+	// are in scope if both are empty.
+	CommonNames []string
+	CertIDs     []string
+	// Certificates of the IDs are never cancelled, e.g. issuances to resume.
+	Exclude []string
+	// Only certificates created at least MinAge ago are cancelled, so issuances in flight elsewhere are kept.
+	// Certificates of unknown creation time are kept too unless MinAge is zero.
+	MinAge time.Duration
+	// Report certificates to cancel without cancelling them.
+	DryRun bool
+}
+
+// inScope reports whether the certificate is in scope of the options.
+func (o CleanOptions) inScope(cert CertificateInfoModel) bool {
+	for _, id := range o.Exclude {
+		if id == cert.ID {
+			return false
+		}
+	}
+	if len(o.CommonNames) == 0 && len(o.CertIDs) == 0 {
+		return true
+	}
+	for _, cn := range o.CommonNames {
+		if strings.EqualFold(cn, cert.CommonName) {
+			return true
+		}
+	}
+	for _, id := range o.CertIDs {
+		if id == cert.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanSummary is the result of CleanUnfinished.
+type CleanSummary struct {
+	// Certificates cancelled, or would be cancelled in dry run.
+	Cancelled []CertificateInfoModel `json:"cancelled"`
+	// Certificates in scope but younger than MinAge.
+	TooYoung []CertificateInfoModel `json:"tooYoung"`
+	// Certificates failed to cancel.
+	Failed []CleanFailure `json:"failed"`
+	// Count of unfinished certificates out of scope.
+	OutOfScope int  `json:"outOfScope"`
+	DryRun     bool `json:"dryRun"`
+}
+
+// CleanFailure is a certificate failed to cancel.
+type CleanFailure struct {
+	Cert  CertificateInfoModel `json:"cert"`
+	Error string               `json:"error"`
+}
+
+// CleanUnfinished cancels certificates not finished issuing (draft or pending validation) in scope of opts,
+// returns what is cancelled or kept, and errors of listing or cancelling joined.
+func (c *Client) CleanUnfinished(opts CleanOptions) (summary CleanSummary, err error) {
+	c.logger().Info("Cleaning unfinished certificates", "dryRun", opts.DryRun)
+	summary.DryRun = opts.DryRun
+	var unfinished_ []CertificateInfoModel
+	// Collecting all before cancelling, cancelled certificates shift pages.
+	err = c.AllCerts(context.Background(), CertsFilter{
+		Statuses: []string{CertStatus.Draft, CertStatus.PendingValidation},
+	}, func(cert CertificateInfoModel) error {
+		unfinished_ = append(unfinished_, cert)
+		return nil
+	})
+	if err != nil {
+		return summary, fmt.Errorf("listing unfinished certificates: %w", err)
+	}
+	var errs_ []error
+	for _, cert := range unfinished_ {
+		logger_ := c.logger().With("commonName", cert.CommonName, "status", cert.Status, "certId", cert.ID)
+		if !opts.inScope(cert) {
+			summary.OutOfScope++
+			continue
+		}
+		if opts.MinAge > 0 && (cert.Created.IsZero() || time.Since(cert.Created) < opts.MinAge) {
+			logger_.Info("Keeping unfinished certificate younger than min age", "created", cert.Created)
+			summary.TooYoung = append(summary.TooYoung, cert)
+			continue
+		}
+		if opts.DryRun {
+			logger_.Info("Would cancel unfinished certificate")
+			summary.Cancelled = append(summary.Cancelled, cert)
+			continue
+		}
+		logger_.Info("Cancelling unfinished certificate")
+		if cancelErr := c.CancelCert(cert.ID); cancelErr != nil {
+			summary.Failed = append(summary.Failed, CleanFailure{Cert: cert, Error: cancelErr.Error()})
+			errs_ = append(errs_, fmt.Errorf("cancelling certificate %v: %w", cert.ID, cancelErr))
+			continue
+		}
+		summary.Cancelled = append(summary.Cancelled, cert)
+	}
+	return summary, errors.Join(errs_...)
 }
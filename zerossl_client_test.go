@@ -17,10 +17,18 @@
 package zerosslIPCert
 
 import (
+	"context"
 	"crypto/elliptic"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -33,13 +41,8 @@ func TestZeroSSLClient_GetCert(t *testing.T) {
 		t.Error(err)
 		return
 	}
-	expireTime_, err := time.Parse("2006-01-02 15:04:05", cert_.Expires)
-	if err != nil {
-		t.Error(err)
-	} else {
-		if time.Now().Add(time.Hour * 24 * 29).After(expireTime_) {
-			t.Log("Expiring soon.")
-		}
+	if time.Now().Add(time.Hour * 24 * 29).After(cert_.Expires) {
+		t.Log("Expiring soon.")
 	}
 	t.Logf("cert: %#v", cert_)
 }
@@ -65,7 +68,12 @@ func TestClient_CreateCert(t *testing.T) {
 		t.Error("failed to get csr string")
 		return
 	}
-	cert_, err := c_.CreateCert("example.com", csrStr_, "90", "1")
+	cert_, err := c_.CreateCert(CreateCertRequest{
+		Domains:       []string{"example.com"},
+		CSR:           []byte(csrStr_),
+		ValidityDays:  90,
+		StrictDomains: true,
+	})
 	if err != nil {
 		t.Error(err)
 		return
@@ -105,7 +113,7 @@ func TestClient_VerificationStatus(t *testing.T) {
 
 func TestClient_DownloadCertInline(t *testing.T) {
 	c_ := &Client{ApiKey: "x"}
-	cert_, err := c_.DownloadCertInline("x", "1")
+	cert_, err := c_.DownloadCertInline("x", true)
 	if err != nil {
 		t.Error(err)
 		return
@@ -117,7 +125,7 @@ func TestClient_DownloadCertInline(t *testing.T) {
 
 func TestClient_ListCerts(t *testing.T) {
 	c_ := &Client{ApiKey: "x"}
-	rspModel_, err := c_.ListCerts("", "example.com", "", "")
+	rspModel_, err := c_.ListCerts(CertsFilter{Search: "example.com"}, 0)
 	if err != nil {
 		t.Error(err)
 		return
@@ -127,7 +135,363 @@ func TestClient_ListCerts(t *testing.T) {
 
 func Test_CleanUnfinished(t *testing.T) {
 	c_ := &Client{ApiKey: "x"}
-	if err := c_.CleanUnfinished(); err != nil {
+	if _, err := c_.CleanUnfinished(CleanOptions{DryRun: true}); err != nil {
 		t.Logf("Failed to clean unfinished issuing certificate: %v\n", err)
 	}
 }
+
+type roundTripFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// stubTransport replaces transport of the default http client during the test.
+func stubTransport(t *testing.T, f roundTripFunc) {
+	orig_ := http.DefaultClient.Transport
+	http.DefaultClient.Transport = f
+	t.Cleanup(func() { http.DefaultClient.Transport = orig_ })
+}
+
+func TestClient_OnApiCall(t *testing.T) {
+	stubTransport(t, func(req *http.Request) (*http.Response, error) {
+		if strings.HasSuffix(req.URL.Path, "/cancel") {
+			return &http.Response{StatusCode: http.StatusNotFound, Body: io.NopCloser(strings.NewReader("{}"))}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"id":"x"}`))}, nil
+	})
+	var calls_ []string
+	c_ := &Client{ApiKey: "x", OnApiCall: func(api string, statusCode int, err error) {
+		calls_ = append(calls_, fmt.Sprintf("%v %d %v", api, statusCode, err != nil))
+	}}
+	if _, err := c_.GetCert("x"); err != nil {
+		t.Error(err)
+	}
+	if err := c_.CancelCert("x"); err == nil {
+		t.Error("expect error of status code 404")
+	}
+	want_ := []string{"get_certificate 200 false", "cancel_certificate 404 true"}
+	if strings.Join(calls_, ",") != strings.Join(want_, ",") {
+		t.Errorf("api calls: %v", calls_)
+	}
+}
+
+type rateLimiterFunc func(ctx context.Context) error
+
+func (f rateLimiterFunc) Wait(ctx context.Context) error { return f(ctx) }
+
+func TestClient_RateLimiter(t *testing.T) {
+	requests_ := 0
+	stubTransport(t, func(req *http.Request) (*http.Response, error) {
+		requests_++
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"id":"x"}`))}, nil
+	})
+	waits_ := 0
+	var waitErr error
+	c_ := &Client{ApiKey: "x", RateLimiter: rateLimiterFunc(func(ctx context.Context) error {
+		waits_++
+		return waitErr
+	})}
+	if _, err := c_.GetCert("x"); err != nil || waits_ != 1 || requests_ != 1 {
+		t.Errorf("waits %d, requests %d, error %v", waits_, requests_, err)
+	}
+	waitErr = context.Canceled
+	if _, err := c_.GetCert("x"); !errors.Is(err, context.Canceled) || waits_ != 2 || requests_ != 1 {
+		t.Errorf("waits %d, requests %d, error %v", waits_, requests_, err)
+	}
+}
+
+func TestClient_RevokeCert(t *testing.T) {
+	stubTransport(t, func(req *http.Request) (*http.Response, error) {
+		if req.Method != http.MethodPost || req.URL.Path != "/certificates/x/revoke" {
+			t.Errorf("unexpected request %v %v", req.Method, req.URL.Path)
+		}
+		if err := req.ParseForm(); err != nil || req.PostForm.Get("reason") != RevokeReason.KeyCompromise {
+			t.Errorf("unexpected reason %q, error %v", req.PostForm.Get("reason"), err)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(`{"success":1}`))}, nil
+	})
+	c_ := &Client{ApiKey: "x"}
+	if err := c_.RevokeCert("x", RevokeReason.KeyCompromise); err != nil {
+		t.Error(err)
+	}
+}
+
+// listCertsApi serves list of total certs in the statuses, with page in response as a string on even pages.
+type listCertsApi struct {
+	total int
+	// The limit is capped at maxLimit if it's positive.
+	maxLimit int
+	// Total count is reported as 0, and the first page is served for any page if ignorePage.
+	hideTotal, ignorePage bool
+}
+
+func listCertsHandler(t *testing.T, api listCertsApi, requests *[]url.Values) roundTripFunc {
+	return func(req *http.Request) (*http.Response, error) {
+		q_ := req.URL.Query()
+		*requests = append(*requests, q_)
+		if q_.Get("search") != "" {
+			t.Errorf("unexpected search %q", q_.Get("search"))
+		}
+		limit_, _ := strconv.Atoi(q_.Get("limit"))
+		if api.maxLimit > 0 && limit_ > api.maxLimit {
+			limit_ = api.maxLimit
+		}
+		page_, _ := strconv.Atoi(q_.Get("page"))
+		from_ := (page_ - 1) * limit_
+		if api.ignorePage {
+			from_ = 0
+		}
+		var results_ []string
+		for i := from_; i < from_+limit_ && i < api.total; i++ {
+			// Certs of odd index are just created, others two days ago.
+			created_ := time.Now().Add(-48 * time.Hour)
+			if i%2 == 1 {
+				created_ = time.Now()
+			}
+			results_ = append(results_, fmt.Sprintf(`{"id":"c%d","common_name":"10.0.0.%d","status":"draft","created":%q}`,
+				i, i%3, created_.UTC().Format(TimeLayout)))
+		}
+		pageJson_ := strconv.Itoa(page_)
+		if page_%2 == 0 {
+			pageJson_ = strconv.Quote(pageJson_)
+		}
+		total_ := api.total
+		if api.hideTotal {
+			total_ = 0
+		}
+		body_ := fmt.Sprintf(`{"total_count":%d,"result_count":%d,"page":%v,"limit":%d,"results":[%v]}`,
+			total_, len(results_), pageJson_, limit_, strings.Join(results_, ","))
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body_))}, nil
+	}
+}
+
+func TestClient_AllCerts(t *testing.T) {
+	for _, c := range []struct {
+		total, pageSize, maxLimit, wantRequests int
+		hideTotal                               bool
+	}{
+		{total: 0, pageSize: 100, wantRequests: 1},
+		{total: 99, pageSize: 100, wantRequests: 1},
+		{total: 200, pageSize: 100, wantRequests: 2},
+		{total: 250, pageSize: 100, wantRequests: 3},
+		{total: 250, pageSize: 0, wantRequests: 3},
+		{total: 7, pageSize: 2, wantRequests: 4},
+		{total: 250, pageSize: 200, maxLimit: 100, wantRequests: 3},
+		{total: 100, pageSize: 200, maxLimit: 50, wantRequests: 2},
+		{total: 250, pageSize: 100, hideTotal: true, wantRequests: 3},
+		{total: 200, pageSize: 200, maxLimit: 100, hideTotal: true, wantRequests: 3},
+	} {
+		var requests_ []url.Values
+		stubTransport(t, listCertsHandler(t, listCertsApi{total: c.total, maxLimit: c.maxLimit, hideTotal: c.hideTotal},
+			&requests_))
+		seen_ := make(map[string]bool)
+		err := (&Client{ApiKey: "x"}).AllCerts(context.Background(), CertsFilter{
+			Statuses: []string{CertStatus.Draft, CertStatus.PendingValidation},
+			PageSize: c.pageSize,
+		}, func(cert CertificateInfoModel) error {
+			if seen_[cert.ID] {
+				t.Errorf("duplicate cert %v", cert.ID)
+			}
+			seen_[cert.ID] = true
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(seen_) != c.total || len(requests_) != c.wantRequests {
+			t.Errorf("total %d page size %d: got %d certs in %d requests", c.total, c.pageSize, len(seen_),
+				len(requests_))
+		}
+		if requests_[0].Get("certificate_status") != "draft,pending_validation" {
+			t.Errorf("status filter %q", requests_[0].Get("certificate_status"))
+		}
+	}
+
+	var requests_ []url.Values
+	stubTransport(t, listCertsHandler(t, listCertsApi{total: 250}, &requests_))
+	count_ := 0
+	err := (&Client{ApiKey: "x"}).AllCerts(context.Background(), CertsFilter{}, func(CertificateInfoModel) error {
+		if count_++; count_ == 150 {
+			return StopIteration
+		}
+		return nil
+	})
+	if err != nil || count_ != 150 || len(requests_) != 2 {
+		t.Errorf("stop iteration: err %v, %d certs, %d requests", err, count_, len(requests_))
+	}
+	// Full pages without total count, whatever the page is.
+	requests_ = nil
+	stubTransport(t, listCertsHandler(t, listCertsApi{total: 250, hideTotal: true, ignorePage: true}, &requests_))
+	if err = (&Client{ApiKey: "x"}).AllCerts(context.Background(), CertsFilter{}, func(CertificateInfoModel) error {
+		return nil
+	}); err == nil || len(requests_) != MaxListPages {
+		t.Errorf("endless pages: err %v, %d requests", err, len(requests_))
+	}
+	ctx_, cancel_ := context.WithCancel(context.Background())
+	cancel_()
+	if err = (&Client{ApiKey: "x"}).AllCerts(ctx_, CertsFilter{}, func(CertificateInfoModel) error {
+		return nil
+	}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context canceled, got %v", err)
+	}
+}
+
+func TestClient_CleanUnfinished(t *testing.T) {
+	for _, c := range []struct {
+		name                              string
+		opts                              CleanOptions
+		failCancel                        bool
+		wantCancelled, wantYoung, wantOut int
+		wantRequests, wantFailed          int
+	}{
+		{name: "all", wantCancelled: 150, wantRequests: 150},
+		{name: "scoped", opts: CleanOptions{CommonNames: []string{"10.0.0.0"}, CertIDs: []string{"c1", "c2"},
+			MinAge: time.Hour}, wantCancelled: 26, wantYoung: 26, wantOut: 98, wantRequests: 26},
+		{name: "dry run", opts: CleanOptions{CommonNames: []string{"10.0.0.0"}, MinAge: time.Hour, DryRun: true},
+			wantCancelled: 25, wantYoung: 25, wantOut: 100},
+		{name: "excluded", opts: CleanOptions{CertIDs: []string{"c0", "c2", "c4"}, Exclude: []string{"c2"}},
+			wantCancelled: 2, wantOut: 148, wantRequests: 2},
+		{name: "failed", opts: CleanOptions{CertIDs: []string{"c0", "c2"}}, failCancel: true, wantOut: 148,
+			wantRequests: 2, wantFailed: 2},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var requests_ []url.Values
+			list_ := listCertsHandler(t, listCertsApi{total: 150}, &requests_)
+			var cancelled_ []string
+			stubTransport(t, func(req *http.Request) (*http.Response, error) {
+				if strings.HasSuffix(req.URL.Path, "/cancel") {
+					cancelled_ = append(cancelled_, strings.Split(req.URL.Path, "/")[2])
+					status_ := http.StatusOK
+					if c.failCancel {
+						status_ = http.StatusInternalServerError
+					}
+					return &http.Response{StatusCode: status_, Body: io.NopCloser(strings.NewReader(`{"success":1}`))},
+						nil
+				}
+				return list_(req)
+			})
+			summary_, err := (&Client{ApiKey: "x"}).CleanUnfinished(c.opts)
+			if (err != nil) != (c.wantFailed > 0) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(summary_.Cancelled) != c.wantCancelled || len(summary_.TooYoung) != c.wantYoung ||
+				summary_.OutOfScope != c.wantOut || len(summary_.Failed) != c.wantFailed ||
+				summary_.DryRun != c.opts.DryRun {
+				t.Errorf("unexpected summary: cancelled %d, too young %d, out of scope %d, failed %d",
+					len(summary_.Cancelled), len(summary_.TooYoung), summary_.OutOfScope, len(summary_.Failed))
+			}
+			if len(cancelled_) != c.wantRequests {
+				t.Errorf("cancel requested %d times", len(cancelled_))
+			}
+		})
+	}
+}
+
+func TestFlexibleInt_UnmarshalJSON(t *testing.T) {
+	for input, want := range map[string]FlexibleInt{`2`: 2, `"3"`: 3, `""`: 0, `null`: 0} {
+		var got_ FlexibleInt
+		if err := json.Unmarshal([]byte(input), &got_); err != nil || got_ != want {
+			t.Errorf("%v: got %v, error %v", input, got_, err)
+		}
+	}
+	var got_ FlexibleInt
+	if err := json.Unmarshal([]byte(`"x"`), &got_); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestClient_CreateCert_request(t *testing.T) {
+	var form_ url.Values
+	stubTransport(t, func(req *http.Request) (*http.Response, error) {
+		if err := req.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		form_ = req.PostForm
+		body_ := `{"id":"x","created":"2022-01-02 03:04:05","expires":"2022-04-02 03:04:05"}`
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(body_))}, nil
+	})
+	csr_, err := GenEccCSR(pkix.Name{CommonName: "192.0.2.1"}, GenEccKey(elliptic.P256()), x509.ECDSAWithSHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req_ := CreateCertRequest{Domains: []string{"192.0.2.1"}, CSR: []byte(GetCSRString(csr_)), ValidityDays: 365,
+		StrictDomains: true}
+	cert_, err := (&Client{ApiKey: "x"}).CreateCert(req_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form_.Get("certificate_domains") != "192.0.2.1" || form_.Get("certificate_validity_days") != "365" ||
+		form_.Get("strict_domains") != "1" || !strings.Contains(form_.Get("certificate_csr"), "CERTIFICATE REQUEST") {
+		t.Errorf("form %v", form_)
+	}
+	if want_ := time.Date(2022, 4, 2, 3, 4, 5, 0, time.UTC); !cert_.Expires.Equal(want_) {
+		t.Errorf("expires %v", cert_.Expires)
+	}
+
+	form_ = nil
+	for _, invalid := range []CreateCertRequest{
+		{CSR: req_.CSR},
+		{Domains: []string{""}, CSR: req_.CSR},
+		{Domains: req_.Domains, CSR: []byte("csr")},
+		{Domains: req_.Domains, CSR: req_.CSR, ValidityDays: 30},
+	} {
+		if _, err = (&Client{ApiKey: "x"}).CreateCert(invalid); err == nil {
+			t.Errorf("expected error of %+v", invalid)
+		}
+	}
+	if form_ != nil {
+		t.Errorf("invalid request sent")
+	}
+}
+
+func TestCertificateInfoModel_JSON(t *testing.T) {
+	var cert_ CertificateInfoModel
+	// Validation can be an empty array, other fields are still unmarshalled.
+	err := json.Unmarshal([]byte(`{"id":"x","created":"2022-01-02 03:04:05","expires":"","validation":[]}`), &cert_)
+	var typeErr_ *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr_) {
+		t.Errorf("expected type error, got %v", err)
+	}
+	if cert_.ID != "x" || !cert_.Created.Equal(time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)) ||
+		!cert_.Expires.IsZero() {
+		t.Errorf("cert %+v", cert_)
+	}
+	data_, err := json.Marshal(cert_)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data_), `"created":"2022-01-02 03:04:05"`) ||
+		!strings.Contains(string(data_), `"expires":""`) {
+		t.Errorf("marshalled %s", data_)
+	}
+	if err = json.Unmarshal([]byte(`{"created":"yesterday"}`), &cert_); err == nil {
+		t.Errorf("expected error of invalid time")
+	}
+}
+
+func TestClient_RedactApiKey(t *testing.T) {
+	const apiKey_ = "s3cr3t+key"
+	stubTransport(t, func(req *http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("dial tcp: lookup %v: no such host", req.URL.Host)
+	})
+	var logs_ strings.Builder
+	c_ := &Client{ApiKey: apiKey_, Logger: slog.New(slog.NewTextHandler(&logs_, &slog.HandlerOptions{Level: slog.LevelDebug}))}
+	_, err := c_.GetCert("x")
+	if err == nil {
+		t.Fatal("expect error")
+	}
+	_, _ = c_.CleanUnfinished(CleanOptions{})
+	for _, s := range []string{err.Error(), fmt.Sprintf("%#v", err), logs_.String()} {
+		if strings.Contains(s, apiKey_) || strings.Contains(s, url.QueryEscape(apiKey_)) {
+			t.Errorf("api key leaked: %v", s)
+		}
+	}
+	if !strings.Contains(err.Error(), "access_key="+Redacted) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	var urlErr_ *url.Error
+	if !errors.As(err, &urlErr_) {
+		t.Error("expect url error kept")
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright [2022] [tinkernels (github.com/tinkernels)]
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package zerosslIPCert
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AllowedValidityDays are validity days of certificates ZeroSSL allows.
+var AllowedValidityDays = []int{90, 365}
+
+// DefaultValidityDays is validity days of certificates when not specified.
+const DefaultValidityDays = 90
+
+// CreateCertRequest is the request of creating a certificate.
+type CreateCertRequest struct {
+	Domains       []string // the first one is the common name
+	CSR           []byte   // in pem format
+	ValidityDays  int      // DefaultValidityDays if not set, see AllowedValidityDays
+	StrictDomains bool
+}
+
+// Validate checks values of the request.
+func (r *CreateCertRequest) Validate() error {
+	if len(r.Domains) == 0 {
+		return fmt.Errorf("no domains")
+	}
+	for _, d := range r.Domains {
+		if strings.TrimSpace(d) == "" || strings.Contains(d, ",") {
+			return fmt.Errorf("invalid domain %q", d)
+		}
+	}
+	block_, _ := pem.Decode(r.CSR)
+	if block_ == nil || block_.Type != "CERTIFICATE REQUEST" {
+		return fmt.Errorf("no certificate request found in csr")
+	}
+	if _, err := x509.ParseCertificateRequest(block_.Bytes); err != nil {
+		return fmt.Errorf("invalid csr: %w", err)
+	}
+	if r.ValidityDays != 0 {
+		valid_ := false
+		for _, d := range AllowedValidityDays {
+			valid_ = valid_ || d == r.ValidityDays
+		}
+		if !valid_ {
+			return fmt.Errorf("validity days must be one of %v", AllowedValidityDays)
+		}
+	}
+	return nil
+}
+
+// params returns values of the request in api format.
+func (r *CreateCertRequest) params() (domains, csr, validityDays, strictDomains string) {
+	domains = strings.Join(r.Domains, ",")
+	csr = string(r.CSR)
+	if r.ValidityDays != 0 {
+		validityDays = strconv.Itoa(r.ValidityDays)
+	}
+	if r.StrictDomains {
+		strictDomains = "1"
+	}
+	return
+}
@@ -16,6 +16,13 @@
 
 package zerosslIPCert
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
 // CertStatus represents the status of a certificate.
 var CertStatus = struct {
 	Draft             string
@@ -24,6 +31,7 @@ var CertStatus = struct {
 	Cancelled         string
 	ExpiringSoon      string
 	Expired           string
+	Revoked           string
 }{
 	Draft:             "draft",
 	PendingValidation: "pending_validation",
@@ -31,6 +39,22 @@ var CertStatus = struct {
 	Cancelled:         "cancelled",
 	ExpiringSoon:      "expiring_soon",
 	Expired:           "expired",
+	Revoked:           "revoked",
+}
+
+// RevokeReason represents reasons of revoking a certificate.
+var RevokeReason = struct {
+	Unspecified          string
+	KeyCompromise        string
+	AffiliationChanged   string
+	Superseded           string
+	CessationOfOperation string
+}{
+	Unspecified:          "unspecified",
+	KeyCompromise:        "keyCompromise",
+	AffiliationChanged:   "affiliationChanged",
+	Superseded:           "Superseded",
+	CessationOfOperation: "cessationOfOperation",
 }
 
 type CertificateInfoModel struct {
@@ -38,8 +62,8 @@ type CertificateInfoModel struct {
 	Type              string              `json:"type"`
 	CommonName        string              `json:"common_name"`
 	AdditionalDomains string              `json:"additional_domains"`
-	Created           string              `json:"created"`
-	Expires           string              `json:"expires"`
+	Created           time.Time           `json:"created"`
+	Expires           time.Time           `json:"expires"`
 	Status            string              `json:"status"`
 	ValidationType    string              `json:"validation_type"`
 	ValidationEmails  string              `json:"validation_email"`
@@ -47,6 +71,65 @@ type CertificateInfoModel struct {
 	Validation        ValidationInfoModel `json:"validation,omitempty"`
 }
 
+// TimeLayout is the layout of times in api responses, which are in UTC.
+const TimeLayout = "2006-01-02 15:04:05"
+
+// certificateInfoJson is CertificateInfoModel with times in api format.
+type certificateInfoJson struct {
+	*certificateInfoAlias
+	Created string `json:"created"`
+	Expires string `json:"expires"`
+}
+
+type certificateInfoAlias CertificateInfoModel
+
+// UnmarshalJSON unmarshals times in api format, empty times are zero.
+func (m *CertificateInfoModel) UnmarshalJSON(data []byte) (err error) {
+	json_ := certificateInfoJson{certificateInfoAlias: (*certificateInfoAlias)(m)}
+	// Type errors don't stop unmarshalling other fields (e.g. validation can be an empty array),
+	// returning them after times parsed.
+	err = json.Unmarshal(data, &json_)
+	var typeErr_ *json.UnmarshalTypeError
+	if err != nil && !errors.As(err, &typeErr_) {
+		return
+	}
+	var timeErr error
+	if m.Created, timeErr = parseApiTime(json_.Created); timeErr != nil {
+		return timeErr
+	}
+	if m.Expires, timeErr = parseApiTime(json_.Expires); timeErr != nil {
+		return timeErr
+	}
+	return
+}
+
+// MarshalJSON marshals times in api format.
+func (m CertificateInfoModel) MarshalJSON() ([]byte, error) {
+	return json.Marshal(certificateInfoJson{
+		certificateInfoAlias: (*certificateInfoAlias)(&m),
+		Created:              formatApiTime(m.Created),
+		Expires:              formatApiTime(m.Expires),
+	})
+}
+
+// parseApiTime parses time in api format, empty string is zero time.
+func parseApiTime(s string) (t time.Time, err error) {
+	if s == "" {
+		return
+	}
+	if t, err = time.ParseInLocation(TimeLayout, s, time.UTC); err != nil {
+		return t, fmt.Errorf("parsing time %q: %w", s, err)
+	}
+	return
+}
+
+func formatApiTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(TimeLayout)
+}
+
 type ValidationInfoModel struct {
 	EmailValidation map[string][]string                 `json:"email_validation"`
 	OtherMethods    map[string]OtherValidationInfoModel `json:"other_methods"`
@@ -16,11 +16,38 @@
 
 package zerosslIPCert
 
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
 type ListCertsModel struct {
 	TotalCount  int `json:"total_count"`
 	ResultCount int `json:"result_count"`
-	// Don't use the page field, because page in response is dynamic typed.
-	//Page        string                 `json:"page"`
+	// The page field in response is dynamic typed, a number or a string.
+	Page    FlexibleInt            `json:"page"`
 	Limit   int                    `json:"limit"`
 	Results []CertificateInfoModel `json:"results,omitempty"`
 }
+
+// FlexibleInt is an int in json, which can be a number or a string of number.
+type FlexibleInt int
+
+// UnmarshalJSON unmarshals a number or a string of number, empty string and null are 0.
+func (i *FlexibleInt) UnmarshalJSON(data []byte) (err error) {
+	s_ := strings.Trim(string(data), `"`)
+	if s_ == "" || s_ == "null" {
+		*i = 0
+		return
+	}
+	v_, err := strconv.Atoi(s_)
+	if err != nil {
+		return &json.UnmarshalTypeError{Value: string(data), Type: jsonIntType}
+	}
+	*i = FlexibleInt(v_)
+	return
+}
+
+var jsonIntType = reflect.TypeOf(0)
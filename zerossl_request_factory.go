@@ -43,6 +43,8 @@ var ApiReqFactory = struct {
 	CancelCertificate func(accessKey, id string) (req *http.Request)
 	// Request of downloading a certificate.
 	DownloadCertificateInline func(accessKey, certID, includeCrossSigned string) (req *http.Request)
+	// Request of revoking a certificate.
+	RevokeCertificate func(accessKey, id, reason string) (req *http.Request)
 }{
 	CreateCertificate: func(accessKey, certificateDomains, certificateCsr, certificateValidityDays,
 		strictDomains string) (req *http.Request) {
@@ -153,4 +155,20 @@ var ApiReqFactory = struct {
 		req.URL = url_
 		return
 	},
+	RevokeCertificate: func(accessKey, id, reason string) (req *http.Request) {
+		req = &http.Request{Method: http.MethodPost}
+		url_ := &url.URL{Scheme: "https", Host: ApiEndpoint, Path: "/certificates/" + id + "/revoke"}
+		q_ := make(url.Values)
+		q_.Add("access_key", accessKey)
+		url_.RawQuery = q_.Encode()
+		req.URL = url_
+		if reason != "" {
+			bodyForm_ := make(url.Values)
+			bodyForm_.Add("reason", reason)
+			req.Header = make(http.Header)
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Body = io.NopCloser(strings.NewReader(bodyForm_.Encode()))
+		}
+		return
+	},
 }